@@ -0,0 +1,345 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go/token"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"perfactor/cmd/util"
+	"perfactor/graph"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/google/uuid"
+	"github.com/owenrumney/go-sarif/sarif"
+	"github.com/plus3it/gorecurcopy"
+	"github.com/spf13/cobra"
+)
+
+var analyzeCmd = &cobra.Command{
+	Use:   "analyze [packages]",
+	Short: "Rank the loops of a project's packages as candidates for concurrency, without rewriting anything",
+	Long: `Finds the loops of the packages matching the pattern, "./..." by default, checks them against the safety rules,
+and ranks them by the share of the profile they take and the speedup the model predicts for them.
+The profile is taken from --Profile if given, or else by running each package's benchmarks in a copy of the project.
+The benchmarks are run with --Profile too, unless --Predict=false, since the predictions need their time per op.
+Neither the project nor the Output folder is written to.`,
+	Run: analyze,
+}
+
+func init() {
+	analyzeCmd.Flags().StringP("project", "p", "", "The path to the project")
+	analyzeCmd.Flags().StringP("benchname", "b", ".", "The -bench pattern of the benchmarks to profile in each package")
+	analyzeCmd.Flags().StringArrayP("Profile", "", nil, "A CPU profile captured elsewhere to rank the loops with instead of the benchmarks; may be repeated")
+	analyzeCmd.Flags().StringP("Id", "n", "", "The Id of the run, which names the temporary folder")
+	analyzeCmd.Flags().StringP("Flags", "", "", "Any Flags to pass to the program")
+	analyzeCmd.Flags().StringP("Accept", "a", "", "Accept an identifier in a given loop")
+	analyzeCmd.Flags().IntP("Count", "c", 1, "The number of times to run each benchmark")
+	analyzeCmd.Flags().DurationP("Timeout", "", 10*time.Minute, "The maximum time a single benchmark run may take before it is killed")
+	analyzeCmd.Flags().Float32P("Threshold", "d", 10.0, "The percentage of the profile a safe loop must take to be a candidate")
+	analyzeCmd.Flags().BoolP("Predict", "", true, "Predict the speedup of each loop, with the cost of a goroutine measured on this machine, and mark those predicted to be slower")
+	analyzeCmd.Flags().StringP("Format", "", "text", "The format of the report: text, json or sarif")
+	analyzeCmd.Flags().StringP("Out", "", "", "The file to write the report to, or stdout if empty")
+	RootCmd.AddCommand(analyzeCmd)
+}
+
+// analysisSettings are the flags of the analyze command
+type analysisSettings struct {
+	projectPath string
+	pattern     string
+	benchName   string
+	profiles    []string
+	id          string
+	flags       string
+	accept      string
+	count       int
+	timeout     time.Duration
+	threshold   float32
+	predict     bool
+	format      string
+	outPath     string
+}
+
+func analyze(cmd *cobra.Command, args []string) {
+	as, err := analysisSettingsFrom(cmd, args)
+	if err != nil {
+		fmt.Printf("Error getting Flags: %s\n", err.Error())
+		return
+	}
+
+	// stop cleanly on ctrl+c or SIGTERM, as full does, so the benchmarks are killed and the workspace removed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// progress goes to stderr, so that the report can be piped from stdout
+	report, err := analyzeProject(ctx, as, os.Stderr)
+	if err != nil {
+		fmt.Printf("Error analysing %s: %s\n", as.projectPath, err.Error())
+		return
+	}
+
+	var out io.Writer = os.Stdout
+	if as.outPath != "" {
+		file, err := os.Create(as.outPath)
+		if err != nil {
+			fmt.Printf("Error creating %s: %s\n", as.outPath, err.Error())
+			return
+		}
+		defer file.Close()
+		out = file
+	}
+	switch as.format {
+	case "json":
+		err = report.WriteJSON(out)
+	case "sarif":
+		err = report.WriteSARIF(out)
+	default:
+		err = report.WriteText(out)
+	}
+	if err != nil {
+		fmt.Printf("Error writing the report: %s\n", err.Error())
+		return
+	}
+	if as.outPath != "" {
+		fmt.Printf("Wrote the analysis of %d loops to %s\n", len(report.Loops), as.outPath)
+	}
+}
+
+func analysisSettingsFrom(cmd *cobra.Command, args []string) (analysisSettings, error) {
+	as := analysisSettings{pattern: "./..."}
+	if len(args) > 0 {
+		as.pattern = args[0]
+	}
+	var err error
+	as.projectPath, err = cmd.Flags().GetString("project")
+	if err != nil {
+		return as, err
+	}
+	if as.projectPath == "" {
+		return as, errors.New("no project path provided")
+	}
+	if !strings.HasSuffix(as.projectPath, p) {
+		as.projectPath += p
+	}
+	as.benchName, err = cmd.Flags().GetString("benchname")
+	if err != nil {
+		return as, err
+	}
+	as.profiles, err = cmd.Flags().GetStringArray("Profile")
+	if err != nil {
+		return as, err
+	}
+	as.id, err = cmd.Flags().GetString("Id")
+	if err != nil {
+		return as, err
+	}
+	if as.id == "" {
+		as.id = uuid.New().String()
+	}
+	as.flags, err = cmd.Flags().GetString("Flags")
+	if err != nil {
+		return as, err
+	}
+	as.accept, err = cmd.Flags().GetString("Accept")
+	if err != nil {
+		return as, err
+	}
+	as.count, err = cmd.Flags().GetInt("Count")
+	if err != nil {
+		return as, err
+	}
+	as.timeout, err = cmd.Flags().GetDuration("Timeout")
+	if err != nil {
+		return as, err
+	}
+	as.threshold, err = cmd.Flags().GetFloat32("Threshold")
+	if err != nil {
+		return as, err
+	}
+	as.predict, err = cmd.Flags().GetBool("Predict")
+	if err != nil {
+		return as, err
+	}
+	as.format, err = cmd.Flags().GetString("Format")
+	if err != nil {
+		return as, err
+	}
+	if as.format != "text" && as.format != "json" && as.format != "sarif" {
+		return as, fmt.Errorf("unknown format %q: use text, json or sarif", as.format)
+	}
+	as.outPath, err = cmd.Flags().GetString("Out")
+	if err != nil {
+		return as, err
+	}
+	return as, nil
+}
+
+// analyzeProject copies the project to a temporary folder, where the packages are loaded and their benchmarks run
+// The folder is removed when it is done, so the analysis leaves nothing behind
+func analyzeProject(ctx context.Context, as analysisSettings, log io.Writer) (util.AnalysisReport, error) {
+	report := util.AnalysisReport{Project: as.projectPath, Threshold: as.threshold}
+	tmpPath := "_tmp" + p + as.id + p
+	util.CleanOrCreateTempFolder(tmpPath)
+	defer func() {
+		if err := os.RemoveAll(tmpPath); err != nil {
+			_, _ = fmt.Fprintf(log, "Warning: could not remove the temp folder %s: %s\n", tmpPath, err.Error())
+		}
+	}()
+	err := gorecurcopy.CopyDirectory(as.projectPath, tmpPath)
+	if err != nil {
+		return report, fmt.Errorf("could not copy the project to the temp folder: %w", err)
+	}
+	root, err := filepath.Abs(tmpPath)
+	if err != nil {
+		return report, err
+	}
+
+	var given *profile.Profile
+	if len(as.profiles) > 0 {
+		given, err = util.LoadProfiles(as.profiles, as.projectPath)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	fileSet := token.NewFileSet()
+	pkgs := loadPackages(tmpPath, fileSet, as.pattern, log)
+	if len(pkgs) == 0 {
+		return report, fmt.Errorf("no packages match %s", as.pattern)
+	}
+	acceptMap := getAcceptMap(as.accept, log)
+	cores := benchmarkCores(as.flags)
+	var overhead time.Duration
+	if as.predict {
+		overhead = util.MeasureSpawnOverhead()
+		_, _ = fmt.Fprintf(log, "Starting a goroutine and waiting for it takes %s on this machine\n", overhead)
+	}
+	for _, pkg := range pkgs {
+		if len(pkg.Errors) > 0 {
+			_, _ = fmt.Fprintf(log, "Warning: skipping %s, which does not load: %s\n", pkg.PkgPath, pkg.Errors[0].Msg)
+			continue
+		}
+		if len(pkg.CompiledGoFiles) == 0 {
+			continue
+		}
+		report.Packages = append(report.Packages, pkg.PkgPath)
+		dir, err := filepath.Rel(root, filepath.Dir(pkg.CompiledGoFiles[0]))
+		if err != nil {
+			_, _ = fmt.Fprintf(log, "Warning: skipping %s, which is outside the project\n", pkg.PkgPath)
+			continue
+		}
+
+		prof, nsPerOp := given, 0.0
+		if prof == nil {
+			prof, nsPerOp = profilePackage(ctx, as, tmpPath, dir, log)
+		} else if as.predict {
+			// the given profile ranks the loops, but only the benchmarks give the time per op the predictions need
+			_, nsPerOp = profilePackage(ctx, as, tmpPath, dir, log)
+		}
+		var total int64
+		if prof != nil {
+			total = util.ProfileTotal(prof)
+		}
+		thresholdNanos := int64((float32(total) / 100) * as.threshold)
+
+		for i, filePath := range pkg.CompiledGoFiles {
+			if !strings.HasPrefix(filePath, root) {
+				// cgo's generated files are in the build cache
+				continue
+			}
+			fileName, _ := filepath.Rel(root, filePath)
+			fileName = filepath.ToSlash(fileName)
+			astFile := pkg.Syntax[i]
+			loops := util.FindForLoopsInAST(astFile, fileSet, nil)
+			if len(loops) == 0 {
+				continue
+			}
+			run := sarif.NewRun("perfactor", "uri_placeholder")
+			safe := util.FindSafeLoopsForRefactoring(loops, fileSet, run, filePath, acceptMap, pkg.TypesInfo, io.Discard)
+			findings := util.RuleFindings(run)
+			isSafe := make(map[token.Pos]bool, len(safe))
+			for _, loop := range safe {
+				isSafe[loop.Pos] = true
+			}
+
+			times := make([]int64, len(loops))
+			matches := make([]string, len(loops))
+			if prof != nil {
+				sampled, loopMatches := util.AttributeSamples(prof, loops, graph.File{Path: fileName, Package: pkg.PkgPath})
+				copy(times, sampled)
+				for j, m := range loopMatches {
+					matches[j] = m.String()
+				}
+			} else {
+				for j := range matches {
+					matches[j] = "no profile"
+				}
+			}
+
+			for j, loop := range loops {
+				l := util.AnalysedLoop{Package: pkg.PkgPath, File: fileName, Line: loop.Line, EndLine: loop.EndLine, Func: loop.Func,
+					Time: times[j], Match: matches[j], Reasons: findings[loop.Line]}
+				if total > 0 {
+					l.Share = float64(times[j]) / float64(total) * 100
+				}
+				switch {
+				case !isSafe[loop.Pos]:
+					l.Verdict = util.VerdictUnsafe
+				case times[j] == 0 || times[j] < thresholdNanos:
+					l.Verdict = util.VerdictCold
+				default:
+					l.Verdict = util.VerdictCandidate
+				}
+				if as.predict && nsPerOp > 0 && l.Verdict != util.VerdictUnsafe && times[j] > 0 {
+					l.Iterations = util.StaticIterations(loop, pkg.TypesInfo)
+					prediction := util.PredictSpeedup(times[j], total, nsPerOp, l.Iterations, cores, overhead)
+					l.Predicted = prediction.PerIteration
+					if l.Verdict == util.VerdictCandidate && prediction.Loses() {
+						l.Verdict = util.VerdictPredictedSlower
+					}
+				}
+				report.Loops = append(report.Loops, l)
+			}
+		}
+	}
+	sort.Strings(report.Packages)
+	report.Rank()
+	return report, nil
+}
+
+// profilePackage runs the benchmarks of the package in dir, within the copy of the project, and merges their profiles
+// It gives a nil profile if the package has no benchmarks or they fail, after saying why
+func profilePackage(ctx context.Context, as analysisSettings, tmpPath string, dir string, log io.Writer) (*profile.Profile, float64) {
+	folderPath := tmpPath
+	if dir != "." {
+		folderPath += dir + p
+	}
+	names, err := util.MatchingBenchmarks(ctx, as.timeout, folderPath, as.benchName)
+	if err != nil {
+		_, _ = fmt.Fprintf(log, "Warning: could not list the benchmarks in %s: %s\n", dir, err.Error())
+		return nil, 0
+	}
+	if len(names) == 0 {
+		_, _ = fmt.Fprintf(log, "No benchmarks in %s, so its loops are not measured\n", dir)
+		return nil, 0
+	}
+	_, _ = fmt.Fprintf(log, "Profiling %s in %s\n", strings.Join(names, ", "), dir)
+	runs, result := util.ProfileBenchmarks(ctx, as.timeout, as.flags, as.id, folderPath, folderPath, names, as.count)
+	if !result.Ok() || len(runs) == 0 {
+		_, _ = fmt.Fprintf(log, "Warning: the benchmarks in %s failed: %s\n", dir, result.FailureSummary())
+		return nil, 0
+	}
+	prof, err := util.MergeProfiles(runs, nil)
+	if err != nil {
+		_, _ = fmt.Fprintf(log, "Warning: could not merge the profiles of %s: %s\n", dir, err.Error())
+		return nil, 0
+	}
+	// the ns/op of each benchmark is already the mean of its runs
+	return prof, util.TotalNsPerOp(result.Output)
+}
@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"context"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"perfactor/cmd/util"
+	"strings"
+	"testing"
+)
+
+// applySource has two loops to rewrite, and a function gofmt would change that the commits must leave alone
+const applySource = `package work
+
+func first(a []int) {
+	for i := range a {
+		a[i] = i
+	}
+}
+
+func   untouched( ) int { return 1 }
+
+func second(a []int) {
+	for i := range a {
+		a[i] *= 2
+	}
+}
+`
+
+func gitIn(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %s\n%s", strings.Join(args, " "), err, output)
+	}
+	return string(output)
+}
+
+func TestApplyPatchesCommitsEachLoop(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	for _, env := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME", "GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(env, "perfactor@example.com")
+	}
+	pf := ProgramSettings{ProjectPath: dir + p, FileName: "work.go", Id: "session", Apply: true, Commit: true}
+	path := filepath.Join(dir, pf.FileName)
+	if err := os.WriteFile(path, []byte(applySource), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gitIn(t, dir, "init", "-q")
+	gitIn(t, dir, "add", pf.FileName)
+	gitIn(t, dir, "commit", "-qm", "initial")
+
+	fileSet := token.NewFileSet()
+	astFile, err := parser.ParseFile(fileSet, path, applySource, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &types.Info{Types: make(map[ast.Expr]types.TypeAndValue), Defs: make(map[*ast.Ident]types.Object), Uses: make(map[*ast.Ident]types.Object)}
+	if _, err := (&types.Config{}).Check("work", fileSet, []*ast.File{astFile}, info); err != nil {
+		t.Fatal(err)
+	}
+	var patches []util.LoopPatch
+	for _, line := range []int{4, 12} {
+		util.MakeLoopConcurrent(astFile, fileSet, line, info)
+		patches = append(patches, newLoopPatch(io.Discard, patches, fileSet, astFile, pf, line, 0, 0, 0))
+	}
+
+	if _, err := applyPatches(context.Background(), io.Discard, patches, pf, false); err != nil {
+		t.Fatal(err)
+	}
+	for i, commit := range []struct {
+		rev     string
+		changed string
+		kept    string
+	}{
+		{"HEAD~1", "func first", "func second"},
+		{"HEAD", "func second", "func first"},
+	} {
+		diff := gitIn(t, dir, "show", "--format=", "-U0", commit.rev)
+		if strings.Contains(diff, "untouched") {
+			t.Errorf("commit %d reformats a function it does not change:\n%s", i+1, diff)
+		}
+		if !strings.Contains(diff, "@@ "+commit.changed) || strings.Contains(diff, "@@ "+commit.kept) {
+			t.Errorf("commit %d should change %s alone:\n%s", i+1, commit.changed, diff)
+		}
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != patches[1].Source || !strings.Contains(string(got), "func   untouched( ) int { return 1 }") {
+		t.Errorf("the project's file is not the last patch's source:\n%s", got)
+	}
+
+	// a file edited during the run is not overwritten
+	gitIn(t, dir, "reset", "-q", "--hard", "HEAD~2")
+	if err := os.WriteFile(path, []byte(applySource+"\nvar edited = true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyPatches(context.Background(), io.Discard, patches, pf, false); err == nil {
+		t.Errorf("applying the patches over an edited file gave no error")
+	}
+}
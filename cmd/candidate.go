@@ -0,0 +1,245 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/printer"
+	"go/token"
+	"io"
+	"os"
+	"perfactor/cmd/util"
+	"strconv"
+	"sync"
+
+	"github.com/plus3it/gorecurcopy"
+)
+
+// stageFailure describes the stage that rejected a candidate, and why
+type stageFailure struct {
+	stage  util.Stage
+	reason string
+	detail string
+	races  []util.RaceReport
+	// dependences are the loop-carried dependences seen while the tests ran, whose lines are attached to the SARIF result
+	dependences []util.Dependence
+}
+
+// candidate is a loop that has been made concurrent in a workspace
+type candidate struct {
+	fileSet *token.FileSet
+	astFile *ast.File
+	// failure is nil if the candidate passed every stage that was run
+	failure *stageFailure
+}
+
+// checkSettings selects the stages checkCandidate runs
+type checkSettings struct {
+	vet  bool
+	race bool
+	// rewriteOnly skips every stage, for when the verdict is already known from the parallel check
+	rewriteOnly bool
+}
+
+// checkCandidate makes the loop on the given line concurrent, writes it into the workspace,
+// and runs it through the stages up to, but not including, the benchmark
+// The file is read from the workspace and type-checked against its packages, loaded once in w
+// An error is only returned if the candidate could not be made at all, or the run was cancelled
+func checkCandidate(ctx context.Context, w *workspacePackages, workspace string, pkgName string, line int, pf ProgramSettings, stages checkSettings) (candidate, error) {
+	filePath := workspace + pf.FileName
+	original, err := os.ReadFile(filePath)
+	if err != nil {
+		return candidate{}, err
+	}
+	// a fresh AST every time, since the rewrite changes it in place
+	c := candidate{fileSet: w.fileSet}
+	astFile, info, err := w.parse(pkgName, filePath, original)
+	if err != nil {
+		return c, err
+	}
+	c.astFile = astFile
+
+	// Do the refactoring of the loopPos
+	util.MakeLoopConcurrent(astFile, c.fileSet, line, info)
+
+	// ------ run the stages, cheapest first; the first one to fail rejects the loop
+
+	// type-check the rewritten package in memory, before anything is written to disk
+	var src bytes.Buffer
+	err = printer.Fprint(&src, c.fileSet, astFile)
+	if err != nil {
+		return c.fail(util.StageTypeCheck, "could not print the rewritten file", err.Error()), nil
+	}
+	if !stages.rewriteOnly {
+		typeErrors, err := w.typeCheck(pkgName, filePath, src.Bytes())
+		if err != nil {
+			return c.fail(util.StageTypeCheck, "could not parse the rewritten file", err.Error()), nil
+		}
+		if len(typeErrors) > 0 {
+			return c.fail(util.StageTypeCheck, typeErrors[0].Msg, joinTypeErrors(typeErrors)), nil
+		}
+	}
+
+	//Program writes current state of AST to file, into a folder with a copy of the project (the tmp folder)
+	util.WriteModifiedAST(c.fileSet, astFile, workspace, pf.FileName)
+	if stages.rewriteOnly {
+		return c, nil
+	}
+
+	output, err := util.BuildPackage(ctx, pf.Timeout, workspace)
+	if err != nil {
+		return c.commandFailed(ctx, util.StageBuild, output, err)
+	}
+	if stages.vet {
+		output, err = util.VetPackage(ctx, pf.Timeout, workspace)
+		if err != nil {
+			return c.commandFailed(ctx, util.StageVet, output, err)
+		}
+	}
+
+	//Run the tests. If these pass, the candidate can be benchmarked
+	testResult := util.RunCodeContext(ctx, pf.Timeout, pf.Flags, "NONE", pf.TestName, pf.Id, filePath, workspace, false, 1)
+	if !testResult.Ok() {
+		return c.testFailed(ctx, util.StageTest, testResult)
+	}
+
+	// The static rules are incomplete, so the tests are run again under the race detector as a safety net
+	if stages.race {
+		raceResult := util.RunCodeContext(ctx, pf.Timeout, pf.Flags+" -race", "NONE", pf.TestName, pf.Id, filePath, workspace, false, 1)
+		if races := util.ParseRaceReports(raceResult.Output); len(races) > 0 {
+			c.failure = &stageFailure{stage: util.StageRace, reason: fmt.Sprintf("%d data races detected", len(races)), races: races}
+			return c, nil
+		}
+		if !raceResult.Ok() {
+			return c.testFailed(ctx, util.StageRace, raceResult)
+		}
+	}
+	return c, nil
+}
+
+func (c candidate) fail(stage util.Stage, reason string, detail string) candidate {
+	c.failure = &stageFailure{stage: stage, reason: reason, detail: detail}
+	return c
+}
+
+// commandFailed turns a failed go build or go vet run into a failure
+func (c candidate) commandFailed(ctx context.Context, stage util.Stage, output string, err error) (candidate, error) {
+	if ctx.Err() != nil {
+		return c, ctx.Err()
+	}
+	if errors.Is(err, util.ErrTimeout) {
+		return c.fail(stage, util.FailureTimeout, output), nil
+	}
+	reason := string(stage) + " failed"
+	if first := firstLine(output); first != "" {
+		reason = first
+	}
+	return c.fail(stage, reason, output), nil
+}
+
+// testFailed turns a failed go test run into a failure
+func (c candidate) testFailed(ctx context.Context, stage util.Stage, result util.TestResult) (candidate, error) {
+	if ctx.Err() != nil {
+		return c, ctx.Err()
+	}
+	return c.fail(stage, result.FailureSummary(), result.Output), nil
+}
+
+// checkInParallel runs every loop through the stages before the benchmark, with each worker in its own copy of the workspace
+// No benchmarks are run here, so they never share the machine with the workers; they are left for the sequential pass
+// The verdicts are keyed by loop position, so the order the workers finish in does not matter
+func (f WithData) checkInParallel(loops util.LoopInfoArray, pkgName string, pf ProgramSettings, stages checkSettings) map[token.Pos]*stageFailure {
+	workers := pf.Workers
+	if workers > len(loops) {
+		workers = len(loops)
+	}
+	original, err := os.ReadFile(f.tmpPath + pf.FileName)
+	if err != nil {
+		_, _ = fmt.Fprintf(f.out, "Error reading %s, checking loops one at a time: %s\n", pf.FileName, err.Error())
+		return nil
+	}
+	_, _ = fmt.Fprintf(f.out, "Checking %d loops with %d workers\n", len(loops), workers)
+
+	var mu sync.Mutex
+	out := &lockedWriter{w: f.out}
+	verdicts := make(map[token.Pos]*stageFailure, len(loops))
+	jobs := make(chan util.LoopInfo)
+	var wg sync.WaitGroup
+
+	started := 0
+	for i := 0; i < workers; i++ {
+		workspace := f.tmpPath[:len(f.tmpPath)-len(p)] + "-w" + strconv.Itoa(i) + p
+		util.CleanOrCreateTempFolder(workspace)
+		err := gorecurcopy.CopyDirectory(f.tmpPath, workspace)
+		if err != nil {
+			_, _ = fmt.Fprintf(out, "Error copying workspace for worker %d: %s\n", i, err.Error())
+			continue
+		}
+		started++
+		wg.Add(1)
+		go func(workspace string) {
+			defer wg.Done()
+			defer os.RemoveAll(workspace)
+			// the worker's copy only changes in the file, which is put back after every loop, so it is loaded once
+			w, err := loadWorkspace(workspace)
+			broken := err != nil
+			if broken {
+				_, _ = fmt.Fprintf(out, "Error loading the packages of a worker's workspace: %s\n", err.Error())
+			}
+			for loopInfo := range jobs {
+				if broken {
+					// keep taking jobs so the other workers are not held up; the sequential pass will check these loops
+					continue
+				}
+				line := loopInfo.Loop.Line
+				c, err := checkCandidate(f.ctx, w, workspace, pkgName, line, pf, stages)
+				// put the original back for the next loop
+				if writeErr := os.WriteFile(workspace+pf.FileName, original, 0644); writeErr != nil {
+					_, _ = fmt.Fprintf(out, "Error restoring worker workspace: %s\n", writeErr.Error())
+					broken = true
+					continue
+				}
+				if err != nil {
+					// leave this loop for the sequential pass, which reports the error itself
+					continue
+				}
+				if c.failure != nil {
+					_, _ = fmt.Fprintf(out, "Checked: %d ; %s failed: %s\n", line, c.failure.stage, c.failure.reason)
+				} else {
+					_, _ = fmt.Fprintf(out, "Checked: %d ; passed\n", line)
+				}
+				mu.Lock()
+				verdicts[loopInfo.Loop.Pos] = c.failure
+				mu.Unlock()
+			}
+		}(workspace)
+	}
+	if started == 0 {
+		close(jobs)
+		return nil
+	}
+
+	for _, loopInfo := range loops {
+		if f.ctx.Err() != nil {
+			break
+		}
+		jobs <- loopInfo
+	}
+	close(jobs)
+	wg.Wait()
+	return verdicts
+}
+
+// lockedWriter lets the workers share the output without interleaving their lines
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(b)
+}
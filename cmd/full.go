@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
@@ -13,9 +15,13 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"perfactor/cmd/util"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 var fullCmd = &cobra.Command{
@@ -28,7 +34,7 @@ var fullCmd = &cobra.Command{
 const p = string(os.PathSeparator)
 
 func init() {
-	fullCmd.Flags().StringP("benchname", "b", "RunProgram", "The Id of the benchmark to run")
+	fullCmd.Flags().StringP("benchname", "b", "", "The -bench pattern of the benchmarks to run; if empty, those that exercise the file are found by profiling each one")
 	fullCmd.Flags().StringP("Id", "n", "", "The Id/Id of the program to run")
 	fullCmd.Flags().StringP("project", "p", "", "The path to the project")
 	fullCmd.Flags().StringP("filename", "f", "", "The path to the input file")
@@ -40,6 +46,26 @@ func init() {
 	fullCmd.Flags().Float32P("Threshold", "d", 10.0, "The Threshold for the percentage increase in runtime")
 	fullCmd.Flags().BoolP("Mode", "m", false, "Benchmark the program when refactoring")
 	fullCmd.Flags().BoolP("Sarif", "s", false, "Output the results in SARIF format")
+	fullCmd.Flags().DurationP("Timeout", "", 10*time.Minute, "The maximum time a single test or benchmark run may take before it is killed")
+	fullCmd.Flags().BoolP("Race", "r", true, "Run the tests under the race detector before accepting a refactoring, which catches races the static checks miss; --Race=false skips it for faster checks")
+	fullCmd.Flags().IntP("Workers", "w", 1, "The number of workspaces to check refactored loops in concurrently")
+	fullCmd.Flags().IntP("Interleave", "i", 0, "Compare each candidate against the current best with this many interleaved rounds of prebuilt test binaries, 0 to compare profiles")
+	fullCmd.Flags().IntP("Warmup", "", 1, "The number of unrecorded runs of each binary before the interleaved rounds")
+	addBenchTargetFlags(fullCmd)
+	fullCmd.Flags().StringToStringP("Weights", "", nil, "Weights for the profile samples of each benchmark when ranking loops, e.g. BenchmarkA=2,BenchmarkB=0.5")
+	fullCmd.Flags().StringArrayP("Profile", "", nil, "A CPU profile captured elsewhere, such as in production or the module's default.pgo, to rank loops with instead of the benchmark's; may be repeated")
+	fullCmd.Flags().Float32P("Contention", "", 0, "Capture mutex and block profiles of each candidate, and flag it if the goroutines of its loop are blocked for more than this percentage of the benchmark run; 0 to not capture them")
+	fullCmd.Flags().BoolP("Trace", "", false, "Record an execution trace of the benchmarks of each accepted candidate, and report how busy its goroutines keep the Ps")
+	fullCmd.Flags().BoolP("Predict", "", true, "Rank the loops by the speedup the model predicts for them, with the cost of a goroutine measured on this machine, and skip those predicted to be slower")
+	fullCmd.Flags().BoolP("Instrument", "", false, "Run the benchmarks once with counters and timers around each candidate loop, and report their exact times, invocations and trip counts")
+	fullCmd.Flags().BoolP("Dependences", "", false, "Run the tests with the reads and writes of the file recorded by iteration, and reject candidate loops seen to use a location in two iterations with a write in one")
+	fullCmd.Flags().StringP("Attribution", "", util.AttributionLines, "How profile samples are attributed to loops: lines, by the lines of their frames, or labels, by profiling a copy with each loop wrapped in pprof.Do")
+	fullCmd.Flags().BoolP("WholeFiles", "", false, "Write the whole rewritten files to the Output folder, as well as the patches")
+	fullCmd.Flags().BoolP("Apply", "", false, "Write the accepted changes back to the project")
+	fullCmd.Flags().BoolP("Commit", "", false, "With Apply, commit each accepted loop to the project's git repository")
+	fullCmd.Flags().StringP("Branch", "", "", "With Apply, create this branch in the project's git repository and commit each accepted loop to it")
+	fullCmd.Flags().BoolP("Force", "", false, "With Apply, write to the project even if it has uncommitted changes or is not in a git repository")
+	fullCmd.Flags().BoolP("History", "", true, "Record the session in the history file of the Output folder")
 	RootCmd.AddCommand(fullCmd)
 }
 
@@ -56,17 +82,58 @@ func full(cmd *cobra.Command, args []string) {
 }
 
 func Full(pf ProgramSettings, out io.Writer) {
+	// stop cleanly on ctrl+c or SIGTERM; the running test binaries are killed along with their process group
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if pf.Apply {
+		err := checkApplicable(ctx, pf)
+		if err != nil {
+			_, _ = fmt.Fprintf(out, "Not applying the changes: %s\n", err.Error())
+			return
+		}
+	}
+
 	var mode RefactoringMode
 	if pf.Mode {
 		mode = WithData{}
 	} else {
 		mode = NoData{}
 	}
+	session := util.Session{Id: pf.Id, Start: time.Now(), Project: pf.ProjectPath, Environment: util.CurrentEnvironment(), Diffs: make(map[string]string)}
+	session.Settings, _ = json.Marshal(pf)
+	if pf.History {
+		// recorded on the way out, so that interrupted and failed runs are remembered too
+		defer func() {
+			session.End = time.Now()
+			session.Interrupted = ctx.Err() != nil
+			if mode != nil {
+				session = mode.RecordSession(session)
+			}
+			err := util.RecordSession(pf.Output, session)
+			if err != nil {
+				_, _ = fmt.Fprintf(out, "Error recording the session in the history: %s\n", err.Error())
+			}
+		}()
+	}
+
+	if pf.Interleave > 0 {
+		// the test binaries are only compared during the run, and are large enough not to leave behind
+		defer func() {
+			err := os.RemoveAll(testBinaryFolder(pf.Id))
+			if err != nil {
+				_, _ = fmt.Fprintf(out, "Warning: could not remove the test binaries: %s\n", err.Error())
+			}
+		}()
+	}
+
 	mode = mode.SetWriter(out)
+	mode = mode.SetContext(ctx)
 	mode = mode.SetWorkingDirPath(pf)
 	fileSet := token.NewFileSet()
 	mode = mode.LoadFiles(fileSet)
 	mode = mode.SetupSarif()
+	branched := false
 	for _, fileName := range pf.FileNames {
 		_, _ = fmt.Fprintf(out, "Running on file: %s\n", fileName)
 		pf.FileName = fileName
@@ -101,6 +168,10 @@ func Full(pf ProgramSettings, out io.Writer) {
 				_, _ = fmt.Fprintf(out, "Error: Mode not set\n")
 				return
 			}
+			if ctx.Err() != nil {
+				_, _ = fmt.Fprintf(out, "Interrupted, stopping before the loop at line %d\n", loopInfo.Loop.Line)
+				return
+			}
 
 			var result bool
 			var err error
@@ -113,6 +184,7 @@ func Full(pf ProgramSettings, out io.Writer) {
 				hasModified = true
 			}
 		}
+		mode.WriteSummary(pf)
 		if pf.Sarif {
 			_, _ = fmt.Fprintf(out, "Writing SARIF file\n")
 			mode.WriteSarifFile(pf)
@@ -129,11 +201,176 @@ func Full(pf ProgramSettings, out io.Writer) {
 			_, _ = fmt.Fprintf(out, "Error creating Output folder: %s\n"+err.Error())
 			return
 		}
-		// write the finished program to Output
+		// write the patches of the file to Output
 		mode.WriteResult(pf)
+		if diff := mode.ResultPatch(pf); diff != "" {
+			session.Diffs[pf.FileName] = diff
+			// rewritten after every file, so that an interrupted run still leaves the patch of what it finished
+			patchPath := pf.Output + p + pf.Id + p + util.SessionPatchName
+			err = util.WriteSessionPatch(patchPath, session.Diffs)
+			if err != nil {
+				_, _ = fmt.Fprintf(out, "Error writing the session patch: %s\n", err.Error())
+			} else {
+				_, _ = fmt.Fprintf(out, "Patch of the session written to %s; apply it in the project with git apply\n", patchPath)
+			}
+		}
+		if pf.Apply {
+			branched, err = applyPatches(ctx, out, mode.Patches(pf), pf, branched)
+			if err != nil {
+				_, _ = fmt.Fprintf(out, "Error applying the changes to %s: %s\n", pf.FileName, err.Error())
+				return
+			}
+		}
 	}
 }
 
+// checkApplicable refuses to apply the changes to a project with uncommitted changes, which they would be mixed with,
+// or that is not in a git repository, unless forced. Committing them needs a repository even when forced
+func checkApplicable(ctx context.Context, pf ProgramSettings) error {
+	dirty, err := util.GitDirtyFiles(ctx, pf.ProjectPath)
+	if err != nil {
+		if pf.Commit || pf.Branch != "" {
+			return fmt.Errorf("cannot commit the changes: %w", err)
+		}
+		if pf.Force {
+			return nil
+		}
+		return fmt.Errorf("cannot check the project for uncommitted changes, use --Force to apply anyway: %w", err)
+	}
+	if len(dirty) > 0 && !pf.Force {
+		return fmt.Errorf("the project has uncommitted changes; commit or stash them, or use --Force:\n%s", strings.Join(dirty, "\n"))
+	}
+	return nil
+}
+
+// applyPatches writes the accepted changes of the file back to the project, committing each loop on its own if asked to
+// Each patch's source is the file in the project with that loop and those before it spliced in, so every commit holds
+// its loop's change alone. The file is left alone if it was edited during the run, since the changes would undo that.
+// The branch is created before the first commit of the session, so a run that changes nothing leaves no branch behind
+func applyPatches(ctx context.Context, out io.Writer, patches []util.LoopPatch, pf ProgramSettings, branched bool) (bool, error) {
+	var applicable []util.LoopPatch
+	for _, lp := range patches {
+		if lp.Source != "" {
+			applicable = append(applicable, lp)
+		}
+	}
+	patches = applicable
+	if len(patches) == 0 {
+		return branched, nil
+	}
+	path := pf.ProjectPath + pf.FileName
+	info, err := os.Stat(path)
+	if err != nil {
+		return branched, err
+	}
+	current, err := os.ReadFile(path)
+	if err != nil {
+		return branched, err
+	}
+	if string(current) != patches[0].Base {
+		return branched, fmt.Errorf("%s was changed during the run; apply the session patch instead", path)
+	}
+	if !pf.Commit && pf.Branch == "" {
+		err = os.WriteFile(path, []byte(patches[len(patches)-1].Source), info.Mode())
+		if err != nil {
+			return branched, err
+		}
+		_, _ = fmt.Fprintf(out, "Applied the changes to %d loops to %s\n", len(patches), path)
+		return branched, nil
+	}
+	if pf.Branch != "" && !branched {
+		err = util.GitCreateBranch(ctx, pf.ProjectPath, pf.Branch)
+		if err != nil {
+			return branched, err
+		}
+		branched = true
+		_, _ = fmt.Fprintf(out, "Created the branch %s in %s\n", pf.Branch, pf.ProjectPath)
+	}
+	for _, lp := range patches {
+		err = os.WriteFile(path, []byte(lp.Source), info.Mode())
+		if err != nil {
+			return branched, err
+		}
+		hash, err := util.GitCommitFile(ctx, pf.ProjectPath, pf.FileName, lp.CommitMessage(pf.Id))
+		if err != nil {
+			return branched, err
+		}
+		_, _ = fmt.Fprintf(out, "Committed the loop at %s:%d as %s\n", lp.File, lp.Line, hash)
+	}
+	return branched, nil
+}
+
+// writePatches writes the patch of each loop accepted in the file to Output, and the whole file if asked to
+func writePatches(out io.Writer, patches []util.LoopPatch, pf ProgramSettings) {
+	folderPath := pf.Output + p + pf.Id + p
+	written, err := util.WriteLoopPatches(folderPath, pf.FileName, patches)
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "Error writing the patches of %s: %s\n", pf.FileName, err.Error())
+	}
+	for _, path := range written {
+		_, _ = fmt.Fprintf(out, "Patch written to %s\n", path)
+	}
+	if pf.WholeFiles {
+		final, err := currentSource(patches, pf)
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(folderPath+pf.FileName), os.ModePerm)
+		}
+		if err == nil {
+			err = os.WriteFile(folderPath+pf.FileName, []byte(final), 0644)
+		}
+		if err != nil {
+			_, _ = fmt.Fprintf(out, "Error writing the final version of %s: %s\n", pf.FileName, err.Error())
+			return
+		}
+		_, _ = fmt.Fprintf(out, "Final version written to %s\n", folderPath+pf.FileName)
+	}
+}
+
+// resultPatch diffs the file in the project against its final version, heading the hunks with the loops they change
+func resultPatch(patches []util.LoopPatch, pf ProgramSettings) string {
+	original, err := os.ReadFile(pf.ProjectPath + pf.FileName)
+	if err != nil {
+		return ""
+	}
+	final, err := currentSource(patches, pf)
+	if err != nil {
+		return ""
+	}
+	return util.FilePatch(pf.FileName, string(original), final, patches)
+}
+
+// currentSource gives the file with the loops accepted so far, which is the project's file until one is
+func currentSource(patches []util.LoopPatch, pf ProgramSettings) (string, error) {
+	for i := len(patches) - 1; i >= 0; i-- {
+		if patches[i].File == pf.FileName && patches[i].Source != "" {
+			return patches[i].Source, nil
+		}
+	}
+	src, err := os.ReadFile(pf.ProjectPath + pf.FileName)
+	return string(src), err
+}
+
+// newLoopPatch diffs the file with the loop rewritten in astFile against the file before, with the loops accepted
+// earlier. Only the declarations the rewrite changed are reformatted, so the patch holds the loop's change alone;
+// if they cannot be told apart, the whole file is printed and the patch reformats it
+func newLoopPatch(out io.Writer, patches []util.LoopPatch, fileSet *token.FileSet, astFile *ast.File, pf ProgramSettings, line int, beforeNs float64, afterNs float64, speedup float64) util.LoopPatch {
+	before, err := currentSource(patches, pf)
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "Warning: could not read %s to diff the loop at line %d: %s\n", pf.FileName, line, err.Error())
+		return util.LoopPatch{File: pf.FileName, Line: line, Before: beforeNs, After: afterNs, Speedup: speedup}
+	}
+	after, err := util.SpliceChangedDecls(before, fileSet, astFile)
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "Warning: the patch of the loop at line %d reformats the whole file, since its changes could not be picked out: %s\n", line, err.Error())
+		after, err = util.PrintAST(fileSet, astFile)
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "Warning: could not print the file to diff the loop at line %d: %s\n", line, err.Error())
+		return util.LoopPatch{File: pf.FileName, Line: line, Before: beforeNs, After: afterNs, Speedup: speedup}
+	}
+	return util.NewLoopPatch(pf.FileName, line, before, after, beforeNs, afterNs, speedup)
+}
+
 func programSettings(cmd *cobra.Command) (ProgramSettings, error) {
 	pf := ProgramSettings{}
 
@@ -201,6 +438,99 @@ func programSettings(cmd *cobra.Command) (ProgramSettings, error) {
 	if err != nil {
 		return pf, err
 	}
+	pf.Timeout, err = cmd.Flags().GetDuration("Timeout")
+	if err != nil {
+		return pf, err
+	}
+	pf.Race, err = cmd.Flags().GetBool("Race")
+	if err != nil {
+		return pf, err
+	}
+	pf.Workers, err = cmd.Flags().GetInt("Workers")
+	if err != nil {
+		return pf, err
+	}
+	pf.Interleave, err = cmd.Flags().GetInt("Interleave")
+	if err != nil {
+		return pf, err
+	}
+	pf.Warmup, err = cmd.Flags().GetInt("Warmup")
+	if err != nil {
+		return pf, err
+	}
+	pf.BenchTargets, err = benchTargets(cmd)
+	if err != nil {
+		return pf, err
+	}
+	pf.History, err = cmd.Flags().GetBool("History")
+	if err != nil {
+		return pf, err
+	}
+	pf.Profiles, err = cmd.Flags().GetStringArray("Profile")
+	if err != nil {
+		return pf, err
+	}
+	pf.Contention, err = cmd.Flags().GetFloat32("Contention")
+	if err != nil {
+		return pf, err
+	}
+	pf.Trace, err = cmd.Flags().GetBool("Trace")
+	if err != nil {
+		return pf, err
+	}
+	pf.Predict, err = cmd.Flags().GetBool("Predict")
+	if err != nil {
+		return pf, err
+	}
+	pf.Instrument, err = cmd.Flags().GetBool("Instrument")
+	if err != nil {
+		return pf, err
+	}
+	pf.Dependences, err = cmd.Flags().GetBool("Dependences")
+	if err != nil {
+		return pf, err
+	}
+	pf.Attribution, err = cmd.Flags().GetString("Attribution")
+	if err != nil {
+		return pf, err
+	}
+	if pf.Attribution != util.AttributionLines && pf.Attribution != util.AttributionLabels {
+		return pf, fmt.Errorf("unknown attribution %q: use %s or %s", pf.Attribution, util.AttributionLines, util.AttributionLabels)
+	}
+	pf.WholeFiles, err = cmd.Flags().GetBool("WholeFiles")
+	if err != nil {
+		return pf, err
+	}
+	pf.Apply, err = cmd.Flags().GetBool("Apply")
+	if err != nil {
+		return pf, err
+	}
+	pf.Commit, err = cmd.Flags().GetBool("Commit")
+	if err != nil {
+		return pf, err
+	}
+	pf.Branch, err = cmd.Flags().GetString("Branch")
+	if err != nil {
+		return pf, err
+	}
+	pf.Force, err = cmd.Flags().GetBool("Force")
+	if err != nil {
+		return pf, err
+	}
+	if (pf.Commit || pf.Branch != "") && !pf.Apply {
+		return pf, errors.New("--Commit and --Branch only apply with --Apply")
+	}
+	weights, err := cmd.Flags().GetStringToString("Weights")
+	if err != nil {
+		return pf, err
+	}
+	pf.Weights = make(map[string]float64, len(weights))
+	for name, weight := range weights {
+		pf.Weights[name], err = strconv.ParseFloat(weight, 64)
+		if err != nil {
+			return pf, fmt.Errorf("invalid weight for %s: %w", name, err)
+		}
+	}
 	if pf.FileName == "all" {
 		pf.FileNames, err = util.GetAllGoFilesInDir(pf.ProjectPath)
 		if err != nil {
@@ -225,7 +555,7 @@ func getAcceptMap(accept string, out io.Writer) map[string]int {
 			}
 			line, err := strconv.Atoi(str[1])
 			if err != nil {
-				_, _ = fmt.Fprintf(out, "Invalid Accept string: ", err.Error())
+				_, _ = fmt.Fprintf(out, "Invalid Accept string: %s\n", err.Error())
 				continue
 			}
 			acceptMap[str[0]] = line
@@ -261,12 +591,17 @@ func downloadRequiredFromModule(err error, tmpPath string, out io.Writer) error
 }
 
 func parseFiles(tmpPath string, fileSet *token.FileSet, out io.Writer) []*packages.Package {
+	return loadPackages(tmpPath, fileSet, "./...", out)
+}
+
+// loadPackages loads the packages in tmpPath that match the pattern, with their syntax and types
+func loadPackages(tmpPath string, fileSet *token.FileSet, pattern string, out io.Writer) []*packages.Package {
 	cfg := &packages.Config{
 		Mode: packages.NeedName | packages.NeedCompiledGoFiles | packages.NeedFiles | packages.NeedSyntax | packages.NeedTypes | packages.NeedTypesInfo,
 		Dir:  tmpPath,
 		Fset: fileSet,
 	}
-	pkgs, err := packages.Load(cfg, "./...")
+	pkgs, err := packages.Load(cfg, pattern)
 	if err != nil {
 		_, _ = fmt.Fprintf(out, "Error loading packages: "+err.Error())
 		return nil
@@ -274,6 +609,17 @@ func parseFiles(tmpPath string, fileSet *token.FileSet, out io.Writer) []*packag
 	return pkgs
 }
 
+// firstLine returns the first line of output that is not blank or a "# package" header
+func firstLine(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return line
+		}
+	}
+	return ""
+}
+
 func getFileFromPkgs(pkgName string, fileName string, pkgs []*packages.Package) (*ast.File, *types.Info, error) {
 	// get the target ast file from the packages
 	if len(pkgs) == 0 {
@@ -312,6 +658,38 @@ type ProgramSettings struct {
 	Mode        bool
 	FileNames   []string
 	Sarif       bool
+	Timeout     time.Duration
+	Race        bool
+	Workers     int
+	Interleave  int
+	Warmup      int
+	// BenchTargets are the benchmarks to generate in the workspace, for projects without any of their own
+	BenchTargets []util.BenchmarkTarget
+	History      bool
+	// Weights scale the profile samples of each benchmark, by name, when the profiles are merged
+	Weights map[string]float64
+	// Profiles are CPU profiles from elsewhere, which the loops are ranked on in place of the benchmarks' own
+	Profiles []string
+	// Contention is the percentage of the benchmark run a candidate's goroutines may be blocked for before it is flagged
+	Contention float32
+	// Trace records and analyses an execution trace of every accepted candidate
+	Trace bool
+	// Predict ranks the loops by their predicted speedup, and skips those predicted to be slower
+	Predict bool
+	// Instrument counts the invocations and iterations of the candidate loops, and times them, in a separate run
+	Instrument bool
+	// Dependences checks the candidate loops for loop-carried dependences by recording their memory accesses in a test run
+	Dependences bool
+	// Attribution is how samples are attributed to loops, util.AttributionLines or util.AttributionLabels
+	Attribution string
+	// WholeFiles writes the rewritten files to Output next to the patches
+	WholeFiles bool
+	// Apply writes the accepted changes back to the project, committing each loop if Commit is set or Branch is given,
+	// on a new branch called Branch if it is. Force applies them even if the project has uncommitted changes
+	Apply  bool
+	Commit bool
+	Branch string
+	Force  bool
 }
 
 type RefactoringMode interface {
@@ -319,9 +697,14 @@ type RefactoringMode interface {
 	GetLoopInfoArray(fileSet *token.FileSet, pkgName string, projectPath string, pf ProgramSettings) (RefactoringMode, util.LoopInfoArray)
 	RefactorLoop(loopInfo util.LoopInfo, pkgName string, pf ProgramSettings) (RefactoringMode, bool, error)
 	WriteResult(pf ProgramSettings)
+	ResultPatch(pf ProgramSettings) string
+	Patches(pf ProgramSettings) []util.LoopPatch
+	WriteSummary(pf ProgramSettings)
 	GetWorkingDirPath() string
 	SetWriter(out io.Writer) RefactoringMode
+	SetContext(ctx context.Context) RefactoringMode
 	SetWorkingDirPath(pf ProgramSettings) RefactoringMode
 	WriteSarifFile(pf ProgramSettings)
 	SetupSarif() RefactoringMode
+	RecordSession(session util.Session) util.Session
 }
@@ -10,6 +10,7 @@ import (
 	"perfactor/parallel_analyser"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/plus3it/gorecurcopy"
@@ -137,13 +138,24 @@ func RunAnalyser(a *analysis.Analyzer, ProjectPath, Id string, pf ProgramSetting
 	fmt.Printf("Running initial benchmark: %s\n", pf.BenchName)
 	//Program runs the benchmark to generate profiling data
 	result := util.RunCode(pf.Flags, pf.BenchName, "NONE", Id, tmpPath+pf.FileName, tmpPath, true, pf.Count)
-	if result == "FAILED" {
-		println("Error running benchmark")
+	if !result.Ok() {
+		println("Error running benchmark: " + result.FailureSummary())
+		return
+	}
+
+	// The benchmark's own time per op is the runtime; the profile also covers setup and calibration, so it is only shown
+	originalBench := util.BenchmarkNsPerOp(result.Output)
+	originalNsPerOp := util.SumNsPerOp(originalBench)
+	if originalNsPerOp == 0 {
+		println("Error running benchmark: no ns/op results in the output")
 		return
 	}
 
 	// Get the profiling data from file
-	prof := util.GetProfileDataFromFile(tmpPath + "cpu.pprof")
+	prof, err := util.GetProfileDataFromFile(tmpPath + "cpu.pprof")
+	if err == nil {
+		fmt.Printf("Original runtime: %s (profile duration %s)\n", util.FormatNsPerOp(originalNsPerOp), time.Duration(prof.DurationNanos))
+	}
 
 	diagnostics := make([]analysis.Diagnostic, 0)
 	// create the analysis pass
@@ -165,10 +177,6 @@ func RunAnalyser(a *analysis.Analyzer, ProjectPath, Id string, pf ProgramSetting
 	}
 	fmt.Printf("Analyzer finished: %s\n", a.Name)
 
-	// Variable to keep track of the best duration
-	// for now it's a strict greater-than, but we could make it require a percentage increase
-	originalDuration := prof.DurationNanos
-
 	// if we work based off of the positions, that changes from run to run. So we need to benchmark each change on its own, then combine them all at the end
 
 	// map to track if fixes pass the tests, and if they give improvement
@@ -223,7 +231,8 @@ func RunAnalyser(a *analysis.Analyzer, ProjectPath, Id string, pf ProgramSetting
 			improved: false,
 		}
 
-		if runTestAndBenchmark(tmpPath, pf.Flags, pf.TestName, pf.BenchName, Id, pf.FileName, pf.Count) {
+		bench, ok := runTestAndBenchmark(tmpPath, pf.Flags, pf.TestName, pf.BenchName, Id, pf.FileName, pf.Count)
+		if ok {
 			fmt.Printf("Fix passed: %s\n", diag.Message)
 			res.passed = true
 		} else {
@@ -232,10 +241,9 @@ func RunAnalyser(a *analysis.Analyzer, ProjectPath, Id string, pf ProgramSetting
 		}
 
 		//If the benchmark scores better than the previous result, we keep the change.
-		tempProf := util.GetProfileDataFromFile(tmpPath + "cpu.pprof")
-		// DurationNanos is the total duration of the test
-		// TimeNanos is the time when the test was run
-		if tempProf.DurationNanos < originalDuration {
+		speedup := util.Speedup(originalBench, bench)
+		fmt.Printf("Runtime with fix: %s against %s (%.2fx)\n", util.FormatNsPerOp(util.SumNsPerOp(bench)), util.FormatNsPerOp(originalNsPerOp), speedup)
+		if speedup > 1 {
 			// If the new benchmark is better, we keep the change
 			res.improved = true
 		}
@@ -310,7 +318,8 @@ func RunAnalyser(a *analysis.Analyzer, ProjectPath, Id string, pf ProgramSetting
 		improved: false,
 	}
 
-	if runTestAndBenchmark(tmpPath, pf.Flags, pf.TestName, pf.BenchName, Id, pf.FileName, pf.Count) {
+	bench, ok := runTestAndBenchmark(tmpPath, pf.Flags, pf.TestName, pf.BenchName, Id, pf.FileName, pf.Count)
+	if ok {
 		res.passed = true
 	} else {
 		return
@@ -320,10 +329,10 @@ func RunAnalyser(a *analysis.Analyzer, ProjectPath, Id string, pf ProgramSetting
 	res.passed = true
 
 	//If the benchmark scores better than the previous result, we keep the change.
-	tempProf := util.GetProfileDataFromFile(tmpPath + "cpu.pprof")
-	// DurationNanos is the total duration of the test
-	// TimeNanos is the time when the test was run
-	if tempProf.DurationNanos < originalDuration {
+	if tempProf, err := util.GetProfileDataFromFile(tmpPath + "cpu.pprof"); err == nil {
+		fmt.Printf("New runtime: %s (profile duration %s)\n", util.FormatNsPerOp(util.SumNsPerOp(bench)), time.Duration(tempProf.DurationNanos))
+	}
+	if util.Speedup(originalBench, bench) > 1 {
 		// If the new benchmark is better, we keep the change
 		res.improved = true
 		fmt.Println("Benchmark improved")
@@ -332,19 +341,25 @@ func RunAnalyser(a *analysis.Analyzer, ProjectPath, Id string, pf ProgramSetting
 	}
 }
 
-func runTestAndBenchmark(tmpPath, Flags, TestName, BenchName, Id, FileName string, Count int) bool {
+// runTestAndBenchmark runs the tests, then the benchmarks, and returns the ns/op of each benchmark if both pass
+func runTestAndBenchmark(tmpPath, Flags, TestName, BenchName, Id, FileName string, Count int) (map[string]float64, bool) {
 	testResult := util.RunCode(Flags, "NONE", TestName, Id, tmpPath+FileName, tmpPath, false, Count)
-	if strings.Contains(testResult, "FAIL") {
-		fmt.Println("Test failed")
-		return false
+	if !testResult.Ok() {
+		fmt.Println("Test failed: " + testResult.FailureSummary())
+		return nil, false
 	}
 
 	benchmarkResult := util.RunCode(Flags, BenchName, "NONE", Id, tmpPath+FileName, tmpPath, true, Count)
-	if strings.Contains(benchmarkResult, "FAIL") {
-		fmt.Println("Benchmark failed")
-		return false
+	if !benchmarkResult.Ok() {
+		fmt.Println("Benchmark failed: " + benchmarkResult.FailureSummary())
+		return nil, false
+	}
+	bench := util.BenchmarkNsPerOp(benchmarkResult.Output)
+	if len(bench) == 0 {
+		fmt.Println("Benchmark failed: no ns/op results in the output")
+		return nil, false
 	}
-	return true
+	return bench, true
 }
 
 func writeChangesToBuffer(changes fixPositionList, fileSet *token.FileSet, importpos int, curIndex int, buf bytes.Buffer, oldFile []byte) bytes.Buffer {
@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"perfactor/cmd/util"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/plus3it/gorecurcopy"
+	"github.com/spf13/cobra"
+)
+
+var genbenchCmd = &cobra.Command{
+	Use:   "genbench",
+	Short: "Generate benchmarks for a project that has none, in a copy of it, and check that they run",
+	Long: `Generates a test file with a benchmark for main, run with the given arguments, or for calls to the package's functions.
+The file is written into a copy of the project in the temporary folder, never into the project itself.
+Pass the same flags to the full command to refactor using the generated benchmarks.`,
+	Run: genbench,
+}
+
+func init() {
+	genbenchCmd.Flags().StringP("project", "p", "", "The path to the project")
+	genbenchCmd.Flags().StringP("Id", "n", "", "The Id of the run, which names the temporary folder")
+	addBenchTargetFlags(genbenchCmd)
+	RootCmd.AddCommand(genbenchCmd)
+}
+
+// addBenchTargetFlags adds the flags that describe the benchmarks to generate
+func addBenchTargetFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolP("BenchMain", "", false, "Generate a benchmark that runs main with --BenchArgs as its arguments")
+	cmd.Flags().StringP("BenchArgs", "", "", "The space separated command line arguments for main")
+	cmd.Flags().StringArrayP("BenchFunc", "", nil, "Generate a benchmark for a call to a function of the package, with its inputs, e.g. 'Sum([]int{1, 2, 3})'")
+}
+
+// benchTargets reads the flags added by addBenchTargetFlags
+func benchTargets(cmd *cobra.Command) ([]util.BenchmarkTarget, error) {
+	var targets []util.BenchmarkTarget
+	benchMain, err := cmd.Flags().GetBool("BenchMain")
+	if err != nil {
+		return nil, err
+	}
+	benchArgs, err := cmd.Flags().GetString("BenchArgs")
+	if err != nil {
+		return nil, err
+	}
+	if benchMain {
+		targets = append(targets, util.BenchmarkTarget{Main: true, Args: strings.Fields(benchArgs)})
+	}
+	calls, err := cmd.Flags().GetStringArray("BenchFunc")
+	if err != nil {
+		return nil, err
+	}
+	for _, call := range calls {
+		targets = append(targets, util.BenchmarkTarget{Call: call})
+	}
+	return targets, nil
+}
+
+func genbench(cmd *cobra.Command, args []string) {
+	projectPath, err := cmd.Flags().GetString("project")
+	if err != nil || projectPath == "" {
+		fmt.Println("Please provide a project path")
+		return
+	}
+	if !strings.HasSuffix(projectPath, p) {
+		projectPath += p
+	}
+	id, err := cmd.Flags().GetString("Id")
+	if err != nil {
+		fmt.Println("Error getting Id: " + err.Error())
+		return
+	}
+	if id == "" {
+		id = uuid.New().String()
+	}
+	targets, err := benchTargets(cmd)
+	if err != nil {
+		fmt.Printf("Error getting Flags: %s\n", err.Error())
+		return
+	}
+	if len(targets) == 0 {
+		fmt.Println("Nothing to benchmark: pass --BenchMain or --BenchFunc")
+		return
+	}
+
+	tmpPath := "_tmp" + p + id + p
+	util.CleanOrCreateTempFolder(tmpPath)
+	err = gorecurcopy.CopyDirectory(projectPath, tmpPath)
+	if err != nil {
+		fmt.Printf("Error copying project folder to temp folder: %s\n", err.Error())
+		return
+	}
+	harness, err := util.WriteBenchmarkHarness(tmpPath, targets)
+	if err != nil {
+		fmt.Printf("Error generating benchmarks: %s\n", err.Error())
+		return
+	}
+	src, err := os.ReadFile(harness)
+	if err != nil {
+		fmt.Printf("Error reading %s: %s\n", harness, err.Error())
+		return
+	}
+	fmt.Printf("Generated %s:\n\n%s\n", harness, src)
+
+	// run each benchmark twice, to show that the harness compiles and main neither exits nor fails when run again
+	result := util.RunCodeContext(context.Background(), 0, "-benchtime=2x", "^BenchmarkPerfactor", "NONE", id, harness, tmpPath, false, 1)
+	if !result.Ok() {
+		fmt.Printf("The generated benchmarks do not run: %s\n%s\n", result.FailureSummary(), result.Output)
+		return
+	}
+	names, err := util.ListBenchmarks(context.Background(), 0, tmpPath)
+	if err != nil {
+		fmt.Printf("Error listing benchmarks: %s\n", err.Error())
+		return
+	}
+	fmt.Printf("The benchmarks run: %s\n", strings.Join(names, ", "))
+}
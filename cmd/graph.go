@@ -0,0 +1,214 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io"
+	"os"
+	"perfactor/cmd/util"
+	"perfactor/graph"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/google/uuid"
+	"github.com/plus3it/gorecurcopy"
+	"github.com/spf13/cobra"
+)
+
+var graphCmd = &cobra.Command{
+	Use:   "graph",
+	Short: "Export the profile graph of a project, with the loops of a file placed on it, as Graphviz DOT or JSON",
+	Long: `Exports the nodes and edges of the profile graph, with their flat and cumulative times, and the loops of the file:
+the time attributed to each, its rank, whether it is a candidate, and what became of it in a recorded session.
+The profile is taken from --Profile if given, or else by running the benchmarks in a copy of the project.
+The verdicts are those of --Session, or of the latest session of the project that tried the file.`,
+	Run: exportGraph,
+}
+
+func init() {
+	graphCmd.Flags().StringP("project", "p", "", "The path to the project")
+	graphCmd.Flags().StringP("filename", "f", "", "The path to the file whose loops are annotated, within the project")
+	graphCmd.Flags().StringP("benchname", "b", "", "The -bench pattern of the benchmarks to profile; if empty, those that exercise the file are found by profiling each one")
+	graphCmd.Flags().StringArrayP("Profile", "", nil, "A CPU profile captured elsewhere to export instead of profiling the benchmarks; may be repeated")
+	graphCmd.Flags().StringP("Id", "n", "", "The Id of the run, which names the temporary folder")
+	graphCmd.Flags().StringP("Flags", "", "", "Any Flags to pass to the program")
+	graphCmd.Flags().IntP("Count", "c", 1, "The number of times to run each benchmark")
+	graphCmd.Flags().DurationP("Timeout", "", 10*time.Minute, "The maximum time a single benchmark run may take before it is killed")
+	graphCmd.Flags().Float32P("Threshold", "d", 10.0, "The percentage of the profile a loop must take to be a candidate")
+	graphCmd.Flags().StringP("Output", "o", "_data", "The path to the Output folder, whose history the verdicts are taken from")
+	graphCmd.Flags().StringP("Session", "", "", "The Id of the recorded session to take the verdicts from")
+	graphCmd.Flags().StringP("Format", "", "dot", "The format to export: dot or json")
+	graphCmd.Flags().StringP("Out", "", "", "The file to write the graph to, or stdout if empty")
+	graphCmd.Flags().IntP("Nodes", "", 80, "The number of nodes with the most cumulative time to keep, besides those in loops; 0 keeps every node")
+	RootCmd.AddCommand(graphCmd)
+}
+
+func exportGraph(cmd *cobra.Command, args []string) {
+	projectPath, _ := cmd.Flags().GetString("project")
+	fileName, _ := cmd.Flags().GetString("filename")
+	format, _ := cmd.Flags().GetString("Format")
+	outPath, _ := cmd.Flags().GetString("Out")
+	maxNodes, _ := cmd.Flags().GetInt("Nodes")
+	threshold, _ := cmd.Flags().GetFloat32("Threshold")
+	if projectPath == "" || fileName == "" {
+		fmt.Println("Please provide a project path and a file name")
+		return
+	}
+	if !strings.HasSuffix(projectPath, p) {
+		projectPath += p
+	}
+	if format != "dot" && format != "json" {
+		fmt.Printf("Unknown format %q: use dot or json\n", format)
+		return
+	}
+
+	// progress goes to stderr, so that the graph can be piped from stdout
+	prof, err := graphProfile(cmd, projectPath, fileName, os.Stderr)
+	if err != nil {
+		fmt.Printf("Error getting the profile: %s\n", err.Error())
+		return
+	}
+
+	fileSet := token.NewFileSet()
+	astFile, err := parser.ParseFile(fileSet, projectPath+fileName, nil, 0)
+	if err != nil {
+		fmt.Printf("Error parsing %s: %s\n", fileName, err.Error())
+		return
+	}
+	loops := util.FindForLoopsInAST(astFile, fileSet, nil)
+	file := util.ProjectFile(projectPath, fileName)
+	times, matches := util.AttributeSamples(prof, loops, file)
+	loopInfo := make(util.LoopInfoArray, len(loops))
+	for i, loop := range loops {
+		loopInfo[i] = util.LoopInfo{Loop: loop, Time: times[i], Match: matches[i]}
+	}
+
+	total := util.ProfileTotal(prof)
+	thresholdNanos := int64((float32(total) / 100) * threshold)
+	verdicts := graphVerdicts(cmd, projectPath, fileName, os.Stderr)
+	export := util.ExportGraph(graph.GetGraphFromProfile(prof), total, file, loopInfo, maxNodes, thresholdNanos, verdicts)
+
+	var out io.Writer = os.Stdout
+	if outPath != "" {
+		file, err := os.Create(outPath)
+		if err != nil {
+			fmt.Printf("Error creating %s: %s\n", outPath, err.Error())
+			return
+		}
+		defer file.Close()
+		out = file
+	}
+	if format == "json" {
+		err = export.WriteJSON(out)
+	} else {
+		err = export.WriteDOT(out)
+	}
+	if err != nil {
+		fmt.Printf("Error writing the graph: %s\n", err.Error())
+		return
+	}
+	if outPath != "" {
+		fmt.Printf("Wrote the graph of %d nodes and %d loops to %s\n", len(export.Nodes), len(export.Loops), outPath)
+	}
+}
+
+// graphProfile loads the given profiles, or profiles the benchmarks in a copy of the project
+func graphProfile(cmd *cobra.Command, projectPath string, fileName string, log io.Writer) (*profile.Profile, error) {
+	profiles, _ := cmd.Flags().GetStringArray("Profile")
+	if len(profiles) > 0 {
+		return util.LoadProfiles(profiles, projectPath)
+	}
+	benchName, _ := cmd.Flags().GetString("benchname")
+	id, _ := cmd.Flags().GetString("Id")
+	flags, _ := cmd.Flags().GetString("Flags")
+	count, _ := cmd.Flags().GetInt("Count")
+	timeout, _ := cmd.Flags().GetDuration("Timeout")
+	if id == "" {
+		id = uuid.New().String()
+	}
+
+	ctx := context.Background()
+	tmpPath := "_tmp" + p + id + p
+	util.CleanOrCreateTempFolder(tmpPath)
+	err := gorecurcopy.CopyDirectory(projectPath, tmpPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not copy the project to the temp folder: %w", err)
+	}
+	if benchName == "" {
+		coverage, err := util.DiscoverBenchmarks(ctx, timeout, flags, tmpPath, fileName)
+		if err != nil {
+			return nil, err
+		}
+		var chosen []string
+		for _, c := range coverage {
+			_, _ = fmt.Fprintf(log, "  %s\n", c)
+			if c.Err == nil && c.FileNanos > 0 {
+				chosen = append(chosen, c.Name)
+			}
+		}
+		if len(chosen) == 0 {
+			return nil, fmt.Errorf("none of the %d benchmarks spend any time in %s", len(coverage), fileName)
+		}
+		benchName = util.BenchmarkPattern(chosen)
+	}
+	names, err := util.MatchingBenchmarks(ctx, timeout, tmpPath, benchName)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, errors.New("no benchmarks match " + benchName)
+	}
+	_, _ = fmt.Fprintf(log, "Profiling %s\n", strings.Join(names, ", "))
+	runs, result := util.ProfileBenchmarks(ctx, timeout, flags, id, tmpPath+fileName, tmpPath, names, count)
+	if !result.Ok() {
+		return nil, errors.New(result.FailureSummary())
+	}
+	return util.MergeProfiles(runs, nil)
+}
+
+// graphVerdicts gives what became of each loop of the file in the chosen session, or in the latest one of the project
+// that tried the file. It gives nil if there is none
+func graphVerdicts(cmd *cobra.Command, projectPath string, fileName string, log io.Writer) map[int]string {
+	output, _ := cmd.Flags().GetString("Output")
+	id, _ := cmd.Flags().GetString("Session")
+	h, err := util.LoadHistory(output)
+	if err != nil {
+		_, _ = fmt.Fprintf(log, "Error loading history, so the loops have no verdicts: %s\n", err.Error())
+		return nil
+	}
+	var session util.Session
+	if id != "" {
+		session, err = h.Find(id)
+		if err != nil {
+			_, _ = fmt.Fprintf(log, "Error: %s, so the loops have no verdicts\n", err.Error())
+			return nil
+		}
+	} else {
+		for _, s := range h.Sessions {
+			if s.Project != projectPath {
+				continue
+			}
+			for _, o := range s.Outcomes {
+				if o.File == fileName {
+					session = s
+					break
+				}
+			}
+		}
+	}
+	verdicts := make(map[int]string)
+	for _, o := range session.Outcomes {
+		if o.File == fileName {
+			verdicts[o.Line] = outcomeVerdict(o)
+		}
+	}
+	if len(verdicts) == 0 {
+		return nil
+	}
+	_, _ = fmt.Fprintf(log, "Using the verdicts of session %s\n", session.Id)
+	return verdicts
+}
@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"perfactor/cmd/util"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const timeLayout = "2006-01-02 15:04:05"
+
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "List the sessions recorded in the Output folder",
+	Run:   history,
+}
+
+var showCmd = &cobra.Command{
+	Use:   "show <id> [<id2>]",
+	Short: "Show a recorded session, or compare two of them",
+	Long: `Shows the settings, environment, measurements, loop outcomes and diffs of a recorded session.
+Given two sessions, shows how their measurements and loop outcomes differ. An Id may be shortened to any unique prefix.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run:  show,
+}
+
+func init() {
+	historyCmd.Flags().StringP("Output", "o", "_data", "The path to the Output folder")
+	showCmd.Flags().StringP("Output", "o", "_data", "The path to the Output folder")
+	RootCmd.AddCommand(historyCmd)
+	RootCmd.AddCommand(showCmd)
+}
+
+func history(cmd *cobra.Command, args []string) {
+	output, _ := cmd.Flags().GetString("Output")
+	h, err := util.LoadHistory(output)
+	if err != nil {
+		fmt.Printf("Error loading history: %s\n", err.Error())
+		return
+	}
+	if len(h.Sessions) == 0 {
+		fmt.Printf("No sessions recorded in %s\n", output)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintf(w, "ID\tSTART\tPROJECT\tLOOPS\tACCEPTED\tSPEEDUP\tFILES CHANGED\n")
+	for _, s := range h.Sessions {
+		speedup := "-"
+		if x := s.Metrics.Speedup(); x > 0 {
+			speedup = fmt.Sprintf("%.2fx", x)
+		}
+		start := s.Start.Format(timeLayout)
+		if s.Interrupted {
+			start += " (interrupted)"
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\t%d\n", s.Id, start, s.Project, len(s.Outcomes), s.Accepted(), speedup, len(s.Diffs))
+	}
+	_ = w.Flush()
+}
+
+func show(cmd *cobra.Command, args []string) {
+	output, _ := cmd.Flags().GetString("Output")
+	h, err := util.LoadHistory(output)
+	if err != nil {
+		fmt.Printf("Error loading history: %s\n", err.Error())
+		return
+	}
+	sessions := make([]util.Session, len(args))
+	for i, id := range args {
+		sessions[i], err = h.Find(id)
+		if err != nil {
+			fmt.Printf("Error: %s\n", err.Error())
+			return
+		}
+	}
+	if len(sessions) == 1 {
+		writeSession(os.Stdout, sessions[0])
+	} else {
+		compareSessions(os.Stdout, sessions[0], sessions[1])
+	}
+}
+
+func writeSession(out io.Writer, s util.Session) {
+	_, _ = fmt.Fprintf(out, "Session %s\n", s.Id)
+	_, _ = fmt.Fprintf(out, "Project: %s\n", s.Project)
+	_, _ = fmt.Fprintf(out, "Ran from %s to %s (%s)\n", s.Start.Format(timeLayout), s.End.Format(timeLayout), s.End.Sub(s.Start).Round(time.Second))
+	if s.Interrupted {
+		_, _ = fmt.Fprintf(out, "The session was interrupted\n")
+	}
+	e := s.Environment
+	_, _ = fmt.Fprintf(out, "Environment: %s %s/%s, %d CPUs, GOMAXPROCS %d, on %s\n", e.GoVersion, e.GOOS, e.GOARCH, e.NumCPU, e.GOMAXPROCS, e.Hostname)
+
+	var settings bytes.Buffer
+	if json.Indent(&settings, s.Settings, "  ", "  ") == nil {
+		_, _ = fmt.Fprintf(out, "Settings:\n  %s\n", settings.String())
+	}
+	writeMetrics(out, s.Metrics)
+
+	_, _ = fmt.Fprintf(out, "Loops (%d, %d accepted):\n", len(s.Outcomes), s.Accepted())
+	for _, o := range s.Outcomes {
+		_, _ = fmt.Fprintf(out, "  %s\n", o)
+	}
+	files := make([]string, 0, len(s.Diffs))
+	for file := range s.Diffs {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		_, _ = fmt.Fprintf(out, "\n%s", s.Diffs[file])
+	}
+}
+
+func writeMetrics(out io.Writer, m util.SessionMetrics) {
+	if m.BestNsPerOp > 0 {
+		_, _ = fmt.Fprintf(out, "Benchmark: %.0f ns/op originally, %.0f ns/op after (%.2fx)\n", m.OriginalNsPerOp, m.BestNsPerOp, m.Speedup())
+	} else if m.BestRuntime > 0 {
+		_, _ = fmt.Fprintf(out, "Runtime: %s originally, %s after (%.2fx)\n", m.OriginalRuntime, m.BestRuntime, m.Speedup())
+	} else {
+		_, _ = fmt.Fprintf(out, "No measurements\n")
+	}
+}
+
+// compareSessions shows what changed from session a to session b, such as a rerun after editing the code
+func compareSessions(out io.Writer, a util.Session, b util.Session) {
+	_, _ = fmt.Fprintf(out, "Comparing %s (%s) with %s (%s)\n", a.Id, a.Start.Format(timeLayout), b.Id, b.Start.Format(timeLayout))
+	if a.Project != b.Project {
+		_, _ = fmt.Fprintf(out, "Warning: the sessions are of different projects, %s and %s\n", a.Project, b.Project)
+	}
+	if a.Environment != b.Environment {
+		_, _ = fmt.Fprintf(out, "Warning: the sessions ran in different environments, so their timings may not be comparable\n")
+	}
+	_, _ = fmt.Fprintf(out, "%s: ", a.Id)
+	writeMetrics(out, a.Metrics)
+	_, _ = fmt.Fprintf(out, "%s: ", b.Id)
+	writeMetrics(out, b.Metrics)
+	_, _ = fmt.Fprintln(out)
+
+	// line up the outcomes by loop, keeping the order they were first tried in
+	type key struct {
+		file string
+		line int
+	}
+	var keys []key
+	outcomes := [2]map[key]util.LoopOutcome{make(map[key]util.LoopOutcome), make(map[key]util.LoopOutcome)}
+	for i, s := range []util.Session{a, b} {
+		for _, o := range s.Outcomes {
+			k := key{o.File, o.Line}
+			if _, seen := outcomes[0][k]; !seen {
+				if _, seen := outcomes[1][k]; !seen {
+					keys = append(keys, k)
+				}
+			}
+			outcomes[i][k] = o
+		}
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintf(w, "LOOP\t%s\t%s\n", a.Id, b.Id)
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(w, "%s:%d\t%s\t%s\n", k.file, k.line, outcomeVerdict(outcomes[0][k]), outcomeVerdict(outcomes[1][k]))
+	}
+	_ = w.Flush()
+}
+
+func outcomeVerdict(o util.LoopOutcome) string {
+	switch {
+	case o.File == "":
+		return "-"
+	case o.Accepted:
+		return "accepted"
+	case o.Stage == "":
+		return o.Reason
+	}
+	return "rejected at " + string(o.Stage)
+}
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/owenrumney/go-sarif/sarif"
 	"go/ast"
@@ -21,6 +22,9 @@ type NoData struct {
 	out         io.Writer
 	projectPath string
 	sarifRun    *sarif.Run
+	outcomes    []util.LoopOutcome
+	// patches are the diffs of the refactored loops, in the order they were made
+	patches []util.LoopPatch
 }
 
 func (f NoData) GetWorkingDirPath() string {
@@ -32,33 +36,38 @@ func (f NoData) SetWriter(out io.Writer) RefactoringMode {
 	return f
 }
 
+// SetContext is a no-op, since nothing is run without data
+func (f NoData) SetContext(ctx context.Context) RefactoringMode {
+	return f
+}
+
 func (f NoData) WriteSarifFile(pf ProgramSettings) {
 	// in order to write the sarif file, we use the sarifRun object and write it to a file
 	report, err := sarif.New(sarif.Version210)
 	if err != nil {
-		println("Error creating SARIF report: " + err.Error())
+		_, _ = fmt.Fprintf(f.out, "Error creating SARIF report: %s\n", err.Error())
 		return
 	}
 	report.AddRun(f.sarifRun)
 	buffer := bytes.NewBufferString("")
 	err = report.Write(buffer)
 	if err != nil {
-		println("Error writing SARIF report: " + err.Error())
+		_, _ = fmt.Fprintf(f.out, "Error writing SARIF report: %s\n", err.Error())
 		return
 	}
 	// write the buffer to a serif file
 	create, err := os.Create(pf.Id + ".sarif")
 	if err != nil {
-		println("Error creating SARIF file: " + err.Error())
+		_, _ = fmt.Fprintf(f.out, "Error creating SARIF file: %s\n", err.Error())
 		return
 	}
 	defer create.Close()
 	_, err = create.Write(buffer.Bytes())
 	if err != nil {
-		println("Error writing SARIF file: " + err.Error())
+		_, _ = fmt.Fprintf(f.out, "Error writing SARIF file: %s\n", err.Error())
 		return
 	}
-	println("SARIF file written")
+	_, _ = fmt.Fprintf(f.out, "SARIF file written\n")
 }
 
 func (f NoData) SetupSarif() RefactoringMode {
@@ -100,10 +109,37 @@ func (f NoData) RefactorLoop(loopInfo util.LoopInfo, pkgName string, pf ProgramS
 	// Do the refactoring of the loopPos
 	util.MakeLoopConcurrent(f.astFile, f.fileSet, line, f.info)
 	fmt.Fprintf(f.out, "Refactored: %v ;\n", line)
+	f.patches = append(f.patches, newLoopPatch(f.out, f.patches, f.fileSet, f.astFile, pf, line, 0, 0, 0))
+	f.outcomes = append(f.outcomes, util.LoopOutcome{File: pf.FileName, Line: line, Accepted: true})
 	return f, true, nil
 }
 
+// RecordSession has no measurements to add, since nothing is run without data
+func (f NoData) RecordSession(session util.Session) util.Session {
+	session.Outcomes = f.outcomes
+	return session
+}
+
+// WriteSummary has nothing to add, since every refactoring is reported as it is made
+func (f NoData) WriteSummary(pf ProgramSettings) {
+}
+
 func (f NoData) WriteResult(pf ProgramSettings) {
-	util.WriteModifiedAST(f.fileSet, f.astFile, pf.Output+p+pf.Id+p, pf.FileName)
-	fmt.Fprintf(f.out, "Final version written to %s\n", pf.Output+p+pf.Id+p+pf.FileName)
+	writePatches(f.out, f.patches, pf)
+}
+
+// ResultPatch diffs the file in the project against the refactored version
+func (f NoData) ResultPatch(pf ProgramSettings) string {
+	return resultPatch(f.patches, pf)
+}
+
+// Patches gives the patches of the loops accepted in the file, in the order they were accepted
+func (f NoData) Patches(pf ProgramSettings) []util.LoopPatch {
+	var patches []util.LoopPatch
+	for _, lp := range f.patches {
+		if lp.File == pf.FileName {
+			patches = append(patches, lp)
+		}
+	}
+	return patches
 }
@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// workspacePackages are the packages of a workspace and their tests, loaded once for every candidate checked in it
+// Only the refactored file changes from one candidate to the next, so it is parsed afresh each time and its package
+// type-checked again against the imports that were loaded, rather than loading the packages again
+type workspacePackages struct {
+	fileSet *token.FileSet
+	pkgs    []*packages.Package
+	// sync is loaded with the packages because the rewrite imports it, which the file may not do yet
+	sync *types.Package
+}
+
+// loadWorkspace loads the packages in the workspace, with the variants of them that are compiled with their tests
+func loadWorkspace(workspace string) (*workspacePackages, error) {
+	w := &workspacePackages{fileSet: token.NewFileSet()}
+	cfg := &packages.Config{
+		Mode: packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles | packages.NeedImports |
+			packages.NeedSyntax | packages.NeedTypes | packages.NeedTypesInfo | packages.NeedTypesSizes,
+		Dir:   workspace,
+		Fset:  w.fileSet,
+		Tests: true,
+	}
+	pkgs, err := packages.Load(cfg, "./...", "sync")
+	if err != nil {
+		return nil, err
+	}
+	for _, pkg := range pkgs {
+		if pkg.PkgPath == "sync" {
+			w.sync = pkg.Types
+			continue
+		}
+		w.pkgs = append(w.pkgs, pkg)
+	}
+	return w, nil
+}
+
+// parse parses the file at filePath from src, and type-checks its package with it, for the rewrite to work on
+func (w *workspacePackages) parse(pkgName string, filePath string, src []byte) (*ast.File, *types.Info, error) {
+	variants, err := w.variants(pkgName, filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := parser.ParseFile(w.fileSet, filePath, src, parser.ParseComments)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the package on its own comes first, before the variant compiled with its tests
+	info, errs := w.check(variants[0], filePath, file)
+	if len(errs) > 0 {
+		return nil, nil, errs[0]
+	}
+	return file, info, nil
+}
+
+// typeCheck type-checks every package the file at filePath is compiled into, its tests included, with src as the file
+// The rewrite only changes a function's body, so the packages importing the file's package are not checked again
+func (w *workspacePackages) typeCheck(pkgName string, filePath string, src []byte) ([]types.Error, error) {
+	variants, err := w.variants(pkgName, filePath)
+	if err != nil {
+		return nil, err
+	}
+	file, err := parser.ParseFile(w.fileSet, filePath, src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	var errs []types.Error
+	for _, pkg := range variants {
+		_, pkgErrs := w.check(pkg, filePath, file)
+		errs = append(errs, pkgErrs...)
+	}
+	return errs, nil
+}
+
+// variants finds the packages named pkgName that compile the file at filePath, the package itself first
+func (w *workspacePackages) variants(pkgName string, filePath string) ([]*packages.Package, error) {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var variants []*packages.Package
+	for _, pkg := range w.pkgs {
+		if pkg.Name != pkgName || pkg.Types == nil {
+			continue
+		}
+		for _, name := range pkg.CompiledGoFiles {
+			if name != absPath {
+				continue
+			}
+			if pkg.ID == pkg.PkgPath {
+				variants = append([]*packages.Package{pkg}, variants...)
+			} else {
+				variants = append(variants, pkg)
+			}
+			break
+		}
+	}
+	if len(variants) == 0 || variants[0].ID != variants[0].PkgPath {
+		return nil, errors.New("Error getting AST from file")
+	}
+	return variants, nil
+}
+
+// check type-checks the package with file in place of the one at filePath, giving the errors it found
+func (w *workspacePackages) check(pkg *packages.Package, filePath string, file *ast.File) (*types.Info, []types.Error) {
+	absPath, _ := filepath.Abs(filePath)
+	files := make([]*ast.File, len(pkg.Syntax))
+	copy(files, pkg.Syntax)
+	for i, name := range pkg.CompiledGoFiles {
+		if name == absPath && i < len(files) {
+			files[i] = file
+		}
+	}
+	info := &types.Info{
+		Types:      make(map[ast.Expr]types.TypeAndValue),
+		Instances:  make(map[*ast.Ident]types.Instance),
+		Defs:       make(map[*ast.Ident]types.Object),
+		Uses:       make(map[*ast.Ident]types.Object),
+		Implicits:  make(map[ast.Node]types.Object),
+		Selections: make(map[*ast.SelectorExpr]*types.Selection),
+		Scopes:     make(map[ast.Node]*types.Scope),
+	}
+	var errs []types.Error
+	conf := types.Config{
+		Importer: importerFunc(func(path string) (*types.Package, error) {
+			if imported, ok := pkg.Imports[path]; ok && imported.Types != nil {
+				return imported.Types, nil
+			}
+			if path == "sync" && w.sync != nil {
+				return w.sync, nil
+			}
+			return nil, fmt.Errorf("package %s is not imported by %s", path, pkg.PkgPath)
+		}),
+		Sizes: pkg.TypesSizes,
+		Error: func(err error) {
+			if typeErr, ok := err.(types.Error); ok {
+				errs = append(errs, typeErr)
+			}
+		},
+	}
+	_, _ = conf.Check(pkg.PkgPath, w.fileSet, files, info)
+	return info, errs
+}
+
+type importerFunc func(path string) (*types.Package, error)
+
+func (f importerFunc) Import(path string) (*types.Package, error) {
+	return f(path)
+}
+
+func joinTypeErrors(errs []types.Error) string {
+	lines := make([]string, 0, len(errs))
+	for _, e := range errs {
+		lines = append(lines, e.Error())
+	}
+	return strings.Join(lines, "\n")
+}
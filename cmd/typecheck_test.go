@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"perfactor/cmd/util"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+)
+
+const workSource = `package work
+
+func Double(a []int) {
+	for i := range a {
+		a[i] = twice(a[i])
+	}
+}
+`
+
+const helperSource = `package work
+
+func twice(n int) int {
+	return 2 * n
+}
+`
+
+const helperTestSource = `package work
+
+import "testing"
+
+// wg is declared by the tests too, which the rewrite must not clash with
+var wg = 0
+
+func TestDouble(t *testing.T) {
+	Double([]int{wg})
+}
+`
+
+// loadedWorkspace stands in for loadWorkspace, type-checking the package and its test variant as go/packages would
+func loadedWorkspace(t *testing.T, dir string) *workspacePackages {
+	w := &workspacePackages{fileSet: token.NewFileSet()}
+	std := importer.ForCompiler(w.fileSet, "source", nil)
+	sync, err := std.Import("sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testingPkg, err := std.Import("testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.sync = sync
+	load := func(id string, sources map[string]string, imports map[string]*packages.Package) *packages.Package {
+		pkg := &packages.Package{ID: id, Name: "work", PkgPath: "example.com/work", Imports: imports}
+		for _, name := range []string{"work.go", "helper.go", "helper_test.go"} {
+			src, ok := sources[name]
+			if !ok {
+				continue
+			}
+			path := filepath.Join(dir, name)
+			file, err := parser.ParseFile(w.fileSet, path, src, parser.ParseComments)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pkg.CompiledGoFiles = append(pkg.CompiledGoFiles, path)
+			pkg.Syntax = append(pkg.Syntax, file)
+		}
+		pkg.Types, err = (&types.Config{Importer: importerFunc(func(path string) (*types.Package, error) {
+			return imports[path].Types, nil
+		})}).Check(pkg.PkgPath, w.fileSet, pkg.Syntax, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pkg
+	}
+	w.pkgs = []*packages.Package{
+		load("example.com/work [example.com/work.test]", map[string]string{"work.go": workSource, "helper.go": helperSource, "helper_test.go": helperTestSource},
+			map[string]*packages.Package{"testing": {PkgPath: "testing", Types: testingPkg}}),
+		load("example.com/work", map[string]string{"work.go": workSource, "helper.go": helperSource}, nil),
+	}
+	return w
+}
+
+func TestWorkspacePackages(t *testing.T) {
+	dir := t.TempDir()
+	w := loadedWorkspace(t, dir)
+	filePath := filepath.Join(dir, "work.go")
+
+	variants, err := w.variants("work", filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(variants) != 2 || variants[0].ID != "example.com/work" {
+		t.Fatalf("got %d variants starting with %s, want the package and its test variant", len(variants), variants[0].ID)
+	}
+
+	tests := []struct {
+		name    string
+		rewrite func(*ast.File, *types.Info) string
+		errors  string
+	}{
+		{"concurrent loop", func(file *ast.File, info *types.Info) string {
+			util.MakeLoopConcurrent(file, w.fileSet, 4, info)
+			src, err := util.PrintAST(w.fileSet, file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(src, "sync.WaitGroup") {
+				t.Fatalf("the loop was not rewritten:\n%s", src)
+			}
+			return src
+		}, ""},
+		{"unused variable", func(*ast.File, *types.Info) string {
+			return strings.Replace(workSource, "a[i] = twice(a[i])", "n := twice(a[i])", 1)
+		}, "declared and not used"},
+		{"clash with a test", func(*ast.File, *types.Info) string {
+			return workSource + "\nvar wg = 1\n"
+		}, "wg redeclared"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// every candidate starts from a fresh parse of the original file
+			file, info, err := w.parse("work", filePath, []byte(workSource))
+			if err != nil {
+				t.Fatal(err)
+			}
+			errs, err := w.typeCheck("work", filePath, []byte(tt.rewrite(file, info)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := joinTypeErrors(errs)
+			if tt.errors == "" && got != "" {
+				t.Errorf("got type errors:\n%s", got)
+			}
+			if tt.errors != "" && !strings.Contains(got, tt.errors) {
+				t.Errorf("got type errors %q, want %q", got, tt.errors)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/tools/benchmark/parse"
+)
+
+// BenchmarkNsPerOp reads the benchmark result lines in the output of a benchmark run
+// It returns the mean ns/op of each benchmark, keyed by name without the -GOMAXPROCS suffix
+func BenchmarkNsPerOp(output string) map[string]float64 {
+	set, err := parse.ParseSet(strings.NewReader(output))
+	if err != nil {
+		return nil
+	}
+	means := make(map[string]float64, len(set))
+	for name, runs := range set {
+		var total float64
+		n := 0
+		for _, run := range runs {
+			if run.Measured&parse.NsPerOp != 0 {
+				total += run.NsPerOp
+				n++
+			}
+		}
+		if n > 0 {
+			means[trimProcs(name)] = total / float64(n)
+		}
+	}
+	return means
+}
+
+// TotalNsPerOp sums the ns/op of every benchmark in the output, to report a run of several benchmarks as one time
+// Runs are compared with Speedup instead, since in the sum a fast benchmark hardly counts next to a slow one
+func TotalNsPerOp(output string) float64 {
+	return SumNsPerOp(BenchmarkNsPerOp(output))
+}
+
+// SumNsPerOp sums the ns/op of the benchmarks
+func SumNsPerOp(means map[string]float64) float64 {
+	var total float64
+	for _, ns := range means {
+		total += ns
+	}
+	return total
+}
+
+// Speedup compares two runs benchmark by benchmark, and gives the geometric mean of the before/after ratios of the
+// benchmarks in both, so that every benchmark counts the same however long its ops take. Above 1 the after run is faster
+// It gives 0 if the runs have no benchmark in common
+func Speedup(before map[string]float64, after map[string]float64) float64 {
+	var logs float64
+	n := 0
+	for name, ns := range before {
+		if ns <= 0 || after[name] <= 0 {
+			continue
+		}
+		logs += math.Log(ns / after[name])
+		n++
+	}
+	if n == 0 {
+		return 0
+	}
+	return math.Exp(logs / float64(n))
+}
+
+// FormatNsPerOp shows a time per op as a duration, such as "21.36ms/op"
+func FormatNsPerOp(ns float64) string {
+	return time.Duration(ns).String() + "/op"
+}
+
+// trimProcs removes the -N that the testing package adds to benchmark names when GOMAXPROCS is above 1
+func trimProcs(name string) string {
+	dash := strings.LastIndex(name, "-")
+	if dash == -1 {
+		return name
+	}
+	for _, c := range name[dash+1:] {
+		if c < '0' || c > '9' {
+			return name
+		}
+	}
+	return name[:dash]
+}
+
+// BuildTestBinary compiles the tests of the package in folderPath into a binary at binaryPath, with go test -c
+func BuildTestBinary(ctx context.Context, timeout time.Duration, folderPath string, binaryPath string) error {
+	dir, err := workingDir(folderPath)
+	if err != nil {
+		return err
+	}
+	binaryPath, err = filepath.Abs(binaryPath)
+	if err != nil {
+		return err
+	}
+	output, err := RunCommand(ctx, timeout, dir, "go", "test", "-c", "-o", binaryPath)
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// TestBinaryName gives the file name go test -c would use on this platform
+func TestBinaryName(name string) string {
+	if runtime.GOOS == "windows" {
+		return name + ".test.exe"
+	}
+	return name + ".test"
+}
+
+// ABResult holds the samples of an interleaved comparison, one per round and binary, in ns/op
+// Each round holds the ns/op of every benchmark
+type ABResult struct {
+	Baseline  []map[string]float64
+	Candidate []map[string]float64
+}
+
+// BaselineMedian is the summed median ns/op of the baseline's benchmarks
+func (r ABResult) BaselineMedian() float64 {
+	return SumNsPerOp(medians(r.Baseline))
+}
+
+// BaselineBench is the median ns/op of each of the baseline's benchmarks
+func (r ABResult) BaselineBench() map[string]float64 {
+	return medians(r.Baseline)
+}
+
+// CandidateBench is the median ns/op of each of the candidate's benchmarks
+func (r ABResult) CandidateBench() map[string]float64 {
+	return medians(r.Candidate)
+}
+
+// CandidateMedian is the summed median ns/op of the candidate's benchmarks
+func (r ABResult) CandidateMedian() float64 {
+	return SumNsPerOp(medians(r.Candidate))
+}
+
+// Speedup compares the median ns/op of each benchmark, as Speedup does
+func (r ABResult) Speedup() float64 {
+	return Speedup(medians(r.Baseline), medians(r.Candidate))
+}
+
+// Improved reports whether the candidate was faster than the baseline
+func (r ABResult) Improved() bool {
+	return r.Speedup() > 1
+}
+
+// medians gives the median ns/op of each benchmark over the rounds
+func medians(rounds []map[string]float64) map[string]float64 {
+	samples := make(map[string][]float64)
+	for _, round := range rounds {
+		for name, ns := range round {
+			samples[name] = append(samples[name], ns)
+		}
+	}
+	result := make(map[string]float64, len(samples))
+	for name, s := range samples {
+		result[name] = median(s)
+	}
+	return result
+}
+
+func median(samples []float64) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// RunInterleaved benchmarks two compiled test binaries in turns, ABAB..., so that thermal throttling and background load
+// affect both alike. The binaries are first run warmups times each without recording anything
+// Both are run in folderPath, as go test would, so that testdata and the like are found
+func RunInterleaved(ctx context.Context, timeout time.Duration, baseline string, candidate string, folderPath string, benchName string, warmups int, rounds int) (ABResult, error) {
+	var res ABResult
+	dir, err := workingDir(folderPath)
+	if err != nil {
+		return res, err
+	}
+	if baseline, err = filepath.Abs(baseline); err != nil {
+		return res, err
+	}
+	if candidate, err = filepath.Abs(candidate); err != nil {
+		return res, err
+	}
+	for i := 0; i < warmups; i++ {
+		if _, err := runTestBinary(ctx, timeout, baseline, dir, benchName); err != nil {
+			return res, err
+		}
+		if _, err := runTestBinary(ctx, timeout, candidate, dir, benchName); err != nil {
+			return res, err
+		}
+	}
+	for i := 0; i < rounds; i++ {
+		ns, err := runTestBinary(ctx, timeout, baseline, dir, benchName)
+		if err != nil {
+			return res, err
+		}
+		res.Baseline = append(res.Baseline, ns)
+		ns, err = runTestBinary(ctx, timeout, candidate, dir, benchName)
+		if err != nil {
+			return res, err
+		}
+		res.Candidate = append(res.Candidate, ns)
+	}
+	return res, nil
+}
+
+// runTestBinary runs the benchmarks matching benchName once, and returns the ns/op of each
+func runTestBinary(ctx context.Context, timeout time.Duration, binary string, dir string, benchName string) (map[string]float64, error) {
+	output, err := RunCommand(ctx, timeout, dir, binary, "-test.run=NONE", "-test.bench="+benchName, "-test.count=1")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	ns := BenchmarkNsPerOp(string(output))
+	if len(ns) == 0 {
+		return nil, errors.New("no benchmark results in output of " + filepath.Base(binary))
+	}
+	return ns, nil
+}
+
+// RemoveTestBinary deletes a binary made by BuildTestBinary, ignoring one that does not exist
+func RemoveTestBinary(binaryPath string) error {
+	if err := os.Remove(binaryPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package util
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBenchmarkNsPerOp(t *testing.T) {
+	output := "goos: linux\n" +
+		"BenchmarkFast-8   \t1000000000\t         1.000 ns/op\n" +
+		"BenchmarkFast-8   \t1000000000\t         3.000 ns/op\n" +
+		"BenchmarkSlow     \t   10000\t       100.0 ns/op\n" +
+		"PASS\n"
+	got := BenchmarkNsPerOp(output)
+	want := map[string]float64{"BenchmarkFast": 2, "BenchmarkSlow": 100}
+	if len(got) != len(want) {
+		t.Fatalf("BenchmarkNsPerOp() = %v, want %v", got, want)
+	}
+	for name, ns := range want {
+		if got[name] != ns {
+			t.Errorf("%s = %v, want %v", name, got[name], ns)
+		}
+	}
+	if total := TotalNsPerOp(output); total != 102 {
+		t.Errorf("TotalNsPerOp() = %v, want 102", total)
+	}
+}
+
+func TestSpeedup(t *testing.T) {
+	tests := []struct {
+		name   string
+		before map[string]float64
+		after  map[string]float64
+		want   float64
+	}{
+		{"one benchmark twice as fast", map[string]float64{"A": 100}, map[string]float64{"A": 50}, 2},
+		{"regression in the fast benchmark", map[string]float64{"Fast": 1, "Slow": 100}, map[string]float64{"Fast": 2, "Slow": 99}, math.Sqrt(0.5 * 100.0 / 99)},
+		{"opposite changes cancel out", map[string]float64{"A": 10, "B": 10}, map[string]float64{"A": 5, "B": 20}, 1},
+		{"only common benchmarks count", map[string]float64{"A": 10, "B": 10}, map[string]float64{"A": 5}, 2},
+		{"nothing in common", map[string]float64{"A": 10}, map[string]float64{"B": 5}, 0},
+		{"no results", nil, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Speedup(tt.before, tt.after); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("Speedup() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestABResultSpeedup(t *testing.T) {
+	r := ABResult{
+		Baseline:  []map[string]float64{{"Fast": 1, "Slow": 100}, {"Fast": 1, "Slow": 102}, {"Fast": 9, "Slow": 98}},
+		Candidate: []map[string]float64{{"Fast": 2, "Slow": 90}, {"Fast": 2, "Slow": 91}, {"Fast": 2, "Slow": 92}},
+	}
+	// the medians are Fast 1 -> 2 and Slow 100 -> 91, so the fast benchmark's regression outweighs the slow one's gain
+	if r.Improved() {
+		t.Errorf("Improved() with a speedup of %v, want a slowdown", r.Speedup())
+	}
+	if got := r.BaselineMedian(); got != 101 {
+		t.Errorf("BaselineMedian() = %v, want 101", got)
+	}
+	if got := r.CandidateMedian(); got != 93 {
+		t.Errorf("CandidateMedian() = %v, want 93", got)
+	}
+	if got := r.CandidateBench(); got["Fast"] != 2 || got["Slow"] != 91 {
+		t.Errorf("CandidateBench() = %v, want Fast 2 and Slow 91", got)
+	}
+}
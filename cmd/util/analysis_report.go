@@ -0,0 +1,182 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/owenrumney/go-sarif/sarif"
+)
+
+// CandidateRuleID is the SARIF rule of a loop the analysis would try to make concurrent
+const CandidateRuleID = "PERFACTOR_ANALYZE_001"
+
+// Verdicts of the analysis, in the order the loops are ranked
+const (
+	// VerdictCandidate is a safe loop, over the threshold and not predicted to be slower, which full would try
+	VerdictCandidate = "candidate"
+	// VerdictPredictedSlower is a safe loop over the threshold that the speedup model expects to be slower
+	VerdictPredictedSlower = "predicted slower"
+	// VerdictCold is a safe loop with too small a share of the profile to be worth trying
+	VerdictCold = "cold"
+	// VerdictUnsafe is a loop the safety rules reject
+	VerdictUnsafe = "unsafe"
+)
+
+// RuleFinding is why a safety rule rejected a loop
+type RuleFinding struct {
+	Rule    string
+	Message string
+}
+
+// AnalysedLoop is a loop with what the analysis found of it
+type AnalysedLoop struct {
+	// Rank is the loop's place in the report, from 1
+	Rank    int
+	Package string
+	// File is the path of the loop's file within the module
+	File    string
+	Line    int
+	EndLine int
+	Func    string
+	Verdict string
+	// Reasons are the safety rules that reject the loop
+	Reasons []RuleFinding `json:",omitempty"`
+	// Time is the CPU time attributed to the loop, and Share that time as a percentage of its package's profile
+	Time  int64
+	Share float64
+	Match string
+	// Predicted is the speedup the model predicts for the benchmarks, or 0 if there was nothing to predict it from or the
+	// loop's iterations are not known
+	Predicted  float64 `json:",omitempty"`
+	Iterations int64   `json:",omitempty"`
+}
+
+// AnalysisReport is the ranked list of the loops of the analysed packages
+type AnalysisReport struct {
+	Project  string
+	Packages []string
+	// Threshold is the percentage of a profile a safe loop must take to be a candidate
+	Threshold float32
+	Loops     []AnalysedLoop
+}
+
+// verdictOrder ranks the verdicts, the most promising first
+var verdictOrder = map[string]int{VerdictCandidate: 0, VerdictPredictedSlower: 1, VerdictCold: 2, VerdictUnsafe: 3}
+
+// Rank sorts the loops by verdict, the candidates by their predicted speedup, and then by share, and numbers them
+func (r *AnalysisReport) Rank() {
+	sort.SliceStable(r.Loops, func(i, j int) bool {
+		a, b := r.Loops[i], r.Loops[j]
+		if verdictOrder[a.Verdict] != verdictOrder[b.Verdict] {
+			return verdictOrder[a.Verdict] < verdictOrder[b.Verdict]
+		}
+		if a.Predicted != b.Predicted {
+			return a.Predicted > b.Predicted
+		}
+		if a.Time != b.Time {
+			return a.Time > b.Time
+		}
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Line < b.Line
+	})
+	for i := range r.Loops {
+		r.Loops[i].Rank = i + 1
+	}
+}
+
+// WriteText writes the report for reading, one loop to a line with the rules that reject it below
+func (r AnalysisReport) WriteText(out io.Writer) error {
+	var b strings.Builder
+	_, _ = fmt.Fprintf(&b, "Analysed %d loops in %s (%s)\n", len(r.Loops), r.Project, strings.Join(r.Packages, ", "))
+	counts := make(map[string]int)
+	for _, l := range r.Loops {
+		counts[l.Verdict]++
+	}
+	_, _ = fmt.Fprintf(&b, "%d candidates, %d predicted slower, %d cold (under %.1f%%), %d unsafe\n",
+		counts[VerdictCandidate], counts[VerdictPredictedSlower], counts[VerdictCold], r.Threshold, counts[VerdictUnsafe])
+	for _, l := range r.Loops {
+		predicted := ""
+		if l.Predicted > 0 {
+			predicted = fmt.Sprintf(", predicted %.2fx", l.Predicted)
+		}
+		sampled := fmt.Sprintf("%.1f%% of the profile (%s)", l.Share, time.Duration(l.Time))
+		if l.Time == 0 {
+			sampled = l.Match
+		}
+		_, _ = fmt.Fprintf(&b, "%3d. %s:%d in %s: %s, %s%s\n", l.Rank, l.File, l.Line, l.Func, l.Verdict, sampled, predicted)
+		for _, reason := range l.Reasons {
+			_, _ = fmt.Fprintf(&b, "       %s: %s\n", reason.Rule, reason.Message)
+		}
+	}
+	_, err := io.WriteString(out, b.String())
+	return err
+}
+
+// WriteJSON writes the report as indented JSON
+func (r AnalysisReport) WriteJSON(out io.Writer) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// WriteSARIF writes the report as a SARIF log: a result for each candidate, and one for each rule that rejects a loop
+// Loops predicted to be slower are reported under the prediction stage's rule, and cold loops are left out
+func (r AnalysisReport) WriteSARIF(out io.Writer) error {
+	report, err := sarif.New(sarif.Version210)
+	if err != nil {
+		return err
+	}
+	run := sarif.NewRun("perfactor", "uri_placeholder")
+	for _, l := range r.Loops {
+		switch l.Verdict {
+		case VerdictCandidate:
+			msg := fmt.Sprintf("Candidate for a concurrent loop ; %.1f%% of the profile", l.Share)
+			if l.Predicted > 0 {
+				msg += fmt.Sprintf(", predicted %.2fx", l.Predicted)
+			}
+			AddRunResultForLine(run, CandidateRuleID, msg, l.File, l.Line).WithLevel("note").WithRank(float32(l.Share))
+		case VerdictPredictedSlower:
+			AddRunResultForLine(run, StagePrediction.RuleID(), fmt.Sprintf("Predicted to be slower ; %.2fx", l.Predicted), l.File, l.Line)
+		case VerdictUnsafe:
+			for _, reason := range l.Reasons {
+				AddRunResultForLine(run, reason.Rule, reason.Message, l.File, l.Line)
+			}
+		}
+	}
+	report.AddRun(run)
+	var buffer bytes.Buffer
+	err = report.Write(&buffer)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(buffer.Bytes())
+	return err
+}
+
+// RuleFindings gives the rules the static checks reported in a SARIF run, by the line of the loop they are about
+func RuleFindings(run *sarif.Run) map[int][]RuleFinding {
+	findings := make(map[int][]RuleFinding)
+	for _, result := range run.Results {
+		if result.RuleID == nil || len(result.Locations) == 0 {
+			continue
+		}
+		location := result.Locations[0].PhysicalLocation
+		if location == nil || location.Region == nil || location.Region.StartLine == nil {
+			continue
+		}
+		message := ""
+		if result.Message.Text != nil {
+			message = *result.Message.Text
+		}
+		line := *location.Region.StartLine
+		findings[line] = append(findings[line], RuleFinding{Rule: *result.RuleID, Message: message})
+	}
+	return findings
+}
@@ -19,6 +19,8 @@ type Loop struct {
 	End     token.Pos
 	Line    int
 	EndLine int
+	// Func is the name of the function the loop is in, as it appears in profiles without the package path
+	Func string
 }
 
 // FindSafeLoopsForRefactoring finds loops that can be refactored to be concurrent
@@ -83,7 +85,7 @@ func LoopCanBeConcurrent(loop Loop, fileSet *token.FileSet, run *sarif.Run, file
 		loopVars = findRangeLoopVars(loop.Range)
 	} else {
 		// This should never happen
-		_, _ = fmt.Fprintf(out, "Error: Loop at line", fileSet.Position(loop.Pos).Line, "is neither a for-loop nor a range-loop\n")
+		_, _ = fmt.Fprintf(out, "Error: Loop at line %d is neither a for-loop nor a range-loop\n", fileSet.Position(loop.Pos).Line)
 		return false
 	}
 	if loopVars == nil {
@@ -721,3 +723,13 @@ func addRunResult(run *sarif.Run, ruleID, messageText string, fileLocation *sari
 				WithStartColumn(f.Position(pos).Column)))).
 		WithMessage(sarif.NewMessage().WithText(messageText))
 }
+
+// AddRunResultForLine adds a result for the loop starting on the given line to the SARIF run
+// It is used for findings made outside the static rules, where the loop has been reprinted and positions are stale
+func AddRunResultForLine(run *sarif.Run, ruleID, messageText string, fileName string, line int) *sarif.Result {
+	return run.AddResult(ruleID).
+		WithLocation(sarif.NewLocationWithPhysicalLocation(sarif.NewPhysicalLocation().
+			WithArtifactLocation(sarif.NewArtifactLocation().WithUri(fileName)).
+			WithRegion(sarif.NewRegion().WithStartLine(line)))).
+		WithMessage(sarif.NewMessage().WithText(messageText))
+}
@@ -47,6 +47,7 @@ func FindAssignedIdentifiers(loop *ast.ForStmt) map[*ast.Ident]bool {
 func FindForLoopsInAST(astFile ast.Node, fset *token.FileSet, valid func(ast.Node, *token.FileSet) bool) []Loop {
 	// array of AST positions for for loops
 	var forLoops []Loop
+	funcs := findFuncDecls(astFile)
 
 	// Traverse the AST looking for loops
 	ast.Inspect(astFile, func(n ast.Node) bool {
@@ -61,6 +62,7 @@ func FindForLoopsInAST(astFile ast.Node, fset *token.FileSet, valid func(ast.Nod
 			//fmt.Println("Found a for Loop at line", fset.Position(n.Pos()).Line)
 			forLoops = append(forLoops, Loop{
 				For:     n,
+				Func:    enclosingFuncName(funcs, n.Pos()),
 				Pos:     n.Pos(),
 				End:     n.End(),
 				Body:    n.Body,
@@ -74,6 +76,7 @@ func FindForLoopsInAST(astFile ast.Node, fset *token.FileSet, valid func(ast.Nod
 			//fmt.Println("Found a range Loop at line", fset.Position(n.Pos()).Line)
 			forLoops = append(forLoops, Loop{
 				Range:   n,
+				Func:    enclosingFuncName(funcs, n.Pos()),
 				Pos:     n.Pos(),
 				End:     n.End(),
 				Body:    n.Body,
@@ -86,6 +89,56 @@ func FindForLoopsInAST(astFile ast.Node, fset *token.FileSet, valid func(ast.Nod
 	return forLoops
 }
 
+func findFuncDecls(node ast.Node) []*ast.FuncDecl {
+	var funcs []*ast.FuncDecl
+	ast.Inspect(node, func(n ast.Node) bool {
+		if decl, ok := n.(*ast.FuncDecl); ok {
+			funcs = append(funcs, decl)
+			return false
+		}
+		return true
+	})
+	return funcs
+}
+
+// enclosingFuncName names the function declared around pos the way profiles do, without the package path:
+// "work" for a function, and "T.M" or "(*T).M" for a method. It is empty outside any function
+func enclosingFuncName(funcs []*ast.FuncDecl, pos token.Pos) string {
+	for _, decl := range funcs {
+		if decl.Pos() > pos || pos >= decl.End() {
+			continue
+		}
+		if decl.Recv == nil || len(decl.Recv.List) == 0 {
+			return decl.Name.Name
+		}
+		recv := decl.Recv.List[0].Type
+		pointer := false
+		if star, ok := recv.(*ast.StarExpr); ok {
+			recv = star.X
+			pointer = true
+		}
+		// generic receivers appear as T[...] in profiles
+		typeName := ""
+		switch r := recv.(type) {
+		case *ast.Ident:
+			typeName = r.Name
+		case *ast.IndexExpr:
+			if ident, ok := r.X.(*ast.Ident); ok {
+				typeName = ident.Name + "[...]"
+			}
+		case *ast.IndexListExpr:
+			if ident, ok := r.X.(*ast.Ident); ok {
+				typeName = ident.Name + "[...]"
+			}
+		}
+		if pointer {
+			return "(*" + typeName + ")." + decl.Name.Name
+		}
+		return typeName + "." + decl.Name.Name
+	}
+	return ""
+}
+
 func GetASTFromFile(inputPath string, fset *token.FileSet) *ast.File {
 	// parse the file
 	f, err := parser.ParseFile(fset, inputPath, nil, parser.ParseComments)
@@ -0,0 +1,135 @@
+package util
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"perfactor/graph"
+	"strings"
+
+	"github.com/google/pprof/profile"
+	"golang.org/x/mod/modfile"
+)
+
+// LoopMatch says how a loop was found in a profile, so loops without samples can be told apart by cause
+type LoopMatch int
+
+const (
+	// LoopSampled means samples were attributed to the loop
+	LoopSampled LoopMatch = iota
+	// LoopNotSampled means the loop's function is in the profile, but none of its samples are on the loop's lines
+	LoopNotSampled
+	// FunctionNotInProfile means the loop's file is in the profile, but its function never is, which can mean it was inlined away
+	FunctionNotInProfile
+	// FileNotInProfile means nothing in the loop's file appears in the profile
+	FileNotInProfile
+)
+
+func (m LoopMatch) String() string {
+	switch m {
+	case LoopSampled:
+		return "sampled"
+	case LoopNotSampled:
+		return "no samples on the loop's lines"
+	case FunctionNotInProfile:
+		return "function not in the profile"
+	case FileNotInProfile:
+		return "file not in the profile"
+	}
+	return "unknown"
+}
+
+// AttributeSamples sums, for each loop, the CPU time of the samples with a frame on the loop's lines, in its function and file
+// The file is matched by its path in the module and its package, as graph.IsFile does, so profiles built elsewhere
+// still match. Every inlined call has its own line in a location, with its own function,
+// so a loop in an inlined function is found through that line rather than the function it was inlined into
+// A sample counts once for a loop, however many of its frames are in it, as with a closure called inside the loop
+func AttributeSamples(prof *profile.Profile, loops []Loop, file graph.File) ([]int64, []LoopMatch) {
+	times := make([]int64, len(loops))
+	matches := make([]LoopMatch, len(loops))
+	fileSeen := false
+	funcSeen := make([]bool, len(loops))
+	index := cpuValueIndex(prof)
+
+	// whether a function of the profile is in the file is looked up once, rather than for every frame
+	inFile := make(map[*profile.Function]bool)
+	for _, fn := range prof.Function {
+		inFile[fn] = graph.IsFile(fn.Filename, fn.Name, file)
+	}
+
+	counted := make([]bool, len(loops))
+	for _, sample := range prof.Sample {
+		for i := range counted {
+			counted[i] = false
+		}
+		for _, location := range sample.Location {
+			for _, line := range location.Line {
+				if line.Function == nil || !inFile[line.Function] {
+					continue
+				}
+				fileSeen = true
+				for i, loop := range loops {
+					if !inFunction(line.Function.Name, loop.Func) {
+						continue
+					}
+					funcSeen[i] = true
+					if !counted[i] && int(line.Line) >= loop.Line && int(line.Line) <= loop.EndLine {
+						counted[i] = true
+						times[i] += sample.Value[index]
+					}
+				}
+			}
+		}
+	}
+
+	for i := range loops {
+		switch {
+		case times[i] != 0:
+			matches[i] = LoopSampled
+		case funcSeen[i]:
+			matches[i] = LoopNotSampled
+		case fileSeen:
+			matches[i] = FunctionNotInProfile
+		default:
+			matches[i] = FileNotInProfile
+		}
+	}
+	return times, matches
+}
+
+// ProjectFile gives the file at fileName in the module at folderPath, with its package's path from the module's go.mod
+// Without a go.mod the package is not known, and the file is matched by its path alone
+func ProjectFile(folderPath string, fileName string) graph.File {
+	file := graph.File{Path: filepath.ToSlash(filepath.Clean(fileName))}
+	data, err := os.ReadFile(filepath.Join(folderPath, "go.mod"))
+	if err != nil {
+		return file
+	}
+	module := modfile.ModulePath(data)
+	if module == "" {
+		return file
+	}
+	file.Package = module
+	if dir := path.Dir(file.Path); dir != "." {
+		file.Package += "/" + dir
+	}
+	return file
+}
+
+// inFunction reports whether the function named in a profile is funcName, or a closure inside it
+// Profile names have the package path in front, as in "example.com/m/pkg.(*T).M", and closures after,
+// as in "pkg.work.func1" or "pkg.work.gowrap1". An empty funcName matches any function
+func inFunction(profileName string, funcName string) bool {
+	if funcName == "" {
+		return true
+	}
+	if strings.HasSuffix(profileName, "."+funcName) {
+		return true
+	}
+	idx := strings.LastIndex(profileName, "."+funcName+".")
+	if idx == -1 {
+		return false
+	}
+	rest := profileName[idx+len(funcName)+2:]
+	return strings.HasPrefix(rest, "func") || strings.HasPrefix(rest, "gowrap") || (rest != "" && rest[0] >= '0' && rest[0] <= '9')
+}
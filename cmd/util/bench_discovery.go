@@ -0,0 +1,136 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"perfactor/graph"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// DiscoveryBenchTime keeps the profiling run of each benchmark short, since it is only used to see which code it reaches
+const DiscoveryBenchTime = "200ms"
+
+// BenchmarkCoverage is how much of a benchmark's CPU profile was spent in the target file
+type BenchmarkCoverage struct {
+	Name string
+	// FileNanos is the CPU time of the samples with a frame in the file, and TotalNanos that of every sample
+	FileNanos  int64
+	TotalNanos int64
+	// Err is set if the benchmark could not be run or profiled
+	Err error
+}
+
+// Share is the part of the benchmark's CPU time spent in the file, from 0 to 1
+func (c BenchmarkCoverage) Share() float64 {
+	if c.TotalNanos == 0 {
+		return 0
+	}
+	return float64(c.FileNanos) / float64(c.TotalNanos)
+}
+
+func (c BenchmarkCoverage) String() string {
+	if c.Err != nil {
+		return fmt.Sprintf("%s: %s", c.Name, c.Err.Error())
+	}
+	return fmt.Sprintf("%s: %s of %s in the file (%.1f%%)", c.Name, time.Duration(c.FileNanos), time.Duration(c.TotalNanos), c.Share()*100)
+}
+
+// ListBenchmarks gives the names of the benchmarks in the package in folderPath, using go test -list
+func ListBenchmarks(ctx context.Context, timeout time.Duration, folderPath string) ([]string, error) {
+	dir, err := workingDir(folderPath)
+	if err != nil {
+		return nil, err
+	}
+	output, err := RunCommand(ctx, timeout, dir, "go", "test", "-list", "^Benchmark")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	var names []string
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "Benchmark") && !strings.ContainsAny(line, " \t") {
+			names = append(names, line)
+		}
+	}
+	return names, nil
+}
+
+// DiscoverBenchmarks profiles every benchmark in the package briefly, and reports how much of each one's time is spent in fileName
+// The coverage is in the order the benchmarks are declared
+func DiscoverBenchmarks(ctx context.Context, timeout time.Duration, flags string, folderPath string, fileName string) ([]BenchmarkCoverage, error) {
+	names, err := ListBenchmarks(ctx, timeout, folderPath)
+	if err != nil {
+		return nil, err
+	}
+	coverage := make([]BenchmarkCoverage, 0, len(names))
+	for _, name := range names {
+		c := BenchmarkCoverage{Name: name}
+		result := RunCodeContext(ctx, timeout, flags+" -benchtime="+DiscoveryBenchTime, BenchmarkPattern([]string{name}), "NONE", "", folderPath+fileName, folderPath, true, 1)
+		if ctx.Err() != nil {
+			return coverage, ctx.Err()
+		}
+		if !result.Ok() {
+			c.Err = fmt.Errorf("benchmark failed: %s", result.FailureSummary())
+			coverage = append(coverage, c)
+			continue
+		}
+		prof, err := GetProfileDataFromFile(folderPath + "cpu.pprof")
+		if err != nil {
+			c.Err = err
+			coverage = append(coverage, c)
+			continue
+		}
+		c.FileNanos, c.TotalNanos = FileSampleTime(prof, ProjectFile(folderPath, fileName))
+		coverage = append(coverage, c)
+	}
+	return coverage, nil
+}
+
+// FileSampleTime sums the CPU time of the samples that have a frame in the file, and that of every sample
+// Each sample is counted once, however many of its frames are in the file
+func FileSampleTime(prof *profile.Profile, file graph.File) (int64, int64) {
+	index := cpuValueIndex(prof)
+	var inFile, total int64
+	for _, sample := range prof.Sample {
+		value := sample.Value[index]
+		total += value
+		if sampleInFile(sample, file) {
+			inFile += value
+		}
+	}
+	return inFile, total
+}
+
+func sampleInFile(sample *profile.Sample, file graph.File) bool {
+	for _, location := range sample.Location {
+		for _, line := range location.Line {
+			if line.Function != nil && graph.IsFile(line.Function.Filename, line.Function.Name, file) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cpuValueIndex finds the sample value holding CPU time, which is the last one in profiles written by the testing package
+func cpuValueIndex(prof *profile.Profile) int {
+	for i, sampleType := range prof.SampleType {
+		if sampleType.Type == "cpu" {
+			return i
+		}
+	}
+	return len(prof.SampleType) - 1
+}
+
+// BenchmarkPattern makes a -bench pattern that matches exactly the given benchmarks
+func BenchmarkPattern(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = regexp.QuoteMeta(name)
+	}
+	return "^(" + strings.Join(quoted, "|") + ")$"
+}
@@ -0,0 +1,38 @@
+package util
+
+import (
+	"perfactor/graph"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestFileSampleTime(t *testing.T) {
+	work := &profile.Function{ID: 1, Name: "example.com/m.work", Filename: "/src/m/work.go"}
+	subWork := &profile.Function{ID: 2, Name: "example.com/m/sub.work", Filename: "/src/m/sub/work.go"}
+	depWork := &profile.Function{ID: 3, Name: "example.com/dep.work", Filename: "/go/pkg/mod/example.com/dep@v1.0.0/work.go"}
+	location := func(id uint64, fns ...*profile.Function) *profile.Location {
+		l := &profile.Location{ID: id}
+		for _, fn := range fns {
+			l.Line = append(l.Line, profile.Line{Function: fn, Line: 10})
+		}
+		return l
+	}
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}, {Type: "cpu", Unit: "nanoseconds"}},
+		Function:   []*profile.Function{work, subWork, depWork},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{location(1, work)}, Value: []int64{1, 10}},
+			// counted once, however many frames are in the file
+			{Location: []*profile.Location{location(2, work), location(3, work)}, Value: []int64{1, 20}},
+			// a frame inlined into another function
+			{Location: []*profile.Location{location(4, work, subWork)}, Value: []int64{1, 40}},
+			{Location: []*profile.Location{location(5, subWork)}, Value: []int64{1, 80}},
+			{Location: []*profile.Location{location(6, depWork)}, Value: []int64{1, 160}},
+		},
+	}
+	inFile, total := FileSampleTime(prof, graph.File{Path: "work.go", Package: "example.com/m"})
+	if inFile != 70 || total != 310 {
+		t.Errorf("FileSampleTime() = %d, %d, want 70, 310", inFile, total)
+	}
+}
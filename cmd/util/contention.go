@@ -0,0 +1,174 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"perfactor/graph"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// BlockProfileName and MutexProfileName are the files in the workspace that a candidate's contention profiles are written to
+const (
+	BlockProfileName = "block.pprof"
+	MutexProfileName = "mutex.pprof"
+)
+
+// ContentionRuleID is the SARIF rule used when a candidate's goroutines are flagged for being blocked
+const ContentionRuleID = "PERFACTOR_RUN_008"
+
+// contendedSiteCount is how many of the call sites with the longest waits are named in the report
+const contendedSiteCount = 5
+
+// ContendedSite is a call that goroutines waited on, named by the first frame outside of the runtime and sync packages,
+// which is the code that took the lock or used the channel rather than the lock itself
+type ContendedSite struct {
+	// Kind is "block" for the block profile, which has the waiters, or "mutex" for the mutex profile, which has the holders
+	Kind     string
+	Function string
+	File     string
+	Line     int
+	Delay    int64
+}
+
+func (s ContendedSite) String() string {
+	return fmt.Sprintf("%s (%s:%d), %s waited (%s)", s.Function, s.File, s.Line, time.Duration(s.Delay), s.Kind)
+}
+
+// Contention is how long the goroutines started in a function spent blocked during a benchmark run
+type Contention struct {
+	// Delay is the summed time the goroutines were blocked, and Elapsed the wall time of the run
+	Delay   int64
+	Elapsed int64
+	Sites   []ContendedSite
+}
+
+// Share is the time blocked as a percentage of the run; with many goroutines it can be over 100
+func (c Contention) Share() float64 {
+	if c.Elapsed == 0 {
+		return 0
+	}
+	return float64(c.Delay) / float64(c.Elapsed) * 100
+}
+
+// MeasureContention runs the benchmarks once with the block and mutex profiles on, which record every event
+// It is a separate run from the timed ones, since recording every event slows down the code that blocks
+// Either profile is nil if it could not be read
+func MeasureContention(ctx context.Context, timeout time.Duration, flags string, folderPath string, benchName string) (*profile.Profile, *profile.Profile, TestResult) {
+	dir, err := workingDir(folderPath)
+	if err != nil {
+		return nil, nil, TestResult{Err: err}
+	}
+	args := []string{"test"}
+	args = append(args, strings.Fields(flags)...)
+	args = append(args, "-json", "-run=NONE", "-bench="+benchName, "-count=1",
+		"-blockprofile", BlockProfileName, "-mutexprofile", MutexProfileName)
+	output, err := RunCommand(ctx, timeout, dir, "go", args...)
+	result := toTestResult(output, err)
+	if !result.Ok() {
+		return nil, nil, result
+	}
+	block, _ := GetProfileDataFromFile(folderPath + BlockProfileName)
+	mutex, _ := GetProfileDataFromFile(folderPath + MutexProfileName)
+	return block, mutex, result
+}
+
+// GoroutineContention sums the waits of the goroutines started by closures of funcName in the file, such as the ones
+// a refactored loop starts. The time comes from the block profile, which has every wait; the mutex profile only adds
+// the call sites that held the contended locks, since its waits are already in the block profile
+func GoroutineContention(block *profile.Profile, mutex *profile.Profile, elapsed time.Duration, funcName string, file graph.File) Contention {
+	c := Contention{Elapsed: int64(elapsed)}
+	type key struct {
+		kind     string
+		function string
+		line     int64
+	}
+	sites := make(map[key]*ContendedSite)
+	for _, kind := range []string{"block", "mutex"} {
+		prof := block
+		if kind == "mutex" {
+			prof = mutex
+		}
+		if prof == nil {
+			continue
+		}
+		index := delayValueIndex(prof)
+		for _, sample := range prof.Sample {
+			if !inClosureOf(sample, funcName, file) {
+				continue
+			}
+			delay := sample.Value[index]
+			if kind == "block" {
+				c.Delay += delay
+			}
+			site := contendedFrame(sample)
+			if site.Function == nil {
+				continue
+			}
+			k := key{kind, site.Function.Name, site.Line}
+			if sites[k] == nil {
+				sites[k] = &ContendedSite{Kind: kind, Function: site.Function.Name, File: site.Function.Filename, Line: int(site.Line)}
+			}
+			sites[k].Delay += delay
+		}
+	}
+	for _, site := range sites {
+		c.Sites = append(c.Sites, *site)
+	}
+	sort.Slice(c.Sites, func(i, j int) bool {
+		if c.Sites[i].Delay != c.Sites[j].Delay {
+			return c.Sites[i].Delay > c.Sites[j].Delay
+		}
+		return c.Sites[i].Function < c.Sites[j].Function
+	})
+	if len(c.Sites) > contendedSiteCount {
+		c.Sites = c.Sites[:contendedSiteCount]
+	}
+	return c
+}
+
+// inClosureOf reports whether the sample has a frame in a closure of funcName in the file, but not in funcName itself,
+// so the waits of the function's own goroutine, such as for the WaitGroup, are not counted
+func inClosureOf(sample *profile.Sample, funcName string, file graph.File) bool {
+	for _, location := range sample.Location {
+		for _, line := range location.Line {
+			if line.Function == nil || !graph.IsFile(line.Function.Filename, line.Function.Name, file) {
+				continue
+			}
+			name := line.Function.Name
+			if inFunction(name, funcName) && !strings.HasSuffix(name, "."+funcName) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// contendedFrame finds the innermost frame of the sample outside of the runtime and sync packages
+func contendedFrame(sample *profile.Sample) profile.Line {
+	for _, location := range sample.Location {
+		for _, line := range location.Line {
+			if line.Function == nil {
+				continue
+			}
+			pkg := graph.PackagePath(line.Function.Name)
+			if pkg != "runtime" && pkg != "sync" && !strings.HasPrefix(pkg, "internal/") && !strings.HasPrefix(pkg, "runtime/") {
+				return line
+			}
+		}
+	}
+	return profile.Line{}
+}
+
+// delayValueIndex finds the delay in the values of a block or mutex profile, which also count the contentions
+func delayValueIndex(prof *profile.Profile) int {
+	for i, sampleType := range prof.SampleType {
+		if sampleType.Type == "delay" {
+			return i
+		}
+	}
+	return len(prof.SampleType) - 1
+}
@@ -0,0 +1,61 @@
+package util
+
+import (
+	"perfactor/graph"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestGoroutineContention(t *testing.T) {
+	var functions []*profile.Function
+	frame := func(name string, filename string, line int64) *profile.Location {
+		fn := &profile.Function{ID: uint64(len(functions) + 1), Name: name, Filename: filename}
+		functions = append(functions, fn)
+		return &profile.Location{ID: fn.ID, Line: []profile.Line{{Function: fn, Line: line}}}
+	}
+	lock := frame("sync.(*Mutex).Lock", "/go/src/sync/mutex.go", 90)
+	// a generic function of sync whose type argument has a path, which must not be taken for the code that waited
+	once := frame("sync.OnceValue[example.com/m/pkg.T].func1", "/go/src/sync/oncefunc.go", 60)
+	closure := frame("example.com/m/pkg.work.func1", "/src/pkg/work.go", 12)
+	work := frame("example.com/m/pkg.work", "/src/pkg/work.go", 10)
+	wait := frame("sync.(*WaitGroup).Wait", "/go/src/sync/waitgroup.go", 110)
+	other := frame("example.com/m/pkg.other.func1", "/src/pkg/work.go", 30)
+
+	profileOf := func(samples ...*profile.Sample) *profile.Profile {
+		return &profile.Profile{
+			SampleType: []*profile.ValueType{{Type: "contentions", Unit: "count"}, {Type: "delay", Unit: "nanoseconds"}},
+			Function:   functions,
+			Sample:     samples,
+		}
+	}
+	block := profileOf(
+		&profile.Sample{Location: []*profile.Location{lock, once, closure, work}, Value: []int64{2, 300}},
+		&profile.Sample{Location: []*profile.Location{lock, closure, work}, Value: []int64{1, 100}},
+		// the function's own wait for its goroutines, and the goroutines of another function, are not counted
+		&profile.Sample{Location: []*profile.Location{wait, work}, Value: []int64{1, 5000}},
+		&profile.Sample{Location: []*profile.Location{lock, other}, Value: []int64{1, 7000}},
+	)
+	mutex := profileOf(&profile.Sample{Location: []*profile.Location{lock, closure, work}, Value: []int64{1, 50}})
+
+	c := GoroutineContention(block, mutex, time.Microsecond, "work", graph.File{Path: "pkg/work.go", Package: "example.com/m/pkg"})
+	if c.Delay != 400 {
+		t.Errorf("Delay = %d, want 400", c.Delay)
+	}
+	if got := c.Share(); got != 40 {
+		t.Errorf("Share() = %v, want 40", got)
+	}
+	want := []ContendedSite{
+		{Kind: "block", Function: "example.com/m/pkg.work.func1", File: "/src/pkg/work.go", Line: 12, Delay: 400},
+		{Kind: "mutex", Function: "example.com/m/pkg.work.func1", File: "/src/pkg/work.go", Line: 12, Delay: 50},
+	}
+	if len(c.Sites) != len(want) {
+		t.Fatalf("Sites = %v, want %v", c.Sites, want)
+	}
+	for i := range want {
+		if c.Sites[i] != want[i] {
+			t.Errorf("Sites[%d] = %+v, want %+v", i, c.Sites[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,727 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DependenceFileName and DependenceTestFileName are the files of the access recorder and of the TestMain that writes out
+// what it found, which are added to the package of the checked file
+const (
+	DependenceFileName     = "perfactor_dependence.go"
+	DependenceTestFileName = "perfactor_dependence_test.go"
+)
+
+// DependencesFileName is the file the loop-carried dependences are written to when the tests finish, in the package's folder
+const DependencesFileName = "perfactor_dependences.json"
+
+// DependenceRuleID is the SARIF rule used when a loop is rejected for a dependence seen while the tests ran
+const DependenceRuleID = "PERFACTOR_RUN_010"
+
+// Dependence is a location used in two iterations of a loop, with a write in at least one of them
+// Kind is "write-read", "write-write" or "read-write", in the order of the two accesses
+type Dependence struct {
+	Kind string
+	// First and Second are the lines of the statements that made the two accesses, which may be in functions the loop calls
+	First           int
+	Second          int
+	FirstIteration  int64
+	SecondIteration int64
+	// Count is how many times the pair of lines was seen
+	Count int64
+}
+
+func (d Dependence) String() string {
+	kinds := strings.SplitN(d.Kind, "-", 2)
+	if len(kinds) != 2 {
+		kinds = []string{"used", "used"}
+	}
+	return fmt.Sprintf("%s at line %d in iteration %d, and %s at line %d in iteration %d (%d times)",
+		pastTense(kinds[0]), d.First, d.FirstIteration, pastTense(kinds[1]), d.Second, d.SecondIteration, d.Count)
+}
+
+func pastTense(access string) string {
+	if access == "write" {
+		return "written"
+	}
+	return access
+}
+
+// DependenceReport is what the recorder saw of a loop over every invocation during the tests
+type DependenceReport struct {
+	Line        int
+	Invocations int64
+	Iterations  int64
+	Conflicts   []Dependence
+}
+
+// Exercised reports whether the loop ran at least two iterations in one invocation, without which no dependence can show
+func (r DependenceReport) Exercised() bool {
+	return r.Invocations > 0 && r.Iterations > r.Invocations
+}
+
+// StartsGoroutines reports whether the loop's body has a go statement, including in the closures it makes
+// The recorder tells the iterations apart by the goroutine running them, so the accesses of a goroutine started in the
+// body would not be recorded against the loop, and a dependence through them would be missed. Such loops are rejected
+// rather than instrumented; a goroutine started in a function the loop calls is still not followed
+func StartsGoroutines(loop Loop) bool {
+	if loop.Body == nil {
+		return false
+	}
+	found := false
+	ast.Inspect(loop.Body, func(n ast.Node) bool {
+		if _, ok := n.(*ast.GoStmt); ok {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// InstrumentAccesses writes a copy of the file to folderPath with every read and write of an addressable location,
+// and every map access, recorded before the statement that makes it, and with each candidate loop counting its
+// iterations. Every function in the file is recorded, so helpers the loops call are seen, but those in other files are not.
+// Only statements in blocks are recorded, so the conditions of if, for and switch are not, nor the operands to the
+// right of && and ||, which may not be evaluated
+// The file is rewritten as text from the original syntax tree and its type information, which the copy must match
+func InstrumentAccesses(folderPath string, fileName string, astFile *ast.File, fileSet *token.FileSet, info *types.Info, loops []Loop) error {
+	dir, err := instrumentablePackage(folderPath, fileName)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(folderPath, fileName)
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	tokenFile := fileSet.File(astFile.Pos())
+	if tokenFile == nil || tokenFile.Size() != len(src) {
+		return fmt.Errorf("%s has changed since it was parsed", fileName)
+	}
+	r := accessRecorder{src: src, fileSet: fileSet, tokenFile: tokenFile, info: info}
+	r.instrument(astFile, loops)
+
+	out := applyEdits(src, r.edits)
+	if formatted, err := format.Source(out); err == nil {
+		out = formatted
+	}
+	err = os.WriteFile(path, out, 0644)
+	if err != nil {
+		return err
+	}
+	lines := make([]int, len(loops))
+	for i, loop := range loops {
+		lines[i] = loop.Line
+	}
+	err = os.WriteFile(filepath.Join(dir, DependenceFileName), dependenceSource(astFile.Name.Name, lines), 0644)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, DependenceTestFileName), instrumentTestSource(astFile.Name.Name, "perfactorWriteDependences"), 0644)
+}
+
+// edit is text inserted into the source at an offset; edits at the same offset are applied in order of priority
+type edit struct {
+	offset   int
+	priority int
+	text     string
+}
+
+const (
+	editAccess = iota
+	editLoop
+)
+
+type accessRecorder struct {
+	src       []byte
+	fileSet   *token.FileSet
+	tokenFile *token.File
+	info      *types.Info
+	// pkg is the package of the file, and imports its imports, which the types of map keys are named with
+	pkg     *types.Package
+	imports []*ast.ImportSpec
+	edits   []edit
+}
+
+func (r *accessRecorder) offset(pos token.Pos) int {
+	return r.tokenFile.Offset(pos)
+}
+
+func (r *accessRecorder) text(n ast.Node) string {
+	return string(r.src[r.offset(n.Pos()):r.offset(n.End())])
+}
+
+func (r *accessRecorder) insert(pos token.Pos, priority int, text string) {
+	r.edits = append(r.edits, edit{offset: r.offset(pos), priority: priority, text: text})
+}
+
+// applyEdits inserts the edits into the source, in order of offset and then of priority
+func applyEdits(src []byte, edits []edit) []byte {
+	sort.SliceStable(edits, func(i, j int) bool {
+		if edits[i].offset != edits[j].offset {
+			return edits[i].offset < edits[j].offset
+		}
+		return edits[i].priority < edits[j].priority
+	})
+	var out bytes.Buffer
+	last := 0
+	for _, e := range edits {
+		out.Write(src[last:e.offset])
+		out.WriteString(e.text)
+		last = e.offset
+	}
+	out.Write(src[last:])
+	return out.Bytes()
+}
+
+func (r *accessRecorder) instrument(astFile *ast.File, loops []Loop) {
+	r.imports = astFile.Imports
+	for _, decl := range astFile.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok && r.info.Defs[fn.Name] != nil {
+			r.pkg = r.info.Defs[fn.Name].Pkg()
+			break
+		}
+	}
+	// only statements directly in a list can have others inserted before them
+	inList := make(map[ast.Stmt]bool)
+	ast.Inspect(astFile, func(n ast.Node) bool {
+		var list []ast.Stmt
+		switch n := n.(type) {
+		case *ast.BlockStmt:
+			list = n.List
+		case *ast.CaseClause:
+			list = n.Body
+		case *ast.CommClause:
+			list = n.Body
+		}
+		for _, stmt := range list {
+			inList[stmt] = true
+		}
+		return true
+	})
+
+	for _, decl := range astFile.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Body == nil {
+			continue
+		}
+		ast.Inspect(fn.Body, func(n ast.Node) bool {
+			if stmt, ok := n.(ast.Stmt); ok && inList[stmt] {
+				r.recordStatement(stmt)
+			}
+			return true
+		})
+	}
+
+	for _, loop := range loops {
+		var stmt ast.Stmt
+		switch {
+		case loop.For != nil:
+			stmt = loop.For
+		case loop.Range != nil:
+			stmt = loop.Range
+		default:
+			continue
+		}
+		call := func(name string) string {
+			return name + "(" + strconv.Itoa(loop.Line) + "); "
+		}
+		// a labelled loop is entered before its label, so that continuing it does not enter it again
+		outer := stmt
+		ast.Inspect(astFile, func(n ast.Node) bool {
+			if labelled, ok := n.(*ast.LabeledStmt); ok && labelled.Stmt == stmt {
+				outer = labelled
+			}
+			return outer == stmt
+		})
+		r.insert(outer.Pos(), editLoop, call("perfactorEnterLoop"))
+		r.insert(loop.Body.Lbrace+1, editLoop, call("perfactorIteration"))
+		r.insert(stmt.End(), editLoop, "; perfactorExitLoop("+strconv.Itoa(loop.Line)+")")
+		ast.Inspect(loop.Body, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.ReturnStmt:
+				if inList[n] {
+					r.insert(n.Pos(), editLoop, call("perfactorExitLoop"))
+				}
+			}
+			return true
+		})
+	}
+}
+
+// recordStatement inserts the record of the reads and writes a simple statement makes before it
+func (r *accessRecorder) recordStatement(stmt ast.Stmt) {
+	line := r.fileSet.Position(stmt.Pos()).Line
+	var calls []string
+	read := func(e ast.Expr) {
+		calls = append(calls, r.reads(e, line)...)
+	}
+	switch stmt := stmt.(type) {
+	case *ast.AssignStmt:
+		for _, e := range stmt.Rhs {
+			read(e)
+		}
+		for _, e := range stmt.Lhs {
+			if ident, ok := e.(*ast.Ident); ok && (ident.Name == "_" || r.info.Defs[ident] != nil) {
+				// a variable being declared cannot have its address taken before the statement
+				continue
+			}
+			if stmt.Tok != token.ASSIGN && stmt.Tok != token.DEFINE {
+				calls = append(calls, r.access(e, line, false)...)
+			}
+			calls = append(calls, r.access(e, line, true)...)
+			calls = append(calls, r.operandReads(e, line)...)
+		}
+	case *ast.IncDecStmt:
+		calls = append(calls, r.access(stmt.X, line, false)...)
+		calls = append(calls, r.access(stmt.X, line, true)...)
+		calls = append(calls, r.operandReads(stmt.X, line)...)
+	case *ast.ExprStmt:
+		read(stmt.X)
+	case *ast.SendStmt:
+		read(stmt.Chan)
+		read(stmt.Value)
+	case *ast.ReturnStmt:
+		for _, e := range stmt.Results {
+			read(e)
+		}
+	case *ast.DeclStmt:
+		if decl, ok := stmt.Decl.(*ast.GenDecl); ok && decl.Tok == token.VAR {
+			for _, spec := range decl.Specs {
+				for _, e := range spec.(*ast.ValueSpec).Values {
+					read(e)
+				}
+			}
+		}
+	}
+	if len(calls) > 0 {
+		r.insert(stmt.Pos(), editAccess, strings.Join(calls, "; ")+"; ")
+	}
+}
+
+// reads gives the records of the locations an expression reads, itself included
+func (r *accessRecorder) reads(e ast.Expr, line int) []string {
+	if e == nil {
+		return nil
+	}
+	var calls []string
+	ast.Inspect(e, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.BinaryExpr:
+			if n.Op == token.LAND || n.Op == token.LOR {
+				calls = append(calls, r.reads(n.X, line)...)
+				return false
+			}
+		case *ast.UnaryExpr:
+			if n.Op == token.AND {
+				// taking an address reads nothing but the operands of the expression
+				calls = append(calls, r.operandReads(n.X, line)...)
+				return false
+			}
+		case *ast.KeyValueExpr:
+			// the key of a struct literal is a field name
+			if tv, ok := r.info.Types[n.Key]; !ok || !tv.IsValue() {
+				calls = append(calls, r.reads(n.Value, line)...)
+				return false
+			}
+		case *ast.SelectorExpr:
+			calls = append(calls, r.access(n, line, false)...)
+			calls = append(calls, r.reads(n.X, line)...)
+			return false
+		case ast.Expr:
+			calls = append(calls, r.access(n, line, false)...)
+		}
+		return true
+	})
+	return calls
+}
+
+// operandReads gives the records of what an expression reads to find the location it names, such as the index of a[i]
+func (r *accessRecorder) operandReads(e ast.Expr, line int) []string {
+	switch e := e.(type) {
+	case *ast.ParenExpr:
+		return r.operandReads(e.X, line)
+	case *ast.IndexExpr:
+		return append(r.reads(e.X, line), r.reads(e.Index, line)...)
+	case *ast.SelectorExpr:
+		return r.reads(e.X, line)
+	case *ast.StarExpr:
+		return r.reads(e.X, line)
+	}
+	return nil
+}
+
+// access gives the record of a single access to the location an expression names, if it names one
+func (r *accessRecorder) access(e ast.Expr, line int, write bool) []string {
+	if !pure(e) {
+		return nil
+	}
+	if index, ok := e.(*ast.IndexExpr); ok {
+		if tv, ok := r.info.Types[index.X]; ok && tv.Type != nil {
+			if m, isMap := tv.Type.Underlying().(*types.Map); isMap {
+				key, ok := r.keyText(index.Index, m.Key())
+				if !ok {
+					return nil
+				}
+				return []string{fmt.Sprintf("perfactorMapAccess(%d, %s, %s, %t)", line, r.text(index.X), key, write)}
+			}
+		}
+	}
+	switch e := e.(type) {
+	case *ast.Ident:
+		if e.Name == "_" {
+			return nil
+		}
+		if _, ok := r.info.Uses[e].(*types.Var); !ok {
+			return nil
+		}
+	case *ast.SelectorExpr:
+		if selection, ok := r.info.Selections[e]; !ok || selection.Kind() != types.FieldVal {
+			return nil
+		}
+	case *ast.IndexExpr, *ast.StarExpr, *ast.ParenExpr:
+	default:
+		return nil
+	}
+	tv, ok := r.info.Types[e]
+	if !ok || !tv.Addressable() {
+		return nil
+	}
+	return []string{fmt.Sprintf("perfactorAccess(%d, &(%s), %t)", line, r.text(e), write)}
+}
+
+// keyText gives the source of a map key, converted to the key type if it is a constant, since it is compared as an
+// interface{} and an untyped constant would otherwise have its default type. It fails if the type cannot be named here
+func (r *accessRecorder) keyText(key ast.Expr, keyType types.Type) (string, bool) {
+	tv, ok := r.info.Types[key]
+	if !ok || tv.Value == nil {
+		return r.text(key), true
+	}
+	named := true
+	typeName := types.TypeString(keyType, func(pkg *types.Package) string {
+		if pkg == r.pkg {
+			return ""
+		}
+		for _, spec := range r.imports {
+			path, _ := strconv.Unquote(spec.Path.Value)
+			if path != pkg.Path() {
+				continue
+			}
+			if spec.Name != nil {
+				return spec.Name.Name
+			}
+			return pkg.Name()
+		}
+		named = false
+		return pkg.Name()
+	})
+	return "(" + typeName + ")(" + r.text(key) + ")", named
+}
+
+// pure reports whether an expression can be evaluated again for its record without doing anything more
+func pure(e ast.Expr) bool {
+	ok := true
+	ast.Inspect(e, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.CallExpr, *ast.FuncLit, *ast.CompositeLit:
+			ok = false
+		case *ast.UnaryExpr:
+			if n.Op == token.ARROW {
+				ok = false
+			}
+		}
+		return ok
+	})
+	return ok
+}
+
+// dependenceSource is the recorder, which keeps, for each candidate loop running, the iterations that last wrote and
+// read each location. Locations are words, or smaller elements on their own, so a field of a struct written whole
+// matches only if it starts on a word. What it records is kept alive until the loop ends, so no address is reused
+// The running loops are kept for each goroutine, so parallel tests and benchmarks running loops at the same time do not
+// mix their iterations. The accesses of goroutines started in the loop are not recorded against it, which is why the
+// loops that StartsGoroutines finds are not checked
+func dependenceSource(pkgName string, lines []int) []byte {
+	var src bytes.Buffer
+	src.WriteString("// Code generated by perfactor. DO NOT EDIT.\n\n")
+	src.WriteString("package " + pkgName + "\n\n")
+	src.WriteString(`import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+type perfactorConflict struct {
+	Kind            string
+	First           int
+	Second          int
+	FirstIteration  int64
+	SecondIteration int64
+	Count           int64
+}
+
+type perfactorShadow struct {
+	write, firstRead, lastRead int64
+	writeLine, readLine        int
+}
+
+type perfactorMapKey struct {
+	m uintptr
+	k interface{}
+}
+
+type perfactorLoopCheck struct {
+	Line        int
+	Invocations int64
+	Iterations  int64
+	Conflicts   []*perfactorConflict
+}
+
+// perfactorRun is one invocation of a loop, on one goroutine
+type perfactorRun struct {
+	check     *perfactorLoopCheck
+	iteration int64
+	words     map[uintptr]*perfactorShadow
+	keys      map[perfactorMapKey]*perfactorShadow
+	keep      []interface{}
+}
+
+// perfactorMaxConflicts bounds the distinct pairs of lines kept for a loop
+const perfactorMaxConflicts = 20
+
+var (
+	perfactorMu      sync.Mutex
+	perfactorRunning int32
+	// perfactorStacks are the loops running on each goroutine, by its id, innermost last
+	perfactorStacks = make(map[int64][]*perfactorRun)
+	perfactorChecks = map[int]*perfactorLoopCheck{
+`)
+	for _, line := range lines {
+		src.WriteString(fmt.Sprintf("\t\t%d: {Line: %d},\n", line, line))
+	}
+	src.WriteString(`	}
+)
+
+// perfactorGoroutine gives the id of the running goroutine, from the first line of its stack trace
+func perfactorGoroutine() int64 {
+	var buf [64]byte
+	b := buf[len("goroutine "):runtime.Stack(buf[:], false)]
+	var id int64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			break
+		}
+		id = id*10 + int64(c-'0')
+	}
+	return id
+}
+
+func perfactorEnterLoop(line int) {
+	g := perfactorGoroutine()
+	perfactorMu.Lock()
+	defer perfactorMu.Unlock()
+	l := perfactorChecks[line]
+	perfactorPop(g, l)
+	l.Invocations++
+	run := &perfactorRun{check: l, words: make(map[uintptr]*perfactorShadow), keys: make(map[perfactorMapKey]*perfactorShadow)}
+	perfactorStacks[g] = append(perfactorStacks[g], run)
+	atomic.AddInt32(&perfactorRunning, 1)
+}
+
+func perfactorIteration(line int) {
+	g := perfactorGoroutine()
+	perfactorMu.Lock()
+	defer perfactorMu.Unlock()
+	stack := perfactorStacks[g]
+	for i := len(stack) - 1; i >= 0; i-- {
+		if stack[i].check.Line == line {
+			stack[i].iteration++
+			stack[i].check.Iterations++
+			return
+		}
+	}
+}
+
+func perfactorExitLoop(line int) {
+	g := perfactorGoroutine()
+	perfactorMu.Lock()
+	defer perfactorMu.Unlock()
+	perfactorPop(g, perfactorChecks[line])
+}
+
+// perfactorPop ends the goroutine's invocation of the loop and any started inside it, which may have been left
+// without their exit being recorded
+func perfactorPop(g int64, l *perfactorLoopCheck) {
+	stack := perfactorStacks[g]
+	for i, running := range stack {
+		if running.check == l {
+			atomic.AddInt32(&perfactorRunning, -int32(len(stack)-i))
+			if i == 0 {
+				delete(perfactorStacks, g)
+			} else {
+				perfactorStacks[g] = stack[:i]
+			}
+			return
+		}
+	}
+}
+
+func perfactorAccess(line int, p interface{}, write bool) {
+	if atomic.LoadInt32(&perfactorRunning) == 0 {
+		return
+	}
+	g := perfactorGoroutine()
+	v := reflect.ValueOf(p)
+	addr, size := v.Pointer(), v.Type().Elem().Size()
+	step := size
+	if step > 8 {
+		step = 8
+	}
+	perfactorMu.Lock()
+	defer perfactorMu.Unlock()
+	for _, r := range perfactorStacks[g] {
+		if r.iteration == 0 {
+			continue
+		}
+		kept := false
+		for off := uintptr(0); off < size && off < 64*8; off += step {
+			s := r.words[addr+off]
+			if s == nil {
+				s = &perfactorShadow{}
+				r.words[addr+off] = s
+				if !kept {
+					r.keep = append(r.keep, p)
+					kept = true
+				}
+			}
+			perfactorRecord(r, s, line, write)
+		}
+	}
+}
+
+func perfactorMapAccess(line int, m interface{}, k interface{}, write bool) {
+	if atomic.LoadInt32(&perfactorRunning) == 0 {
+		return
+	}
+	g := perfactorGoroutine()
+	key := perfactorMapKey{reflect.ValueOf(m).Pointer(), k}
+	perfactorMu.Lock()
+	defer perfactorMu.Unlock()
+	for _, r := range perfactorStacks[g] {
+		if r.iteration == 0 {
+			continue
+		}
+		s := r.keys[key]
+		if s == nil {
+			s = &perfactorShadow{}
+			r.keys[key] = s
+			r.keep = append(r.keep, m)
+		}
+		perfactorRecord(r, s, line, write)
+	}
+}
+
+func perfactorRecord(r *perfactorRun, s *perfactorShadow, line int, write bool) {
+	l, it := r.check, r.iteration
+	if s.write != 0 && s.write != it {
+		kind := "write-read"
+		if write {
+			kind = "write-write"
+		}
+		perfactorConflictSeen(l, kind, s.writeLine, line, s.write, it)
+	}
+	if write {
+		if s.firstRead != 0 && (s.firstRead != it || s.lastRead != it) {
+			read := s.firstRead
+			if read == it {
+				read = s.lastRead
+			}
+			perfactorConflictSeen(l, "read-write", s.readLine, line, read, it)
+		}
+		s.write, s.writeLine = it, line
+		return
+	}
+	if s.firstRead == 0 {
+		s.firstRead = it
+	}
+	s.lastRead, s.readLine = it, line
+}
+
+func perfactorConflictSeen(l *perfactorLoopCheck, kind string, first int, second int, firstIteration int64, secondIteration int64) {
+	for _, c := range l.Conflicts {
+		if c.Kind == kind && c.First == first && c.Second == second {
+			c.Count++
+			return
+		}
+	}
+	if len(l.Conflicts) < perfactorMaxConflicts {
+		l.Conflicts = append(l.Conflicts, &perfactorConflict{kind, first, second, firstIteration, secondIteration, 1})
+	}
+}
+
+func perfactorWriteDependences() {
+	perfactorMu.Lock()
+	defer perfactorMu.Unlock()
+	data, err := json.Marshal(perfactorChecks)
+	if err == nil {
+		_ = os.WriteFile("` + DependencesFileName + `", data, 0644)
+	}
+}
+`)
+	return src.Bytes()
+}
+
+// RunDependenceCheck runs the tests matching testName, and each benchmark once, in the instrumented copy in folderPath,
+// and reads what the recorder found, by the line of the loop
+func RunDependenceCheck(ctx context.Context, timeout time.Duration, flags string, folderPath string, testName string, benchName string) (map[int]DependenceReport, TestResult) {
+	dir, err := workingDir(folderPath)
+	if err != nil {
+		return nil, TestResult{Err: err}
+	}
+	_ = os.Remove(filepath.Join(dir, DependencesFileName))
+	args := []string{"test"}
+	args = append(args, strings.Fields(flags)...)
+	args = append(args, "-json", "-run="+testName, "-bench="+benchName, "-benchtime=1x", "-count=1")
+	output, err := RunCommand(ctx, timeout, dir, "go", args...)
+	result := toTestResult(output, err)
+	if !result.Ok() {
+		return nil, result
+	}
+	data, err := os.ReadFile(filepath.Join(dir, DependencesFileName))
+	if err != nil {
+		result.Err = fmt.Errorf("the dependences were not written: %w", err)
+		return nil, result
+	}
+	var reports map[int]DependenceReport
+	err = json.Unmarshal(data, &reports)
+	if err != nil {
+		result.Err = fmt.Errorf("could not read the dependences: %w", err)
+		return nil, result
+	}
+	for line, report := range reports {
+		sort.SliceStable(report.Conflicts, func(i, j int) bool {
+			return report.Conflicts[i].Count > report.Conflicts[j].Count
+		})
+		reports[line] = report
+	}
+	return reports, result
+}
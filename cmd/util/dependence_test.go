@@ -0,0 +1,172 @@
+package util
+
+import (
+	"context"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const dependenceProject = `package dep
+
+func apply(a []int, hook func()) {
+	for i := range a {
+		v := a[i]
+		hook()
+		a[i] = v + 1
+	}
+}
+
+func prefixSum(a []int) {
+	for i := 1; i < len(a); i++ {
+		a[i] += a[i-1]
+	}
+}
+
+func count(words []string) map[string]int {
+	counts := make(map[string]int)
+	for _, w := range words {
+		counts[w]++
+	}
+	return counts
+}
+`
+
+// The two goroutines run the loop at line 4 in strict turns, so that each reads its element before the other starts
+// an iteration and writes it after, which a recorder shared between goroutines takes for a dependence
+const dependenceProjectTest = `package dep
+
+import "testing"
+
+func TestInterleaved(t *testing.T) {
+	g1, g2, done := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	go func() {
+		<-g2
+		apply(make([]int, 10), func() { g1 <- struct{}{}; <-g2 })
+		close(done)
+	}()
+	apply(make([]int, 10), func() { g2 <- struct{}{}; <-g1 })
+	g2 <- struct{}{}
+	<-done
+}
+
+func TestPrefixSum(t *testing.T) {
+	t.Parallel()
+	prefixSum(make([]int, 10))
+}
+
+func TestCount(t *testing.T) {
+	t.Parallel()
+	count([]string{"a", "b", "a"})
+}
+`
+
+func TestDependenceCheck(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs go test on an instrumented project")
+	}
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod":      "module dep\n\ngo 1.19\n",
+		"dep.go":      dependenceProject,
+		"dep_test.go": dependenceProjectTest,
+	}
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fileSet := token.NewFileSet()
+	astFile, err := parser.ParseFile(fileSet, filepath.Join(dir, "dep.go"), dependenceProject, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &types.Info{Types: map[ast.Expr]types.TypeAndValue{}, Defs: map[*ast.Ident]types.Object{}, Uses: map[*ast.Ident]types.Object{}}
+	if _, err := (&types.Config{}).Check("dep", fileSet, []*ast.File{astFile}, info); err != nil {
+		t.Fatal(err)
+	}
+	loops := FindForLoopsInAST(astFile, fileSet, nil)
+	if len(loops) != 3 {
+		t.Fatalf("found %d loops, want 3", len(loops))
+	}
+	if err := InstrumentAccesses(dir, "dep.go", astFile, fileSet, info, loops); err != nil {
+		t.Fatal(err)
+	}
+	reports, result := RunDependenceCheck(context.Background(), 2*time.Minute, "", dir, "Test", "NONE")
+	if !result.Ok() {
+		t.Fatalf("instrumented tests failed: %s\n%s", result.FailureSummary(), result.Output)
+	}
+
+	tests := []struct {
+		name        string
+		line        int
+		invocations int64
+		iterations  int64
+		kind        string
+	}{
+		{"loops on two goroutines", 4, 2, 20, ""},
+		{"prefix sum", 12, 1, 9, "write-read"},
+		{"counting into a map", 19, 1, 3, "write-read"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := reports[tt.line]
+			if report.Invocations != tt.invocations || report.Iterations != tt.iterations {
+				t.Errorf("ran %d invocations of %d iterations, want %d of %d", report.Invocations, report.Iterations, tt.invocations, tt.iterations)
+			}
+			if tt.kind == "" {
+				if len(report.Conflicts) != 0 {
+					t.Errorf("got dependences %v, want none", report.Conflicts)
+				}
+				return
+			}
+			if len(report.Conflicts) == 0 {
+				t.Fatalf("got no dependence, want a %s one", tt.kind)
+			}
+			if report.Conflicts[0].Kind != tt.kind {
+				t.Errorf("got a %s dependence, want %s", report.Conflicts[0].Kind, tt.kind)
+			}
+		})
+	}
+}
+
+func TestStartsGoroutines(t *testing.T) {
+	src := `package p
+
+func f(a []int, done chan bool) {
+	for i := range a {
+		a[i]++
+	}
+	for i := range a {
+		go func() { done <- true }()
+		_ = i
+	}
+	for i := range a {
+		func() {
+			go close(done)
+		}()
+		_ = i
+	}
+}
+`
+	fileSet := token.NewFileSet()
+	astFile, err := parser.ParseFile(fileSet, "p.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]bool{4: false, 7: true, 11: true}
+	loops := FindForLoopsInAST(astFile, fileSet, nil)
+	if len(loops) != len(want) {
+		t.Fatalf("found %d loops, want %d", len(loops), len(want))
+	}
+	for _, loop := range loops {
+		if got := StartsGoroutines(loop); got != want[loop.Line] {
+			t.Errorf("StartsGoroutines() of the loop at line %d = %v, want %v", loop.Line, got, want[loop.Line])
+		}
+	}
+}
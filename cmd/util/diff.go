@@ -0,0 +1,186 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change, as diff -u does
+const diffContext = 3
+
+// diffOp is one line of a line diff: kept (' '), removed from the old text ('-') or added in the new text ('+')
+// oldIndex and newIndex are where the line is, or would go, in each text, counting from 0
+type diffOp struct {
+	kind     byte
+	oldIndex int
+	newIndex int
+	text     string
+}
+
+// splitLines splits a text into lines that keep their newline, so a missing final newline can be told apart
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines finds a shortest edit from a to b, through the longest common subsequence of their lines
+// The common start and end are taken off first, so the table is only as big as the changed middle
+func diffLines(a []string, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+
+	// lcs[i][j] is the length of the longest common subsequence of midA[i:] and midB[j:]
+	lcs := make([][]int32, len(midA)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(midB)+1)
+	}
+	for i := len(midA) - 1; i >= 0; i-- {
+		for j := len(midB) - 1; j >= 0; j-- {
+			if midA[i] == midB[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b)-prefix-suffix)
+	for i := 0; i < prefix; i++ {
+		ops = append(ops, diffOp{kind: ' ', oldIndex: i, newIndex: i, text: a[i]})
+	}
+	i, j := 0, 0
+	for i < len(midA) || j < len(midB) {
+		switch {
+		case i < len(midA) && j < len(midB) && midA[i] == midB[j]:
+			ops = append(ops, diffOp{kind: ' ', oldIndex: prefix + i, newIndex: prefix + j, text: midA[i]})
+			i++
+			j++
+		case j == len(midB) || (i < len(midA) && lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, diffOp{kind: '-', oldIndex: prefix + i, newIndex: prefix + j, text: midA[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{kind: '+', oldIndex: prefix + i, newIndex: prefix + j, text: midB[j]})
+			j++
+		}
+	}
+	for k := 0; k < suffix; k++ {
+		ops = append(ops, diffOp{kind: ' ', oldIndex: len(a) - suffix + k, newIndex: len(b) - suffix + k, text: a[len(a)-suffix+k]})
+	}
+	return ops
+}
+
+// diffHunk is a run of ops with at most diffContext unchanged lines on either side of its changes
+type diffHunk struct {
+	ops []diffOp
+}
+
+// hunks groups the changes in ops, merging those whose context would overlap
+func hunks(ops []diffOp) []diffHunk {
+	var result []diffHunk
+	start, end := -1, -1
+	for k, op := range ops {
+		if op.kind == ' ' {
+			continue
+		}
+		from := k - diffContext
+		if from < 0 {
+			from = 0
+		}
+		to := k + diffContext + 1
+		if to > len(ops) {
+			to = len(ops)
+		}
+		if start != -1 && from <= end {
+			end = to
+			continue
+		}
+		if start != -1 {
+			result = append(result, diffHunk{ops: ops[start:end]})
+		}
+		start, end = from, to
+	}
+	if start != -1 {
+		result = append(result, diffHunk{ops: ops[start:end]})
+	}
+	return result
+}
+
+// header gives the @@ line of the hunk, with line numbers counted from 1, and the section text after it if any
+// A side with no lines is numbered by the line before it, as diff -u does
+func (h diffHunk) header(section func(oldStart int, oldEnd int) string) string {
+	oldCount, newCount := 0, 0
+	for _, op := range h.ops {
+		if op.kind != '+' {
+			oldCount++
+		}
+		if op.kind != '-' {
+			newCount++
+		}
+	}
+	oldStart, newStart := h.ops[0].oldIndex+1, h.ops[0].newIndex+1
+	if oldCount == 0 {
+		oldStart--
+	}
+	if newCount == 0 {
+		newStart--
+	}
+	header := fmt.Sprintf("@@ -%s +%s @@", hunkRange(oldStart, oldCount), hunkRange(newStart, newCount))
+	if section != nil {
+		if text := section(h.ops[0].oldIndex+1, h.ops[0].oldIndex+oldCount); text != "" {
+			header += " " + text
+		}
+	}
+	return header
+}
+
+func hunkRange(start int, count int) string {
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+func (h diffHunk) write(sb *strings.Builder) {
+	for _, op := range h.ops {
+		sb.WriteByte(op.kind)
+		sb.WriteString(op.text)
+		if !strings.HasSuffix(op.text, "\n") {
+			sb.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// UnifiedDiff compares two versions of a file, and returns the changes in the unified format of diff -u and git diff
+// It returns an empty string if the texts are the same
+func UnifiedDiff(oldName string, newName string, oldText string, newText string) string {
+	return UnifiedDiffWithSections(oldName, newName, oldText, newText, nil)
+}
+
+// UnifiedDiffWithSections is UnifiedDiff with a section text after each hunk's @@ line, where diff -p puts the function
+// section is given the first and last lines of the old text the hunk covers, counting from 1, and may return ""
+// Patch tools ignore the section text, so the diff still applies
+func UnifiedDiffWithSections(oldName string, newName string, oldText string, newText string, section func(oldStart int, oldEnd int) string) string {
+	if oldText == newText {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("--- " + oldName + "\n")
+	sb.WriteString("+++ " + newName + "\n")
+	for _, h := range hunks(diffLines(splitLines(oldText), splitLines(newText))) {
+		sb.WriteString(h.header(section) + "\n")
+		h.write(&sb)
+	}
+	return sb.String()
+}
@@ -0,0 +1,83 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"time"
+)
+
+// FailureTimeout is the failure category given to runs that were killed because they did not finish in time
+// With goroutine rewrites this is almost always a deadlock
+const FailureTimeout = "timeout/deadlock"
+
+// ErrTimeout is returned by RunCommand when the command was killed after running past its timeout
+var ErrTimeout = errors.New(FailureTimeout)
+
+// how long the process group gets to shut down after an interrupt before it is killed
+const killGracePeriod = 3 * time.Second
+
+// RunCommand runs an external command in dir and returns its combined output
+// The command is started in its own process group. If ctx is cancelled, or timeout (when non-zero) expires,
+// the whole group is interrupted and then killed, so no test binaries are left behind
+func RunCommand(ctx context.Context, timeout time.Duration, dir string, name string, args ...string) ([]byte, error) {
+	var buf bytes.Buffer
+	err := runCommand(ctx, timeout, dir, &buf, &buf, name, args...)
+	return buf.Bytes(), err
+}
+
+// RunCommandWriting is RunCommand for output too large to hold: the standard output is written to stdout as it comes,
+// and only the standard error is returned
+func RunCommandWriting(ctx context.Context, timeout time.Duration, dir string, stdout io.Writer, name string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	err := runCommand(ctx, timeout, dir, stdout, &stderr, name, args...)
+	return stderr.Bytes(), err
+}
+
+func runCommand(ctx context.Context, timeout time.Duration, dir string, stdout io.Writer, stderr io.Writer, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	setProcessGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		stopProcessGroup(cmd, done)
+		return ctx.Err()
+	case <-deadline:
+		stopProcessGroup(cmd, done)
+		return ErrTimeout
+	}
+}
+
+// stopProcessGroup interrupts the process group, giving the go command a chance to clean up its work directory,
+// and kills it if it has not exited after the grace period
+func stopProcessGroup(cmd *exec.Cmd, done chan error) {
+	interruptProcessGroup(cmd)
+	select {
+	case <-done:
+	case <-time.After(killGracePeriod):
+		killProcessGroup(cmd)
+		<-done
+	}
+}
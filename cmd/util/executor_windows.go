@@ -0,0 +1,22 @@
+//go:build windows
+
+package util
+
+import (
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// windows has no way of interrupting a process group from here, so both of these kill the process tree
+func interruptProcessGroup(cmd *exec.Cmd) {
+	killProcessGroup(cmd)
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	_ = exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run()
+}
@@ -0,0 +1,141 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/tools/imports"
+)
+
+// HarnessFileName is the test file the generated benchmarks are written to
+const HarnessFileName = "perfactor_bench_test.go"
+
+// BenchmarkTarget is something to generate a benchmark for: either main, run with Args as its command line,
+// or Call, a call expression such as "Sum([]int{1, 2, 3})" using the package's own functions
+type BenchmarkTarget struct {
+	Main bool
+	Args []string
+	Call string
+}
+
+// name gives the function name the benchmark is built from
+func (t BenchmarkTarget) name() (string, error) {
+	if t.Main {
+		return "main", nil
+	}
+	expr, err := parser.ParseExpr(t.Call)
+	if err != nil {
+		return "", fmt.Errorf("could not parse %q: %w", t.Call, err)
+	}
+	call, ok := expr.(*ast.CallExpr)
+	if !ok {
+		return "", fmt.Errorf("%q is not a function call", t.Call)
+	}
+	ident, ok := call.Fun.(*ast.Ident)
+	if !ok {
+		return "", fmt.Errorf("%q does not call a function of the package", t.Call)
+	}
+	return ident.Name, nil
+}
+
+// GenerateBenchmarkHarness writes the source of a test file in package pkgName with one benchmark per target
+// The imports the inputs need are added, as far as goimports can find them
+func GenerateBenchmarkHarness(pkgName string, targets []BenchmarkTarget) ([]byte, error) {
+	if len(targets) == 0 {
+		return nil, errors.New("nothing to benchmark")
+	}
+	var src bytes.Buffer
+	src.WriteString("// Code generated by perfactor genbench. DO NOT EDIT.\n\n")
+	src.WriteString("package " + pkgName + "\n\n")
+	src.WriteString("import \"testing\"\n")
+
+	used := make(map[string]int)
+	for _, target := range targets {
+		name, err := target.name()
+		if err != nil {
+			return nil, err
+		}
+		if target.Main && pkgName != "main" {
+			return nil, fmt.Errorf("package %s has no main function to benchmark", pkgName)
+		}
+		first, size := utf8.DecodeRuneInString(name)
+		benchName := "BenchmarkPerfactor" + string(unicode.ToUpper(first)) + name[size:]
+		used[benchName]++
+		if used[benchName] > 1 {
+			benchName += strconv.Itoa(used[benchName])
+		}
+
+		src.WriteString("\nfunc " + benchName + "(b *testing.B) {\n")
+		if target.Main {
+			// main reads os.Args and may parse flags, and its output would drown the benchmark results
+			quoted := make([]string, len(target.Args))
+			for i, arg := range target.Args {
+				quoted[i] = strconv.Quote(arg)
+			}
+			src.WriteString("\targs, stdout, commandLine := os.Args, os.Stdout, flag.CommandLine\n")
+			src.WriteString("\tdefer func() { os.Args, os.Stdout, flag.CommandLine = args, stdout, commandLine }()\n")
+			src.WriteString("\tif devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {\n")
+			src.WriteString("\t\tdefer devNull.Close()\n")
+			src.WriteString("\t\tos.Stdout = devNull\n")
+			src.WriteString("\t}\n")
+			src.WriteString("\tb.ResetTimer()\n")
+			src.WriteString("\tfor i := 0; i < b.N; i++ {\n")
+			// a main that defines flags panics when they are defined again, so each call gets a fresh flag set
+			src.WriteString("\t\tos.Args = []string{args[0]" + strings.Join(append([]string{""}, quoted...), ", ") + "}\n")
+			src.WriteString("\t\tflag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)\n")
+			src.WriteString("\t\tmain()\n\t}\n")
+		} else {
+			src.WriteString("\tfor i := 0; i < b.N; i++ {\n\t\t" + target.Call + "\n\t}\n")
+		}
+		src.WriteString("}\n")
+	}
+
+	out, err := imports.Process(HarnessFileName, src.Bytes(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("generated benchmarks are not valid Go: %w", err)
+	}
+	return out, nil
+}
+
+// WriteBenchmarkHarness generates the benchmarks for the package in folderPath, and writes them there as HarnessFileName
+// It is only meant for a workspace copy, never the user's project, and returns the path of the file it wrote
+func WriteBenchmarkHarness(folderPath string, targets []BenchmarkTarget) (string, error) {
+	pkgName, err := packageNameInDir(folderPath)
+	if err != nil {
+		return "", err
+	}
+	src, err := GenerateBenchmarkHarness(pkgName, targets)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(folderPath, HarnessFileName)
+	err = os.WriteFile(path, src, 0644)
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// packageNameInDir finds the name of the package in a folder, ignoring external test packages
+func packageNameInDir(folderPath string) (string, error) {
+	pkgs, err := parser.ParseDir(token.NewFileSet(), folderPath, nil, parser.PackageClauseOnly)
+	if err != nil {
+		return "", err
+	}
+	for name := range pkgs {
+		if !strings.HasSuffix(name, "_test") {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no Go package in %s", folderPath)
+}
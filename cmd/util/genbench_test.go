@@ -0,0 +1,112 @@
+package util
+
+import (
+	"context"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateBenchmarkHarness(t *testing.T) {
+	tests := []struct {
+		name    string
+		pkgName string
+		targets []BenchmarkTarget
+		want    []string
+		err     string
+	}{
+		{"call", "sum", []BenchmarkTarget{{Call: "Sum([]int{1, 2, 3})"}},
+			[]string{"func BenchmarkPerfactorSum(b *testing.B) {\n\tfor i := 0; i < b.N; i++ {\n\t\tSum([]int{1, 2, 3})\n\t}\n}"}, ""},
+		{"calls of the same function", "sum", []BenchmarkTarget{{Call: "Sum(nil)"}, {Call: "Sum([]int{1})"}},
+			[]string{"func BenchmarkPerfactorSum(b", "func BenchmarkPerfactorSum2(b"}, ""},
+		{"imports of the inputs", "words", []BenchmarkTarget{{Call: "count(strings.Repeat(\"a \", 100))"}},
+			[]string{"\t\"strings\"\n", "func BenchmarkPerfactorCount(b"}, ""},
+		{"main with arguments", "main", []BenchmarkTarget{{Main: true, Args: []string{"-n", "a b"}}},
+			[]string{"\t\"flag\"\n\t\"os\"\n", "os.Args = []string{args[0], \"-n\", \"a b\"}", "func BenchmarkPerfactorMain(b",
+				"\t\tflag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)\n\t\tmain()\n"}, ""},
+		{"main without arguments", "main", []BenchmarkTarget{{Main: true}},
+			[]string{"os.Args = []string{args[0]}"}, ""},
+		{"name starting with a non-ASCII letter", "p", []BenchmarkTarget{{Call: "ähnlich(1)"}},
+			[]string{"func BenchmarkPerfactorÄhnlich(b"}, ""},
+		{"main of a library", "sum", []BenchmarkTarget{{Main: true}}, nil, "no main function"},
+		{"method call", "sum", []BenchmarkTarget{{Call: "s.Sum()"}}, nil, "does not call a function of the package"},
+		{"not a call", "sum", []BenchmarkTarget{{Call: "Sum"}}, nil, "is not a function call"},
+		{"not an expression", "sum", []BenchmarkTarget{{Call: "Sum("}}, nil, "could not parse"},
+		{"nothing", "sum", nil, nil, "nothing to benchmark"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, err := GenerateBenchmarkHarness(tt.pkgName, tt.targets)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			file, err := parser.ParseFile(token.NewFileSet(), HarnessFileName, src, 0)
+			if err != nil {
+				t.Fatalf("the harness does not parse: %s\n%s", err, src)
+			}
+			if file.Name.Name != tt.pkgName {
+				t.Errorf("the harness is in package %s, want %s", file.Name.Name, tt.pkgName)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(string(src), want) {
+					t.Errorf("the harness does not have %q:\n%s", want, src)
+				}
+			}
+		})
+	}
+}
+
+// flagMain defines its flags in main, as most commands do, which panics if they are defined twice on one flag set
+const flagMain = `package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+func main() {
+	n := flag.Int("n", 1, "the number to print")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		panic(fmt.Sprintf("got arguments %v", flag.Args()))
+	}
+	fmt.Println(*n, flag.Arg(0))
+}
+`
+
+func TestGeneratedMainBenchmarkRuns(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs go test on a generated benchmark")
+	}
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod":  "module example.com/cmd\n\ngo 1.19\n",
+		"main.go": flagMain,
+	}
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	harness, err := WriteBenchmarkHarness(dir, []BenchmarkTarget{{Main: true, Args: []string{"-n", "3", "word"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := RunCodeContext(context.Background(), 2*time.Minute, "-benchtime=3x", "^BenchmarkPerfactor", "NONE", "genbench", harness, dir+string(os.PathSeparator), false, 1)
+	if !result.Ok() {
+		t.Fatalf("the generated benchmark failed: %s\n%s", result.FailureSummary(), result.Output)
+	}
+	if !strings.Contains(result.Output, "BenchmarkPerfactorMain") {
+		t.Errorf("the benchmark did not run:\n%s", result.Output)
+	}
+}
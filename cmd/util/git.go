@@ -0,0 +1,56 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// gitTimeout is how long a git command may take, which is only long for a repository on a slow disk
+const gitTimeout = time.Minute
+
+// git runs git in dir, and returns its output without the trailing newline, or its output as the error
+func git(ctx context.Context, dir string, args ...string) (string, error) {
+	output, err := RunCommand(ctx, gitTimeout, dir, "git", args...)
+	if err != nil {
+		if text := strings.TrimSpace(string(output)); text != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], text)
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return strings.TrimRight(string(output), "\n"), nil
+}
+
+// GitDirtyFiles gives the tracked files of the repository in dir that have uncommitted changes, as git status lists them
+// It fails if dir is not in a git repository
+func GitDirtyFiles(ctx context.Context, dir string) ([]string, error) {
+	status, err := git(ctx, dir, "status", "--porcelain", "--untracked-files=no")
+	if err != nil {
+		return nil, err
+	}
+	if status == "" {
+		return nil, nil
+	}
+	return strings.Split(status, "\n"), nil
+}
+
+// GitCreateBranch creates a branch at the current commit of the repository in dir, and checks it out
+func GitCreateBranch(ctx context.Context, dir string, name string) error {
+	_, err := git(ctx, dir, "checkout", "-b", name)
+	return err
+}
+
+// GitCommitFile commits the file, relative to dir, with the message, and gives the short hash of the commit
+// Only that file is committed, whatever else is staged
+func GitCommitFile(ctx context.Context, dir string, file string, message string) (string, error) {
+	_, err := git(ctx, dir, "add", "--", file)
+	if err != nil {
+		return "", err
+	}
+	_, err = git(ctx, dir, "commit", "--quiet", "-m", message, "--", file)
+	if err != nil {
+		return "", err
+	}
+	return git(ctx, dir, "rev-parse", "--short", "HEAD")
+}
@@ -0,0 +1,260 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"perfactor/graph"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GraphExport is the profile graph, with the loops of a file placed on it, in a form other tools can read
+type GraphExport struct {
+	// File is the path within the module of the file whose loops are annotated
+	File string
+	// Total is the length of time the profile covers, which the shares are of
+	Total int64
+	Nodes []ExportNode
+	Edges []ExportEdge
+	Loops []ExportLoop
+}
+
+// ExportNode is a line of a function in the profile
+type ExportNode struct {
+	Id   int
+	Name string
+	File string
+	Line int
+	Flat int64
+	Cum  int64
+	// Loops are the Ids of the loops the line is in, outermost first
+	Loops []int `json:",omitempty"`
+}
+
+// ExportEdge is a call, or an inlined call, from one node to another
+type ExportEdge struct {
+	From     int
+	To       int
+	Weight   int64
+	Inline   bool `json:",omitempty"`
+	Residual bool `json:",omitempty"`
+}
+
+// ExportLoop is a loop of the file, with why it ranked where it did
+type ExportLoop struct {
+	Id      int
+	Line    int
+	EndLine int
+	Func    string
+	// Time is the CPU time of the samples in the loop, and Share that time as a percentage of the profile's Total
+	Time  int64
+	Share float64
+	// Rank is the loop's place by Time, from 1, or 0 if it has no samples
+	Rank  int
+	Match string
+	// Candidate is set if the loop's share is over the threshold, so it would be tried if it is safe
+	Candidate bool
+	// Verdict is what became of the loop in a recorded session, if one is given
+	Verdict string `json:",omitempty"`
+}
+
+// ExportGraph builds the export of the graph, keeping the maxNodes nodes with the most cumulative time and every node in a loop
+// A maxNodes of 0 keeps every node. verdicts maps the first line of a loop to its verdict, and may be nil
+func ExportGraph(gr *graph.Graph, total int64, file graph.File, loops LoopInfoArray, maxNodes int, thresholdNanos int64, verdicts map[int]string) GraphExport {
+	export := GraphExport{File: file.Path, Total: total}
+
+	byTime := make(LoopInfoArray, len(loops))
+	copy(byTime, loops)
+	sort.Stable(byTime)
+	rank := make(map[int]int, len(byTime))
+	for i, l := range byTime {
+		if l.Time > 0 {
+			rank[l.Loop.Line] = i + 1
+		}
+	}
+	// outermost first, so a node lists the loops it is in from the outside in
+	loops = append(LoopInfoArray(nil), loops...)
+	sort.SliceStable(loops, func(i, j int) bool {
+		return loops[i].Loop.Line < loops[j].Loop.Line
+	})
+	for i, l := range loops {
+		loop := ExportLoop{
+			Id:        i,
+			Line:      l.Loop.Line,
+			EndLine:   l.Loop.EndLine,
+			Func:      l.Loop.Func,
+			Time:      l.Time,
+			Rank:      rank[l.Loop.Line],
+			Match:     l.Match.String(),
+			Candidate: l.Time > 0 && l.Time >= thresholdNanos,
+			Verdict:   verdicts[l.Loop.Line],
+		}
+		if total > 0 {
+			loop.Share = float64(l.Time) / float64(total) * 100
+		}
+		export.Loops = append(export.Loops, loop)
+	}
+
+	// the graph's nodes are already sorted by cumulative time
+	ids := make(map[*graph.Node]int)
+	for _, n := range gr.Nodes {
+		var in []int
+		if graph.IsFile(n.Info.File, n.Info.Name, file) {
+			for i, l := range loops {
+				if n.Info.Lineno >= l.Loop.Line && n.Info.Lineno <= l.Loop.EndLine && inFunction(n.Info.Name, l.Loop.Func) {
+					in = append(in, i)
+				}
+			}
+		}
+		if maxNodes > 0 && len(ids) >= maxNodes && len(in) == 0 {
+			continue
+		}
+		ids[n] = len(export.Nodes)
+		export.Nodes = append(export.Nodes, ExportNode{Id: len(export.Nodes), Name: n.Info.Name, File: n.Info.File, Line: n.Info.Lineno, Flat: n.Flat, Cum: n.Cum, Loops: in})
+	}
+	for _, n := range gr.Nodes {
+		from, ok := ids[n]
+		if !ok {
+			continue
+		}
+		for dest, e := range n.Out {
+			if to, ok := ids[dest]; ok {
+				export.Edges = append(export.Edges, ExportEdge{From: from, To: to, Weight: e.Weight, Inline: e.Inline, Residual: e.Residual})
+			}
+		}
+	}
+	// the edges come out of maps, so they are sorted to make the export the same for the same profile
+	sort.Slice(export.Edges, func(i, j int) bool {
+		if export.Edges[i].From != export.Edges[j].From {
+			return export.Edges[i].From < export.Edges[j].From
+		}
+		return export.Edges[i].To < export.Edges[j].To
+	})
+	return export
+}
+
+// WriteJSON writes the export as indented JSON
+func (g GraphExport) WriteJSON(out io.Writer) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(g)
+}
+
+// WriteDOT writes the export as a Graphviz digraph, in the style of pprof's: the hotter a node, the bigger and redder it is
+// Each loop is a cluster around its nodes, coloured by its verdict, or by whether it is a candidate if there is none
+func (g GraphExport) WriteDOT(out io.Writer) error {
+	var b strings.Builder
+	b.WriteString("digraph perfactor {\n")
+	b.WriteString("  node [shape=box style=filled fontname=\"Helvetica\"];\n")
+	_, _ = fmt.Fprintf(&b, "  label=%s;\n", strconv.Quote(fmt.Sprintf("%s, %s total", g.File, time.Duration(g.Total))))
+
+	var maxFlat int64 = 1
+	for _, n := range g.Nodes {
+		if n.Flat > maxFlat {
+			maxFlat = n.Flat
+		}
+	}
+	// nodes go in the cluster of their innermost loop, and the clusters of nested loops inside each other
+	innermost := make(map[int][]ExportNode)
+	for _, n := range g.Nodes {
+		loop := -1
+		if len(n.Loops) > 0 {
+			loop = n.Loops[len(n.Loops)-1]
+		}
+		innermost[loop] = append(innermost[loop], n)
+	}
+	for _, n := range innermost[-1] {
+		g.writeDOTNode(&b, n, maxFlat, "  ")
+	}
+	for i, l := range g.Loops {
+		if g.parentLoop(i) == -1 {
+			g.writeDOTLoop(&b, l, innermost, maxFlat, "  ")
+		}
+	}
+	for _, e := range g.Edges {
+		attrs := fmt.Sprintf("label=%s", strconv.Quote(time.Duration(e.Weight).String()))
+		if e.Inline {
+			attrs += " style=dashed"
+		}
+		if e.Residual {
+			attrs += " style=dotted"
+		}
+		_, _ = fmt.Fprintf(&b, "  N%d -> N%d [%s];\n", e.From, e.To, attrs)
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(out, b.String())
+	return err
+}
+
+func (g GraphExport) writeDOTLoop(b *strings.Builder, l ExportLoop, innermost map[int][]ExportNode, maxFlat int64, indent string) {
+	label := fmt.Sprintf("loop %d-%d in %s\n%s (%.1f%%)", l.Line, l.EndLine, l.Func, time.Duration(l.Time), l.Share)
+	if l.Rank > 0 {
+		label += fmt.Sprintf(", rank %d", l.Rank)
+	}
+	if l.Verdict != "" {
+		label += "\n" + l.Verdict
+	} else if l.Match != LoopSampled.String() {
+		label += "\n" + l.Match
+	}
+	_, _ = fmt.Fprintf(b, "%ssubgraph cluster_loop%d {\n", indent, l.Id)
+	_, _ = fmt.Fprintf(b, "%s  label=%s;\n%s  color=%s;\n", indent, strconv.Quote(label), indent, loopColour(l))
+	for _, n := range innermost[l.Id] {
+		g.writeDOTNode(b, n, maxFlat, indent+"  ")
+	}
+	for i, inner := range g.Loops {
+		if g.parentLoop(i) == l.Id {
+			g.writeDOTLoop(b, inner, innermost, maxFlat, indent+"  ")
+		}
+	}
+	_, _ = fmt.Fprintf(b, "%s}\n", indent)
+}
+
+func (g GraphExport) writeDOTNode(b *strings.Builder, n ExportNode, maxFlat int64, indent string) {
+	label := fmt.Sprintf("%s\n%s:%d\nflat %s\ncum %s", n.Name, shortFile(n.File), n.Line, time.Duration(n.Flat), time.Duration(n.Cum))
+	// between 8 and 24 points, and from white to red, by flat time
+	heat := float64(n.Flat) / float64(maxFlat)
+	if heat < 0 {
+		heat = 0
+	}
+	fill := fmt.Sprintf("#ff%02x%02x", 255-int(heat*200), 255-int(heat*200))
+	_, _ = fmt.Fprintf(b, "%sN%d [label=%s fontsize=%d fillcolor=%s];\n", indent, n.Id, strconv.Quote(label), 8+int(heat*16), strconv.Quote(fill))
+}
+
+// parentLoop gives the Id of the innermost loop that loop i is nested in, or -1 if it is not nested
+func (g GraphExport) parentLoop(i int) int {
+	parent := -1
+	l := g.Loops[i]
+	for j, outer := range g.Loops {
+		if j == i || outer.Func != l.Func || outer.Line > l.Line || outer.EndLine < l.EndLine {
+			continue
+		}
+		if parent == -1 || outer.Line >= g.Loops[parent].Line {
+			parent = j
+		}
+	}
+	return parent
+}
+
+func loopColour(l ExportLoop) string {
+	switch {
+	case l.Verdict == "accepted":
+		return "darkgreen"
+	case l.Verdict != "":
+		return "red"
+	case l.Candidate:
+		return "orange"
+	}
+	return "grey"
+}
+
+// shortFile keeps the last two elements of a path, which is enough to tell the files of a module apart in a label
+func shortFile(path string) string {
+	parts := strings.Split(strings.ReplaceAll(path, "\\", "/"), "/")
+	if len(parts) > 2 {
+		parts = parts[len(parts)-2:]
+	}
+	return strings.Join(parts, "/")
+}
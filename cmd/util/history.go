@@ -0,0 +1,178 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HistoryFileName is the file in the output folder that every session is recorded in
+const HistoryFileName = "history.json"
+
+// Session is the record of one run of perfactor
+type Session struct {
+	Id      string
+	Start   time.Time
+	End     time.Time
+	Project string
+	// Settings are the program settings of the run, as they were given
+	Settings    json.RawMessage
+	Environment Environment
+	Metrics     SessionMetrics
+	Outcomes    []LoopOutcome
+	// Diffs maps each changed file to a unified diff of the change
+	Diffs map[string]string
+	// Interrupted is set if the run was stopped before it got through every file
+	Interrupted bool
+}
+
+// SessionMetrics are the baseline and final measurements of a session, where it took any
+type SessionMetrics struct {
+	OriginalRuntime time.Duration
+	BestRuntime     time.Duration
+	OriginalNsPerOp float64 `json:",omitempty"`
+	BestNsPerOp     float64 `json:",omitempty"`
+}
+
+// Speedup is how many times faster the result is than the original, or 0 if nothing was measured
+func (m SessionMetrics) Speedup() float64 {
+	if m.BestNsPerOp > 0 {
+		return m.OriginalNsPerOp / m.BestNsPerOp
+	}
+	if m.BestRuntime > 0 {
+		return float64(m.OriginalRuntime) / float64(m.BestRuntime)
+	}
+	return 0
+}
+
+// Environment describes the machine a session ran on, since timings are only comparable on the same one
+type Environment struct {
+	GoVersion  string
+	GOOS       string
+	GOARCH     string
+	NumCPU     int
+	GOMAXPROCS int
+	Hostname   string
+}
+
+// CurrentEnvironment describes this machine, with the version of the go command used to run the benchmarks
+func CurrentEnvironment() Environment {
+	env := Environment{
+		GoVersion:  runtime.Version(),
+		GOOS:       runtime.GOOS,
+		GOARCH:     runtime.GOARCH,
+		NumCPU:     runtime.NumCPU(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+	}
+	if version, err := exec.Command("go", "env", "GOVERSION").Output(); err == nil {
+		env.GoVersion = strings.TrimSpace(string(version))
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		env.Hostname = hostname
+	}
+	return env
+}
+
+// Accepted counts the loops that were kept
+func (s Session) Accepted() int {
+	n := 0
+	for _, o := range s.Outcomes {
+		if o.Accepted {
+			n++
+		}
+	}
+	return n
+}
+
+// History is every session recorded in an output folder, oldest first
+type History struct {
+	Sessions []Session
+}
+
+// LoadHistory reads the history of the output folder, which is empty if nothing has been recorded yet
+func LoadHistory(outputPath string) (History, error) {
+	var h History
+	data, err := os.ReadFile(filepath.Join(outputPath, HistoryFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return h, err
+	}
+	err = json.Unmarshal(data, &h)
+	if err != nil {
+		return h, fmt.Errorf("could not read %s: %w", HistoryFileName, err)
+	}
+	return h, nil
+}
+
+// RecordSession adds a session to the history of the output folder, replacing any earlier one with the same Id
+// The file is replaced in one step, so an interrupted write cannot lose the sessions already in it
+func RecordSession(outputPath string, session Session) error {
+	h, err := LoadHistory(outputPath)
+	if err != nil {
+		return err
+	}
+	replaced := false
+	for i := range h.Sessions {
+		if h.Sessions[i].Id == session.Id {
+			h.Sessions[i] = session
+			replaced = true
+		}
+	}
+	if !replaced {
+		h.Sessions = append(h.Sessions, session)
+	}
+	sort.SliceStable(h.Sessions, func(i, j int) bool {
+		return h.Sessions[i].Start.Before(h.Sessions[j].Start)
+	})
+
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(outputPath, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(outputPath, HistoryFileName+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(outputPath, HistoryFileName))
+}
+
+// Find gives the session with the given Id, or the only one whose Id starts with it
+func (h History) Find(id string) (Session, error) {
+	var matches []Session
+	for _, s := range h.Sessions {
+		if s.Id == id {
+			return s, nil
+		}
+		if strings.HasPrefix(s.Id, id) {
+			matches = append(matches, s)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return Session{}, fmt.Errorf("no session %s", id)
+	case 1:
+		return matches[0], nil
+	}
+	return Session{}, fmt.Errorf("%s matches %d sessions", id, len(matches))
+}
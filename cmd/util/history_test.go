@@ -0,0 +1,110 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordSession(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "_data")
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	sessions := []Session{
+		{Id: "b", Start: start.Add(time.Hour), Diffs: map[string]string{"x.go": "--- a/x.go\n"}},
+		{Id: "a", Start: start, Outcomes: []LoopOutcome{{File: "x.go", Line: 3, Accepted: true}, {File: "x.go", Line: 9}}},
+		// recorded again under the same Id, as a session is when it is interrupted and recorded on the way out
+		{Id: "b", Start: start.Add(time.Hour), Interrupted: true},
+	}
+	for _, s := range sessions {
+		if err := RecordSession(output, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h, err := LoadHistory(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Sessions) != 2 || h.Sessions[0].Id != "a" || h.Sessions[1].Id != "b" {
+		t.Fatalf("got sessions %+v, want a then b", h.Sessions)
+	}
+	if !h.Sessions[1].Interrupted || h.Sessions[1].Diffs != nil {
+		t.Errorf("session b was not replaced by its second record: %+v", h.Sessions[1])
+	}
+	if h.Sessions[0].Accepted() != 1 {
+		t.Errorf("session a accepted %d loops, want 1", h.Sessions[0].Accepted())
+	}
+	entries, err := os.ReadDir(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != HistoryFileName {
+		t.Errorf("the output folder holds %d files, want only %s", len(entries), HistoryFileName)
+	}
+
+	empty, err := LoadHistory(filepath.Join(output, "missing"))
+	if err != nil || len(empty.Sessions) != 0 {
+		t.Errorf("a folder without a history gave %+v, %v", empty, err)
+	}
+	if err := os.WriteFile(filepath.Join(output, HistoryFileName), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecordSession(output, Session{Id: "c"}); err == nil {
+		t.Errorf("recording over a broken history gave no error, which would have overwritten it")
+	}
+}
+
+func TestHistoryFind(t *testing.T) {
+	h := History{Sessions: []Session{{Id: "3f2a-01"}, {Id: "3f2a-02"}, {Id: "9c"}, {Id: "9c1"}}}
+	tests := []struct {
+		id   string
+		want string
+		err  string
+	}{
+		{"3f2a-01", "3f2a-01", ""},
+		{"3f2a-0", "", "matches 2 sessions"},
+		{"3f", "", "matches 2 sessions"},
+		// an exact Id wins over the longer ones it is a prefix of
+		{"9c", "9c", ""},
+		{"9c1", "9c1", ""},
+		{"7", "", "no session 7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			s, err := h.Find(tt.id)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got %+v, %v, want an error containing %q", s, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Id != tt.want {
+				t.Errorf("Find(%q) = %s, want %s", tt.id, s.Id, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionMetricsSpeedup(t *testing.T) {
+	tests := []struct {
+		name    string
+		metrics SessionMetrics
+		want    float64
+	}{
+		{"ns/op", SessionMetrics{OriginalNsPerOp: 300, BestNsPerOp: 100, OriginalRuntime: time.Second, BestRuntime: time.Second}, 3},
+		{"profile durations of older sessions", SessionMetrics{OriginalRuntime: 2 * time.Second, BestRuntime: time.Second}, 2},
+		{"nothing measured", SessionMetrics{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.metrics.Speedup(); got != tt.want {
+				t.Errorf("Speedup() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
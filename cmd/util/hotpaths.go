@@ -0,0 +1,168 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"perfactor/graph"
+	"sort"
+	"time"
+)
+
+// bestPointCoverage is how much of the time of the innermost loop above a hot function an outer loop must also cover
+// to be the better place to parallelise: the outer loop makes fewer, bigger units of work, so it is preferred unless
+// most of the time is spent outside of it
+const bestPointCoverage = 0.9
+
+// HotFunction is a function with a large share of the profile's flat time, and the loops it is called from
+type HotFunction struct {
+	Name string
+	File string
+	Line int
+	Flat int64
+	// Loops are the loops it is called from, at any depth and in any file of the module, innermost first
+	Loops []LoopAbove
+	// Best is the index in Loops of the loop that is the best place to parallelise, or -1 if there is none
+	Best int
+}
+
+// LoopAbove is a loop that a hot function is called from
+type LoopAbove struct {
+	// File is the path of the loop's file within the module
+	File string
+	Loop Loop
+	// Depth is the number of calls between the loop and the hot function, 1 if the loop calls it directly
+	Depth int
+	// Cum is the cumulative time of the call sites in the loop
+	Cum int64
+}
+
+func (h HotFunction) String() string {
+	return fmt.Sprintf("%s (%s:%d, %s flat)", h.Name, h.File, h.Line, time.Duration(h.Flat))
+}
+
+// FindLoopsAboveHotFunctions walks up the call graph from the top functions, by flat time, to every loop they are
+// called from, however far up and in whichever file. loops maps each file of the module to its loops
+// The best place to parallelise is chosen among the loops accepted by canRefactor, which may be nil to accept all
+func FindLoopsAboveHotFunctions(gr *graph.Graph, loops map[graph.File][]Loop, top int, canRefactor func(file string, loop Loop) bool) []HotFunction {
+	// the graph has a node per line, so the flat time is summed per function
+	type function struct {
+		hot   HotFunction
+		nodes []*graph.Node
+	}
+	functions := make(map[string]*function)
+	for _, n := range gr.Nodes {
+		if n.Info.Name == "" {
+			continue
+		}
+		fn := functions[n.Info.Name]
+		if fn == nil {
+			fn = &function{hot: HotFunction{Name: n.Info.Name, File: n.Info.File}}
+			functions[n.Info.Name] = fn
+		}
+		fn.hot.Flat += n.Flat
+		fn.nodes = append(fn.nodes, n)
+	}
+	ranked := make([]*function, 0, len(functions))
+	for _, fn := range functions {
+		if fn.hot.Flat > 0 {
+			ranked = append(ranked, fn)
+		}
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		return ranked[i].hot.Flat > ranked[j].hot.Flat
+	})
+	if len(ranked) > top {
+		ranked = ranked[:top]
+	}
+
+	hot := make([]HotFunction, 0, len(ranked))
+	for _, fn := range ranked {
+		h := fn.hot
+		h.Best = -1
+		// the hottest line names the function's place in the report
+		var flattest int64 = -1
+		found := make(map[string]int)
+		// every line of the function walks up the same callers, which must only count once
+		visited := make(map[*graph.Node]bool)
+		for _, n := range fn.nodes {
+			if n.Flat > flattest {
+				flattest = n.Flat
+				h.Line = n.Info.Lineno
+			}
+			gr.WalkCallers(n, func(caller *graph.Node, depth int) bool {
+				if visited[caller] {
+					return true
+				}
+				visited[caller] = true
+				for file, fileLoops := range loops {
+					if !graph.IsFile(caller.Info.File, caller.Info.Name, file) {
+						continue
+					}
+					for _, loop := range fileLoops {
+						if caller.Info.Lineno < loop.Line || caller.Info.Lineno > loop.EndLine || !inFunction(caller.Info.Name, loop.Func) {
+							continue
+						}
+						key := fmt.Sprintf("%s:%d", file.Path, loop.Line)
+						if i, ok := found[key]; ok {
+							h.Loops[i].Cum += caller.Cum
+							if depth < h.Loops[i].Depth {
+								h.Loops[i].Depth = depth
+							}
+							continue
+						}
+						found[key] = len(h.Loops)
+						h.Loops = append(h.Loops, LoopAbove{File: file.Path, Loop: loop, Depth: depth, Cum: caller.Cum})
+					}
+				}
+				return true
+			})
+		}
+		// innermost first; a loop nested in another at the same depth is the inner one
+		sort.SliceStable(h.Loops, func(i, j int) bool {
+			if h.Loops[i].Depth != h.Loops[j].Depth {
+				return h.Loops[i].Depth < h.Loops[j].Depth
+			}
+			return h.Loops[i].Loop.Line > h.Loops[j].Loop.Line
+		})
+		h.Best = bestParallelisationPoint(h.Loops, canRefactor)
+		hot = append(hot, h)
+	}
+	return hot
+}
+
+// bestParallelisationPoint picks the outermost loop that can be refactored and still covers most of the time of the
+// innermost one, whether or not that one can be refactored. Every loop is held to the innermost one's time, so a chain
+// of loops each covering most of the last cannot drift away from it. If none covers it, the innermost loop that can be
+// refactored is the best there is
+func bestParallelisationPoint(loops []LoopAbove, canRefactor func(file string, loop Loop) bool) int {
+	best := -1
+	for i, l := range loops {
+		if canRefactor != nil && !canRefactor(l.File, l.Loop) {
+			continue
+		}
+		if best == -1 || float64(l.Cum) >= bestPointCoverage*float64(loops[0].Cum) {
+			best = i
+		}
+	}
+	return best
+}
+
+// WriteHotFunctions reports the loops above each hot function, marking the best place to parallelise
+func WriteHotFunctions(out io.Writer, hot []HotFunction) {
+	for _, h := range hot {
+		if len(h.Loops) == 0 {
+			continue
+		}
+		_, _ = fmt.Fprintf(out, "Hot function %s is called from %d loops:\n", h, len(h.Loops))
+		for i, l := range h.Loops {
+			marker := " "
+			if i == h.Best {
+				marker = "*"
+			}
+			_, _ = fmt.Fprintf(out, "  %s %s:%d in %s, %d calls up, %s cumulative\n", marker, l.File, l.Loop.Line, l.Loop.Func, l.Depth, time.Duration(l.Cum))
+		}
+		if h.Best == -1 {
+			_, _ = fmt.Fprintf(out, "  none of these loops can be refactored in this run\n")
+		}
+	}
+}
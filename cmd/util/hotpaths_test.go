@@ -0,0 +1,84 @@
+package util
+
+import (
+	"perfactor/graph"
+	"testing"
+)
+
+func TestBestParallelisationPoint(t *testing.T) {
+	loop := func(line int, cum int64) LoopAbove {
+		return LoopAbove{File: "work.go", Loop: Loop{Line: line}, Cum: cum}
+	}
+	tests := []struct {
+		name      string
+		loops     []LoopAbove
+		refactors map[int]bool
+		want      int
+	}{
+		{"outer loop covering the inner one", []LoopAbove{loop(10, 100), loop(20, 95)}, nil, 1},
+		{"outer loop with most of its time elsewhere", []LoopAbove{loop(10, 100), loop(20, 50)}, nil, 0},
+		{"chain drifting away from the innermost loop", []LoopAbove{loop(10, 100), loop(20, 91), loop(30, 83), loop(40, 75)}, nil, 1},
+		{"innermost loop that cannot be refactored", []LoopAbove{loop(10, 100), loop(20, 60), loop(30, 95)}, map[int]bool{20: true, 30: true}, 2},
+		{"no loop covering the innermost one", []LoopAbove{loop(10, 100), loop(20, 60), loop(30, 50)}, map[int]bool{20: true, 30: true}, 1},
+		{"no loop that can be refactored", []LoopAbove{loop(10, 100)}, map[int]bool{}, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var canRefactor func(string, Loop) bool
+			if tt.refactors != nil {
+				canRefactor = func(file string, loop Loop) bool {
+					return tt.refactors[loop.Line]
+				}
+			}
+			if got := bestParallelisationPoint(tt.loops, canRefactor); got != tt.want {
+				t.Errorf("bestParallelisationPoint() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindLoopsAboveHotFunctions(t *testing.T) {
+	node := func(name string, file string, line int, flat int64, cum int64) *graph.Node {
+		return &graph.Node{Info: graph.NodeInfo{Name: name, File: file, Lineno: line}, Flat: flat, Cum: cum,
+			In: make(map[*graph.Node]*graph.Edge), Out: make(map[*graph.Node]*graph.Edge)}
+	}
+	call := func(caller *graph.Node, callee *graph.Node) {
+		e := &graph.Edge{Src: caller, Dest: callee, Weight: callee.Cum}
+		caller.Out[callee] = e
+		callee.In[caller] = e
+	}
+	hot := node("example.com/m/sub.hash", "/src/sub/hash.go", 5, 100, 100)
+	inner := node("example.com/m.process", "/src/work.go", 12, 0, 100)
+	outer := node("example.com/m.main", "/src/work.go", 22, 0, 100)
+	// a file of the same name in another package, whose lines fall in the loops of work.go
+	other := node("example.com/m/sub.process", "/src/sub/work.go", 13, 0, 100)
+	call(inner, hot)
+	call(outer, inner)
+	call(other, hot)
+	gr := &graph.Graph{Nodes: graph.Nodes{hot, inner, outer, other}}
+
+	work := graph.File{Path: "work.go", Package: "example.com/m"}
+	loops := map[graph.File][]Loop{work: {
+		{Line: 10, EndLine: 14, Func: "process"},
+		{Line: 20, EndLine: 24, Func: "main"},
+	}}
+	found := FindLoopsAboveHotFunctions(gr, loops, 1, nil)
+	if len(found) != 1 || found[0].Name != hot.Info.Name {
+		t.Fatalf("found %v, want %s", found, hot.Info.Name)
+	}
+	h := found[0]
+	if len(h.Loops) != 2 {
+		t.Fatalf("found %d loops above %s, want 2: %v", len(h.Loops), h.Name, h.Loops)
+	}
+	for i, want := range []struct {
+		line  int
+		depth int
+	}{{10, 1}, {20, 2}} {
+		if h.Loops[i].Loop.Line != want.line || h.Loops[i].Depth != want.depth || h.Loops[i].File != "work.go" {
+			t.Errorf("loop %d is %s:%d, %d calls up, want work.go:%d, %d calls up", i, h.Loops[i].File, h.Loops[i].Loop.Line, h.Loops[i].Depth, want.line, want.depth)
+		}
+	}
+	if h.Best != 1 {
+		t.Errorf("Best = %d, want the outer loop", h.Best)
+	}
+}
@@ -0,0 +1,365 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// InstrumentFileName and InstrumentTestFileName are the files of the counters and of the TestMain that writes them out,
+// which are added to the package of the instrumented file
+const (
+	InstrumentFileName     = "perfactor_instrument.go"
+	InstrumentTestFileName = "perfactor_instrument_test.go"
+)
+
+// LoopStatsFileName is the file the counters are written to when the benchmarks finish, in the package's folder
+const LoopStatsFileName = "perfactor_loops.json"
+
+// LoopStats is what the instrumentation counted for a loop over every run of the benchmarks, including the rounds
+// the testing package uses to choose b.N
+type LoopStats struct {
+	Line int
+	// Invocations is the number of times the loop was started, and Iterations the number of times its body was run
+	Invocations int64
+	Iterations  int64
+	// Nanos is the wall time spent in the loop, summed over invocations, so it counts the time of nested loops too
+	Nanos    int64
+	MaxTrips int64
+	// Histogram counts the invocations by trip count: bucket 0 is no iterations, and bucket k is from 2^(k-1) to 2^k-1
+	Histogram []int64
+}
+
+// MeanTrips is the average number of iterations of an invocation
+func (s LoopStats) MeanTrips() float64 {
+	if s.Invocations == 0 {
+		return 0
+	}
+	return float64(s.Iterations) / float64(s.Invocations)
+}
+
+// TypicalTrips is the trip count to model a loop with, the mean rounded up, so that a loop that ran at all counts
+// as at least one iteration. It is 0 if the loop never ran
+func (s LoopStats) TypicalTrips() int64 {
+	if s.Invocations == 0 || s.Iterations == 0 {
+		return 0
+	}
+	return (s.Iterations + s.Invocations - 1) / s.Invocations
+}
+
+// PerIteration is the average wall time of an iteration, with the loop's own overhead
+func (s LoopStats) PerIteration() time.Duration {
+	if s.Iterations == 0 {
+		return 0
+	}
+	return time.Duration(s.Nanos / s.Iterations)
+}
+
+// Trips describes the distribution of the trip counts, as the share of invocations in each non-empty bucket
+func (s LoopStats) Trips() string {
+	var parts []string
+	for k, n := range s.Histogram {
+		if n == 0 {
+			continue
+		}
+		share := float64(n) / float64(s.Invocations) * 100
+		parts = append(parts, fmt.Sprintf("%s: %.1f%%", bucketRange(k), share))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (s LoopStats) String() string {
+	return fmt.Sprintf("%d invocations, %d iterations (%.1f on average, %d at most), %s in the loop, %s per iteration",
+		s.Invocations, s.Iterations, s.MeanTrips(), s.MaxTrips, time.Duration(s.Nanos).Round(time.Microsecond), s.PerIteration())
+}
+
+func bucketRange(k int) string {
+	if k == 0 {
+		return "0"
+	}
+	low := int64(1) << (k - 1)
+	high := int64(1)<<k - 1
+	if k == 64 {
+		high = 1<<63 - 1
+	}
+	if low == high {
+		return strconv.FormatInt(low, 10)
+	}
+	return fmt.Sprintf("%d-%d", low, high)
+}
+
+// InstrumentLoops rewrites the file in folderPath with counters and a timer around each loop starting on one of the
+// lines, and adds the files that hold the counters and write them out when the tests finish
+// The benchmarks must be in the file's package, which must not have a TestMain of its own
+func InstrumentLoops(folderPath string, fileName string, lines []int) error {
+	dir, err := instrumentablePackage(folderPath, fileName)
+	if err != nil {
+		return err
+	}
+	fileSet := token.NewFileSet()
+	path := filepath.Join(folderPath, fileName)
+	astFile, err := parser.ParseFile(fileSet, path, nil, parser.ParseComments)
+	if err != nil {
+		return err
+	}
+	wanted := make(map[int]bool, len(lines))
+	for _, line := range lines {
+		wanted[line] = true
+	}
+	found := instrumentFile(astFile, fileSet, wanted)
+	if len(found) == 0 {
+		return errors.New("none of the loops were found to instrument")
+	}
+
+	var src bytes.Buffer
+	err = format.Node(&src, fileSet, astFile)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(path, src.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(dir, InstrumentFileName), instrumentSource(astFile.Name.Name, found), 0644)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, InstrumentTestFileName), instrumentTestSource(astFile.Name.Name, "perfactorWriteLoops"), 0644)
+}
+
+// instrumentFile adds the counters to the wanted loops, and gives the lines of those it found
+// Before the loop, the time and a trip count are taken; the body counts its iterations first, so a continue still
+// counts; and the invocation is recorded after the loop, unless it is a terminating statement, and before every return
+// in its body. A loop left for an enclosing loop's label, by a goto or by a panic is not recorded
+func instrumentFile(astFile *ast.File, fileSet *token.FileSet, wanted map[int]bool) []int {
+	var found []int
+	astutil.Apply(astFile, func(c *astutil.Cursor) bool {
+		stmt, ok := c.Node().(ast.Stmt)
+		if !ok || c.Index() < 0 {
+			return true
+		}
+		// a labelled loop is wrapped as a whole, so its label stays on the loop
+		loop := stmt
+		if labelled, ok := stmt.(*ast.LabeledStmt); ok {
+			loop = labelled.Stmt
+		}
+		var body *ast.BlockStmt
+		switch loop := loop.(type) {
+		case *ast.ForStmt:
+			body = loop.Body
+		case *ast.RangeStmt:
+			body = loop.Body
+		default:
+			return true
+		}
+		line := fileSet.Position(loop.Pos()).Line
+		if !wanted[line] {
+			return true
+		}
+		found = append(found, line)
+		start := ast.NewIdent("perfactorStart" + strconv.Itoa(line))
+		trips := ast.NewIdent("perfactorTrips" + strconv.Itoa(line))
+		exit := func() ast.Stmt {
+			return &ast.ExprStmt{X: &ast.CallExpr{
+				Fun:  ast.NewIdent("perfactorExit"),
+				Args: []ast.Expr{&ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(line)}, ast.NewIdent(start.Name), ast.NewIdent(trips.Name)},
+			}}
+		}
+
+		astutil.Apply(body, func(r *astutil.Cursor) bool {
+			switch r.Node().(type) {
+			case *ast.FuncLit:
+				// a return in a closure does not leave the loop
+				return false
+			case *ast.ReturnStmt:
+				if r.Index() >= 0 {
+					r.InsertBefore(exit())
+				}
+			}
+			return true
+		}, nil)
+		body.List = append([]ast.Stmt{&ast.IncDecStmt{X: ast.NewIdent(trips.Name), Tok: token.INC}}, body.List...)
+
+		c.InsertBefore(&ast.AssignStmt{
+			Lhs: []ast.Expr{start, trips},
+			Tok: token.DEFINE,
+			Rhs: []ast.Expr{
+				&ast.CallExpr{Fun: ast.NewIdent("perfactorEnter")},
+				&ast.CallExpr{Fun: ast.NewIdent("int64"), Args: []ast.Expr{&ast.BasicLit{Kind: token.INT, Value: "0"}}},
+			},
+		})
+		// a loop that is a terminating statement is never left at its end, and a call after it would be unreachable and
+		// would stop it from ending a function that has results
+		if !isTerminating(stmt, "", nil) {
+			c.InsertAfter(exit())
+		}
+		return true
+	}, nil)
+	sort.Ints(found)
+	return found
+}
+
+// instrumentablePackage gives the folder of the file's package, if the benchmarks run in it and a generated TestMain
+// can be added to it to write out what was recorded
+func instrumentablePackage(folderPath string, fileName string) (string, error) {
+	dir := filepath.Dir(filepath.Join(folderPath, fileName))
+	if filepath.Clean(dir) != filepath.Clean(folderPath) {
+		return "", errors.New("the benchmarks are run in the module's root package, so only its files can be instrumented")
+	}
+	if hasTestMain(dir) {
+		return "", errors.New("the package has a TestMain, so what is recorded cannot be written out")
+	}
+	return dir, nil
+}
+
+// hasTestMain reports whether a test file of the package in dir declares TestMain
+func hasTestMain(dir string) bool {
+	matches, _ := filepath.Glob(filepath.Join(dir, "*_test.go"))
+	for _, match := range matches {
+		astFile, err := parser.ParseFile(token.NewFileSet(), match, nil, 0)
+		if err != nil {
+			continue
+		}
+		for _, decl := range astFile.Decls {
+			if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv == nil && fn.Name.Name == "TestMain" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// instrumentSource is the file with a counter for each loop; the counters are updated atomically, since the loops may
+// run on several goroutines
+func instrumentSource(pkgName string, lines []int) []byte {
+	var src bytes.Buffer
+	src.WriteString("// Code generated by perfactor. DO NOT EDIT.\n\n")
+	src.WriteString("package " + pkgName + "\n\n")
+	src.WriteString(`import (
+	"encoding/json"
+	"math/bits"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+type perfactorLoop struct {
+	Line        int
+	Invocations int64
+	Iterations  int64
+	Nanos       int64
+	MaxTrips    int64
+	Histogram   [65]int64
+}
+
+var perfactorLoops = map[int]*perfactorLoop{
+`)
+	for _, line := range lines {
+		src.WriteString(fmt.Sprintf("\t%d: {Line: %d},\n", line, line))
+	}
+	src.WriteString(`}
+
+func perfactorEnter() time.Time {
+	return time.Now()
+}
+
+func perfactorExit(line int, start time.Time, trips int64) {
+	l := perfactorLoops[line]
+	atomic.AddInt64(&l.Nanos, int64(time.Since(start)))
+	atomic.AddInt64(&l.Invocations, 1)
+	atomic.AddInt64(&l.Iterations, trips)
+	atomic.AddInt64(&l.Histogram[bits.Len64(uint64(trips))], 1)
+	for {
+		most := atomic.LoadInt64(&l.MaxTrips)
+		if trips <= most || atomic.CompareAndSwapInt64(&l.MaxTrips, most, trips) {
+			return
+		}
+	}
+}
+
+func perfactorWriteLoops() {
+	data, err := json.Marshal(perfactorLoops)
+	if err == nil {
+		_ = os.WriteFile("` + LoopStatsFileName + `", data, 0644)
+	}
+}
+`)
+	return src.Bytes()
+}
+
+// instrumentTestSource is the TestMain that calls the generated write function once the tests and benchmarks are done
+func instrumentTestSource(pkgName string, write string) []byte {
+	return []byte("// Code generated by perfactor. DO NOT EDIT.\n\n" +
+		"package " + pkgName + "\n\n" + `import (
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	` + write + `()
+	os.Exit(code)
+}
+`)
+}
+
+// RunInstrumented runs the benchmarks once in the instrumented copy in folderPath, and reads the counters, by line
+func RunInstrumented(ctx context.Context, timeout time.Duration, flags string, folderPath string, benchName string) (map[int]LoopStats, TestResult) {
+	dir, err := workingDir(folderPath)
+	if err != nil {
+		return nil, TestResult{Err: err}
+	}
+	_ = os.Remove(filepath.Join(dir, LoopStatsFileName))
+	args := []string{"test"}
+	args = append(args, strings.Fields(flags)...)
+	args = append(args, "-json", "-run=NONE", "-bench="+benchName, "-count=1")
+	output, err := RunCommand(ctx, timeout, dir, "go", args...)
+	result := toTestResult(output, err)
+	if !result.Ok() {
+		return nil, result
+	}
+	data, err := os.ReadFile(filepath.Join(dir, LoopStatsFileName))
+	if err != nil {
+		result.Err = fmt.Errorf("the counters were not written: %w", err)
+		return nil, result
+	}
+	var stats map[int]LoopStats
+	err = json.Unmarshal(data, &stats)
+	if err != nil {
+		result.Err = fmt.Errorf("could not read the counters: %w", err)
+		return nil, result
+	}
+	return stats, result
+}
+
+// WriteLoopStats reports the counters of the loops in the order of the file
+func WriteLoopStats(out io.Writer, fileName string, stats map[int]LoopStats) {
+	lines := make([]int, 0, len(stats))
+	for line := range stats {
+		lines = append(lines, line)
+	}
+	sort.Ints(lines)
+	_, _ = fmt.Fprintf(out, "Instrumented loops in %s:\n", fileName)
+	for _, line := range lines {
+		s := stats[line]
+		_, _ = fmt.Fprintf(out, "  line %d: %s\n", line, s)
+		if s.Invocations > 0 {
+			_, _ = fmt.Fprintf(out, "    trip counts: %s\n", s.Trips())
+		}
+	}
+}
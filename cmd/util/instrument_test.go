@@ -0,0 +1,125 @@
+package util
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strings"
+	"testing"
+)
+
+// instrumentedSource has a loop of every shape the instrumentation treats differently, one per function
+const instrumentedSource = `package p
+
+func sum(a []int) int {
+	total := 0
+	for _, v := range a {
+		total += v
+	}
+	return total
+}
+
+func find(a []int, x int) int {
+	for i, v := range a {
+		if v == x {
+			return i
+		}
+	}
+	return -1
+}
+
+func first(a []int) int {
+	for i := 0; ; i++ {
+		if a[i] != 0 {
+			return i
+		}
+	}
+}
+
+func labelled(a [][]int) int {
+	n := 0
+outer:
+	for _, row := range a {
+		for _, v := range row {
+			if v < 0 {
+				continue outer
+			}
+			n++
+		}
+	}
+	return n
+}
+
+func closure(a []int) []func() int {
+	var fs []func() int
+	for _, v := range a {
+		fs = append(fs, func() int { return v })
+	}
+	return fs
+}
+`
+
+func TestInstrumentFile(t *testing.T) {
+	fileSet := token.NewFileSet()
+	astFile, err := parser.ParseFile(fileSet, "p.go", instrumentedSource, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wanted := map[int]bool{5: true, 12: true, 21: true, 31: true, 32: true, 44: true}
+	found := instrumentFile(astFile, fileSet, wanted)
+	if len(found) != len(wanted) {
+		t.Fatalf("instrumented the loops on lines %v, want %d loops", found, len(wanted))
+	}
+	var src bytes.Buffer
+	if err := format.Node(&src, fileSet, astFile); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		line  string
+		exits int
+	}{
+		// after the loop
+		{"5", 1},
+		// before the return in the body, and after the loop
+		{"12", 2},
+		// only before the return, since the loop ends the function and is never left at its end
+		{"21", 1},
+		// the labelled loop keeps its label, and the inner loop is left by continue outer without being recorded
+		{"31", 1},
+		{"32", 1},
+		// the return of the closure does not leave the loop
+		{"44", 1},
+	}
+	for _, tt := range tests {
+		t.Run("line "+tt.line, func(t *testing.T) {
+			if got := strings.Count(src.String(), "perfactorExit("+tt.line+", "); got != tt.exits {
+				t.Errorf("recorded the invocation in %d places, want %d:\n%s", got, tt.exits, src.String())
+			}
+			if !strings.Contains(src.String(), "perfactorTrips"+tt.line+"++") {
+				t.Errorf("the body does not count its iterations:\n%s", src.String())
+			}
+		})
+	}
+	if !strings.Contains(src.String(), "outer:\n\tfor _, row := range a {") {
+		t.Errorf("the label was moved off its loop:\n%s", src.String())
+	}
+
+	// the instrumented file compiles with the counters added to its package
+	files := []*ast.File{}
+	for name, text := range map[string]string{"p.go": src.String(), InstrumentFileName: string(instrumentSource("p", found))} {
+		file, err := parser.ParseFile(fileSet, name, text, 0)
+		if err != nil {
+			t.Fatalf("%s does not parse: %s\n%s", name, err, text)
+		}
+		files = append(files, file)
+	}
+	config := &types.Config{Importer: importer.ForCompiler(fileSet, "source", nil)}
+	if _, err := config.Check("p", fileSet, files, nil); err != nil {
+		t.Errorf("the instrumented package does not compile: %s\n%s", err, src.String())
+	}
+}
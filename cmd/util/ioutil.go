@@ -75,6 +75,13 @@ func WriteModifiedAST(fset *token.FileSet, astFile *ast.File, filePath string, f
 	}
 }
 
+// PrintAST gives the source of the file as WriteModifiedAST writes it, so that versions of it can be compared
+func PrintAST(fset *token.FileSet, astFile *ast.File) (string, error) {
+	var sb strings.Builder
+	err := printer.Fprint(&sb, fset, astFile)
+	return sb.String(), err
+}
+
 // GetAllGoFilesInDir returns a list of all .go files in the given directory
 func GetAllGoFilesInDir(dirPath string) ([]string, error) {
 	return getAllGoFilesInDir(dirPath, "")
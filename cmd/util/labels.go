@@ -0,0 +1,312 @@
+package util
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"perfactor/graph"
+	"strconv"
+
+	"github.com/google/pprof/profile"
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// LoopLabel is the pprof label that the samples taken inside a wrapped loop carry, with the loop's line as its value
+const LoopLabel = "perfactor_loop"
+
+// LabelFileName is the file of the function that runs a loop under its label, which is added to the package of the file
+const LabelFileName = "perfactor_labels.go"
+
+// Attribution modes: by the lines of the samples' frames, or by the labels of loops wrapped in pprof.Do
+const (
+	AttributionLines  = "lines"
+	AttributionLabels = "labels"
+)
+
+// LabelLoops rewrites the file in folderPath so that every loop that can be moved into a closure runs inside pprof.Do,
+// labelled with its line, and gives the lines of the loops it wrapped. The calls are added on the loop's first and
+// last lines, so no line of the file moves and the loops it could not wrap can still be found by their lines
+// A loop cannot be wrapped if it returns, defers, jumps out with goto or a label, or is what ends a function with results
+func LabelLoops(folderPath string, fileName string) (map[int]bool, error) {
+	path := filepath.Join(folderPath, fileName)
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fileSet := token.NewFileSet()
+	astFile, err := parser.ParseFile(fileSet, path, src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	tokenFile := fileSet.File(astFile.Pos())
+
+	var edits []edit
+	wrapped := make(map[int]bool)
+	for _, loop := range FindForLoopsInAST(astFile, fileSet, nil) {
+		stmt, outer := loopStatement(astFile, loop)
+		if stmt == nil || !canWrap(astFile, stmt, outer) {
+			continue
+		}
+		wrapped[loop.Line] = true
+		edits = append(edits,
+			edit{offset: tokenFile.Offset(outer.Pos()), text: "perfactorDo(\"" + strconv.Itoa(loop.Line) + "\", func() { "},
+			edit{offset: tokenFile.Offset(stmt.End()), text: " })"})
+	}
+	if len(wrapped) == 0 {
+		return nil, fmt.Errorf("none of the loops of %s can be wrapped", fileName)
+	}
+	err = os.WriteFile(path, applyEdits(src, edits), 0644)
+	if err != nil {
+		return nil, err
+	}
+	return wrapped, os.WriteFile(filepath.Join(filepath.Dir(path), LabelFileName), labelSource(astFile.Name.Name), 0644)
+}
+
+// loopStatement gives the statement of the loop, and the statement to wrap, which is its label if it has one
+func loopStatement(astFile *ast.File, loop Loop) (ast.Stmt, ast.Stmt) {
+	var stmt ast.Stmt
+	switch {
+	case loop.For != nil:
+		stmt = loop.For
+	case loop.Range != nil:
+		stmt = loop.Range
+	default:
+		return nil, nil
+	}
+	outer := stmt
+	ast.Inspect(astFile, func(n ast.Node) bool {
+		if labelled, ok := n.(*ast.LabeledStmt); ok && labelled.Stmt == stmt {
+			outer = labelled
+		}
+		return outer == stmt
+	})
+	return stmt, outer
+}
+
+// canWrap reports whether moving the statement into a closure keeps its meaning, and the function still compiles
+func canWrap(astFile *ast.File, stmt ast.Stmt, outer ast.Stmt) bool {
+	// labels declared inside the statement, its own included, can still be jumped to from inside the closure
+	labels := make(map[string]bool)
+	ast.Inspect(outer, func(n ast.Node) bool {
+		if labelled, ok := n.(*ast.LabeledStmt); ok {
+			labels[labelled.Label.Name] = true
+		}
+		return true
+	})
+	ok := true
+	ast.Inspect(outer, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.ReturnStmt, *ast.DeferStmt:
+			ok = false
+		case *ast.BranchStmt:
+			if n.Tok == token.GOTO || (n.Label != nil && !labels[n.Label.Name]) {
+				ok = false
+			}
+		}
+		return ok
+	})
+	if !ok {
+		return false
+	}
+	// the closure's call does not end the function, so the statement cannot be moved if the function relies on it to end
+	body, results := enclosingFunc(astFile, outer)
+	return body == nil || !results || !isTerminating(body, "", nil) || isTerminating(body, "", outer)
+}
+
+// enclosingFunc gives the body of the innermost function, declared or literal, around the statement, and whether it
+// has results, which makes it need to end in a terminating statement
+func enclosingFunc(astFile *ast.File, stmt ast.Stmt) (*ast.BlockStmt, bool) {
+	path, _ := astutil.PathEnclosingInterval(astFile, stmt.Pos(), stmt.End())
+	for _, n := range path {
+		switch fn := n.(type) {
+		case *ast.FuncLit:
+			return fn.Body, fn.Type.Results != nil && len(fn.Type.Results.List) > 0
+		case *ast.FuncDecl:
+			return fn.Body, fn.Type.Results != nil && len(fn.Type.Results.List) > 0
+		}
+	}
+	return nil, false
+}
+
+// isTerminating reports whether the statement is a terminating statement, as the spec defines it and go/types checks
+// it, with label the statement's label if it has one. The moved statement, once wrapped, is not terminating
+// A call to panic is recognised by its name, so a shadowed panic is taken for the builtin
+func isTerminating(s ast.Stmt, label string, moved ast.Stmt) bool {
+	if s == moved {
+		return false
+	}
+	switch s := s.(type) {
+	case *ast.ReturnStmt:
+		return true
+	case *ast.BranchStmt:
+		return s.Tok == token.GOTO || s.Tok == token.FALLTHROUGH
+	case *ast.ExprStmt:
+		call, ok := astutil.Unparen(s.X).(*ast.CallExpr)
+		if !ok {
+			return false
+		}
+		id, ok := astutil.Unparen(call.Fun).(*ast.Ident)
+		return ok && id.Name == "panic"
+	case *ast.LabeledStmt:
+		return isTerminating(s.Stmt, s.Label.Name, moved)
+	case *ast.BlockStmt:
+		return isTerminatingList(s.List, moved)
+	case *ast.IfStmt:
+		return s.Else != nil && isTerminating(s.Body, "", moved) && isTerminating(s.Else, "", moved)
+	case *ast.SwitchStmt:
+		return isTerminatingSwitch(s.Body, label, moved)
+	case *ast.TypeSwitchStmt:
+		return isTerminatingSwitch(s.Body, label, moved)
+	case *ast.SelectStmt:
+		for _, clause := range s.Body.List {
+			cc := clause.(*ast.CommClause)
+			if !isTerminatingList(cc.Body, moved) || hasBreak(cc.Body, label, true) {
+				return false
+			}
+		}
+		return true
+	case *ast.ForStmt:
+		return s.Cond == nil && !hasBreak(s.Body.List, label, true)
+	}
+	return false
+}
+
+// isTerminatingList reports whether the last statement of the list that is not empty is terminating
+func isTerminatingList(list []ast.Stmt, moved ast.Stmt) bool {
+	for i := len(list) - 1; i >= 0; i-- {
+		if _, empty := list[i].(*ast.EmptyStmt); !empty {
+			return isTerminating(list[i], "", moved)
+		}
+	}
+	return false
+}
+
+func isTerminatingSwitch(body *ast.BlockStmt, label string, moved ast.Stmt) bool {
+	hasDefault := false
+	for _, clause := range body.List {
+		cc := clause.(*ast.CaseClause)
+		if cc.List == nil {
+			hasDefault = true
+		}
+		if !isTerminatingList(cc.Body, moved) || hasBreak(cc.Body, label, true) {
+			return false
+		}
+	}
+	return hasDefault
+}
+
+// hasBreak reports whether the statements break out of the statement labelled label, or, if implicit, out of the
+// statement they are the body of with a break without a label
+func hasBreak(list []ast.Stmt, label string, implicit bool) bool {
+	found := false
+	for _, stmt := range list {
+		ast.Inspect(stmt, func(n ast.Node) bool {
+			var body *ast.BlockStmt
+			switch n := n.(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.BranchStmt:
+				if n.Tok == token.BREAK && ((n.Label == nil && implicit) || (n.Label != nil && n.Label.Name == label)) {
+					found = true
+				}
+			case *ast.ForStmt:
+				body = n.Body
+			case *ast.RangeStmt:
+				body = n.Body
+			case *ast.SwitchStmt:
+				body = n.Body
+			case *ast.TypeSwitchStmt:
+				body = n.Body
+			case *ast.SelectStmt:
+				body = n.Body
+			}
+			if body != nil && implicit {
+				// a break without a label in a nested statement leaves that statement
+				found = found || hasBreak(body.List, label, false)
+				return false
+			}
+			return !found
+		})
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+func labelSource(pkgName string) []byte {
+	return []byte("// Code generated by perfactor. DO NOT EDIT.\n\n" +
+		"package " + pkgName + "\n\n" + `import (
+	"context"
+	"runtime/pprof"
+)
+
+func perfactorDo(line string, loop func()) {
+	pprof.Do(context.Background(), pprof.Labels("` + LoopLabel + `", line), func(context.Context) {
+		loop()
+	})
+}
+`)
+}
+
+// AttributeLabels sums, for each wrapped loop, the CPU time of the samples labelled with its line, which includes the
+// goroutines it starts and everything it calls. A wrapped loop inside it, in the same function or one it calls,
+// replaces its label, so a sample labelled for another loop also counts if it has a frame on this loop's lines
+// The loops that were not wrapped are attributed by their lines, as by AttributeSamples
+func AttributeLabels(prof *profile.Profile, loops []Loop, file graph.File, wrapped map[int]bool) ([]int64, []LoopMatch) {
+	times, matches := AttributeSamples(prof, loops, file)
+	index := cpuValueIndex(prof)
+	inFile := make(map[*profile.Function]bool)
+	for _, fn := range prof.Function {
+		inFile[fn] = graph.IsFile(fn.Filename, fn.Name, file)
+	}
+	for i, loop := range loops {
+		if !wrapped[loop.Line] {
+			continue
+		}
+		label := strconv.Itoa(loop.Line)
+		times[i] = 0
+		for _, sample := range prof.Sample {
+			values := sample.Label[LoopLabel]
+			if len(values) == 0 {
+				continue
+			}
+			if containsString(values, label) || sampleOnLoop(sample, loop, inFile) {
+				times[i] += sample.Value[index]
+			}
+		}
+		if times[i] != 0 {
+			matches[i] = LoopSampled
+		}
+	}
+	return times, matches
+}
+
+// sampleOnLoop reports whether a sample has a frame on the loop's lines, in its function
+func sampleOnLoop(sample *profile.Sample, loop Loop, inFile map[*profile.Function]bool) bool {
+	for _, location := range sample.Location {
+		for _, line := range location.Line {
+			if line.Function == nil || !inFile[line.Function] || !inFunction(line.Function.Name, loop.Func) {
+				continue
+			}
+			if int(line.Line) >= loop.Line && int(line.Line) <= loop.EndLine {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
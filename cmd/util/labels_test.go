@@ -0,0 +1,84 @@
+package util
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"testing"
+)
+
+func TestCanWrap(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want bool
+	}{
+		{"plain loop", "func f(a []int) {\n\tfor i := range a {\n\t\ta[i]++\n\t}\n}", true},
+		{"returns", "func f(a []int) int {\n\tfor i := range a {\n\t\treturn i\n\t}\n\treturn 0\n}", false},
+		{"defers", "func f(a []int) {\n\tfor range a {\n\t\tdefer println()\n\t}\n}", false},
+		{"breaks out of an outer loop", "func f(a []int) {\nouter:\n\tfor {\n\t\tfor range a {\n\t\t\tbreak outer\n\t\t}\n\t}\n}", false},
+		{"return in a function literal", "func f(a []int) {\n\tfor i := range a {\n\t\t_ = func() int { return i }\n\t}\n}", true},
+		{"endless loop ending a function with results", "func f() int {\n\tfor {\n\t\tprintln()\n\t}\n}", false},
+		{"endless loop ending a function without results", "func f() {\n\tfor {\n\t\tprintln()\n\t}\n}", true},
+		{"endless loop before a return", "func f() int {\n\tfor {\n\t\tprintln()\n\t}\n\treturn 0\n}", true},
+		{"endless loop ending an else branch", "func f(b bool) int {\n\tif b {\n\t\treturn 1\n\t} else {\n\t\tfor {\n\t\t\tprintln()\n\t\t}\n\t}\n}", false},
+		{"endless loop ending a function literal with results", "func f() {\n\t_ = func() int {\n\t\tfor {\n\t\t\tprintln()\n\t\t}\n\t}\n}", false},
+		{"endless loop ending a switch with a default", "func f(n int) int {\n\tswitch n {\n\tcase 0:\n\t\treturn 0\n\tdefault:\n\t\tfor {\n\t\t\tprintln()\n\t\t}\n\t}\n}", false},
+		{"loop with a break after a panic", "func f(a []int) int {\n\tif len(a) == 0 {\n\t\tpanic(\"empty\")\n\t}\n\tfor {\n\t\tbreak\n\t}\n\treturn 0\n}", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileSet := token.NewFileSet()
+			astFile, err := parser.ParseFile(fileSet, "f.go", "package p\n\n"+tt.body+"\n", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			loops := FindForLoopsInAST(astFile, fileSet, nil)
+			if len(loops) == 0 {
+				t.Fatal("found no loop")
+			}
+			// the loop to wrap is the last one found, which is the innermost
+			stmt, outer := loopStatement(astFile, loops[len(loops)-1])
+			if got := canWrap(astFile, stmt, outer); got != tt.want {
+				t.Errorf("canWrap() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsTerminating(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want bool
+	}{
+		{"return", "return 0", true},
+		{"panic", "panic(0)", true},
+		{"if without else", "if true { return 0 }", false},
+		{"if and else both returning", "if true { return 0 } else { return 1 }", true},
+		{"endless loop", "for {}", true},
+		{"endless loop with a break", "for { break }", false},
+		{"break of a nested switch", "for { switch { default: break } }", true},
+		{"labelled break out of a nested switch", "L: for { switch { default: break L } }", false},
+		{"switch without default", "switch { case true: return 0 }", false},
+		{"switch with fallthrough", "switch { case true: fallthrough; default: return 0 }", true},
+		{"select", "select { case <-make(chan int): return 0 }", true},
+		{"trailing empty statement", "return 0;;", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileSet := token.NewFileSet()
+			astFile, err := parser.ParseFile(fileSet, "f.go", "package p\n\nfunc f() int {\n"+tt.body+"\n}\n", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, results := enclosingFunc(astFile, astFile.Decls[0].(*ast.FuncDecl).Body.List[0])
+			if !results {
+				t.Fatal("function has no results")
+			}
+			if got := isTerminating(body, "", nil); got != tt.want {
+				t.Errorf("isTerminating() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
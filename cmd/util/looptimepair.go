@@ -4,6 +4,8 @@ package util
 type LoopInfo struct {
 	Loop Loop
 	Time int64
+	// Match says whether the loop was found in the profile, and if not, why
+	Match LoopMatch
 }
 
 type LoopInfoArray []LoopInfo
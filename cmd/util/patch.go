@@ -0,0 +1,239 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// PatchFolder is the folder of a session's Output folder that holds a patch for each accepted loop
+const PatchFolder = "patches"
+
+// StrategyPerIteration is the rewrite perfactor makes, which starts a goroutine for each iteration of the loop
+const StrategyPerIteration = "a goroutine per iteration"
+
+// SessionPatchName is the patch of every change of a session, written to its Output folder, which applies to the
+// project with git apply
+const SessionPatchName = "perfactor.patch"
+
+// LoopPatch is the change that made one loop concurrent, as a unified diff against the version of the file before it
+// The patches of a file apply in the order they were accepted, starting from the file in the project, since only the
+// declarations a change touches are reprinted
+type LoopPatch struct {
+	File string
+	// Line is the loop's line in the version before the change
+	Line int
+	// Before and After are the benchmarks' summed ns/op before and after the change, and Speedup the geometric mean of
+	// their ratios, which is what the change was accepted on; all are 0 if the benchmarks were not run
+	Before  float64
+	After   float64
+	Speedup float64
+	Diff    string
+	// Base is the file before the change, which Diff applies to
+	Base string
+	// Source is the file after the change, and after the changes accepted before it, which is written back to the
+	// project when applying it
+	Source string
+}
+
+// NewLoopPatch diffs the versions of the file before and after the loop was made concurrent
+// Every hunk is headed with the loop and its improvement
+func NewLoopPatch(file string, line int, before string, after string, beforeNs float64, afterNs float64, speedup float64) LoopPatch {
+	lp := LoopPatch{File: file, Line: line, Before: beforeNs, After: afterNs, Speedup: speedup, Base: before, Source: after}
+	lp.Diff = UnifiedDiffWithSections("a/"+file, "b/"+file, before, after, func(int, int) string {
+		return lp.Section()
+	})
+	return lp
+}
+
+// Section describes the loop and its improvement for a hunk header
+func (lp LoopPatch) Section() string {
+	section := fmt.Sprintf("loop %s:%d", lp.File, lp.Line)
+	if lp.Speedup > 0 {
+		section += ", " + lp.improvement()
+	}
+	return section
+}
+
+// CommitMessage describes the change for a git commit of it, with the loop, the rewrite and the benchmark numbers
+func (lp LoopPatch) CommitMessage(sessionId string) string {
+	benchmarks := "not run"
+	if lp.Speedup > 0 {
+		benchmarks = lp.improvement()
+	}
+	return fmt.Sprintf("Make the loop at %s:%d concurrent\n\nStrategy: %s\nBenchmarks: %s\nSession: %s\n",
+		lp.File, lp.Line, StrategyPerIteration, benchmarks, sessionId)
+}
+
+func (lp LoopPatch) improvement() string {
+	return fmt.Sprintf("%s -> %s (%.2fx)", FormatNsPerOp(lp.Before), FormatNsPerOp(lp.After), lp.Speedup)
+}
+
+// SpliceChangedDecls gives src with the declarations that differ in file, the rewritten version of it, replaced by
+// their formatted source, so the rest of src keeps its own formatting. The imports are taken as one declaration
+// It fails if the declarations besides the imports cannot be paired up in order
+func SpliceChangedDecls(src string, fset *token.FileSet, file *ast.File) (string, error) {
+	srcSet := token.NewFileSet()
+	orig, err := parser.ParseFile(srcSet, "", src, parser.ParseComments)
+	if err != nil {
+		return "", err
+	}
+	origImports, origDecls := splitImportDecls(orig.Decls)
+	newImports, newDecls := splitImportDecls(file.Decls)
+	if len(origDecls) != len(newDecls) {
+		return "", fmt.Errorf("the file has %d declarations besides its imports, and its rewritten version %d", len(origDecls), len(newDecls))
+	}
+	offset := func(pos token.Pos) int {
+		return srcSet.Position(pos).Offset
+	}
+
+	// the imports come before every other declaration, so the edits are in the order of their offsets
+	type edit struct {
+		start, end int
+		text       string
+	}
+	var edits []edit
+	oldText, err := printDecls(srcSet, orig.Comments, origImports)
+	if err != nil {
+		return "", err
+	}
+	newText, err := printDecls(fset, file.Comments, newImports)
+	if err != nil {
+		return "", err
+	}
+	if oldText != newText {
+		if len(origImports) == 0 {
+			at := offset(orig.Name.End())
+			edits = append(edits, edit{at, at, "\n\n" + newText})
+		} else {
+			edits = append(edits, edit{offset(declStart(origImports[0])), offset(origImports[len(origImports)-1].End()), newText})
+		}
+	}
+	for i, decl := range origDecls {
+		oldText, err := printDecls(srcSet, orig.Comments, origDecls[i:i+1])
+		if err != nil {
+			return "", err
+		}
+		newText, err := printDecls(fset, file.Comments, newDecls[i:i+1])
+		if err != nil {
+			return "", err
+		}
+		if oldText != newText {
+			edits = append(edits, edit{offset(declStart(decl)), offset(decl.End()), newText})
+		}
+	}
+
+	var sb strings.Builder
+	last := 0
+	for _, e := range edits {
+		sb.WriteString(src[last:e.start])
+		sb.WriteString(e.text)
+		last = e.end
+	}
+	sb.WriteString(src[last:])
+	return sb.String(), nil
+}
+
+// splitImportDecls separates the import declarations at the start of a file from the rest
+func splitImportDecls(decls []ast.Decl) ([]ast.Decl, []ast.Decl) {
+	i := 0
+	for i < len(decls) {
+		gen, ok := decls[i].(*ast.GenDecl)
+		if !ok || gen.Tok != token.IMPORT {
+			break
+		}
+		i++
+	}
+	return decls[:i], decls[i:]
+}
+
+// declStart is where the declaration starts in the source, with its doc comment
+func declStart(decl ast.Decl) token.Pos {
+	switch d := decl.(type) {
+	case *ast.FuncDecl:
+		if d.Doc != nil {
+			return d.Doc.Pos()
+		}
+	case *ast.GenDecl:
+		if d.Doc != nil {
+			return d.Doc.Pos()
+		}
+	}
+	return decl.Pos()
+}
+
+// printDecls formats the declarations as gofmt would, with the comments of the file within them, a blank line apart
+func printDecls(fset *token.FileSet, comments []*ast.CommentGroup, decls []ast.Decl) (string, error) {
+	var texts []string
+	for _, decl := range decls {
+		var buf bytes.Buffer
+		err := format.Node(&buf, fset, &printer.CommentedNode{Node: decl, Comments: comments})
+		if err != nil {
+			return "", err
+		}
+		texts = append(texts, buf.String())
+	}
+	return strings.Join(texts, "\n\n"), nil
+}
+
+// FilePatch diffs the file in the project against the final version, heading each hunk with the accepted loops it covers
+// The lines of a loop are those of the version it was changed in, so after earlier changes have moved it a hunk
+// may not be matched to it
+func FilePatch(file string, original string, final string, patches []LoopPatch) string {
+	return UnifiedDiffWithSections("a/"+file, "b/"+file, original, final, func(oldStart int, oldEnd int) string {
+		var sections []string
+		for _, lp := range patches {
+			if lp.File == file && lp.Line >= oldStart && lp.Line <= oldEnd {
+				sections = append(sections, lp.Section())
+			}
+		}
+		return strings.Join(sections, "; ")
+	})
+}
+
+// WriteLoopPatches writes the patches of the file to the PatchFolder of folderPath, numbered by their place in patches
+// so that listing the folder gives the order to apply them in. It gives the paths it wrote
+func WriteLoopPatches(folderPath string, fileName string, patches []LoopPatch) ([]string, error) {
+	var written []string
+	for i, lp := range patches {
+		if lp.File != fileName || lp.Diff == "" {
+			continue
+		}
+		if len(written) == 0 {
+			err := os.MkdirAll(filepath.Join(folderPath, PatchFolder), os.ModePerm)
+			if err != nil {
+				return nil, err
+			}
+		}
+		name := fmt.Sprintf("%03d-%s-%d.patch", i+1, strings.ReplaceAll(filepath.ToSlash(lp.File), "/", "_"), lp.Line)
+		path := filepath.Join(folderPath, PatchFolder, name)
+		err := os.WriteFile(path, []byte(lp.Diff), 0644)
+		if err != nil {
+			return written, err
+		}
+		written = append(written, path)
+	}
+	return written, nil
+}
+
+// WriteSessionPatch writes the diffs of a session's files to one patch, in the order of their names
+func WriteSessionPatch(path string, diffs map[string]string) error {
+	files := make([]string, 0, len(diffs))
+	for file := range diffs {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	var sb strings.Builder
+	for _, file := range files {
+		sb.WriteString(diffs[file])
+	}
+	return os.WriteFile(path, []byte(sb.String()), 0644)
+}
@@ -0,0 +1,155 @@
+package util
+
+import (
+	"go/ast"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// spliceSource has a loop to rewrite in fill, and declarations around it that gofmt would change
+const spliceSource = `package p
+
+%s
+// table   is left as it was written
+var table = map[string]int{"a":1,
+	"bb": 2}
+
+// fill sets every element
+func fill(a []int) {
+	for i := range a {
+		a[i] = i // keep this comment
+	}
+}
+
+func   other( ) int { return len(table) }
+`
+
+func TestSpliceChangedDecls(t *testing.T) {
+	tests := []struct {
+		name    string
+		imports string
+	}{
+		{"no imports", ""},
+		{"one import", "import \"strings\"\n\nvar _ = strings.ToUpper\n"},
+		{"import block", "import (\n\t\"strings\"\n)\n\nvar _ = strings.ToUpper\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := strings.Replace(spliceSource, "%s", tt.imports, 1)
+			fileSet := token.NewFileSet()
+			file, err := parser.ParseFile(fileSet, "p.go", src, parser.ParseComments)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info := &types.Info{Types: make(map[ast.Expr]types.TypeAndValue), Defs: make(map[*ast.Ident]types.Object), Uses: make(map[*ast.Ident]types.Object)}
+			config := &types.Config{Importer: importer.ForCompiler(fileSet, "source", nil)}
+			if _, err := config.Check("p", fileSet, []*ast.File{file}, info); err != nil {
+				t.Fatal(err)
+			}
+			MakeLoopConcurrent(file, fileSet, 10+strings.Count(tt.imports, "\n"), info)
+
+			got, err := SpliceChangedDecls(src, fileSet, file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, kept := range []string{"// table   is left as it was written\nvar table = map[string]int{\"a\":1,\n", "func   other( ) int { return len(table) }\n"} {
+				if !strings.Contains(got, kept) {
+					t.Errorf("the unchanged declaration %q was reformatted:\n%s", kept, got)
+				}
+			}
+			for _, changed := range []string{"\"sync\"", "sync.WaitGroup", "// keep this comment", "// fill sets every element\nfunc fill"} {
+				if !strings.Contains(got, changed) {
+					t.Errorf("the result does not have %q:\n%s", changed, got)
+				}
+			}
+			if _, err := format.Source([]byte(got)); err != nil {
+				t.Errorf("the result does not parse: %s\n%s", err, got)
+			}
+		})
+	}
+}
+
+func TestSpliceChangedDeclsUnchanged(t *testing.T) {
+	src := strings.Replace(spliceSource, "%s", "", 1)
+	fileSet := token.NewFileSet()
+	file, err := parser.ParseFile(fileSet, "p.go", src, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := SpliceChangedDecls(src, fileSet, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != src {
+		t.Errorf("an unchanged file came back as:\n%s", got)
+	}
+
+	file.Decls = file.Decls[1:]
+	if _, err := SpliceChangedDecls(src, fileSet, file); err == nil {
+		t.Errorf("a file with a declaration removed gave no error")
+	}
+}
+
+func TestUnifiedDiffWithSections(t *testing.T) {
+	old := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\n"
+	tests := []struct {
+		name string
+		new  string
+		want string
+	}{
+		{"same", old, ""},
+		{"one line changed", strings.Replace(old, "f\n", "F\n", 1),
+			"--- a/x.go\n+++ b/x.go\n@@ -3,7 +3,7 @@ 3-9\n c\n d\n e\n-f\n+F\n g\n h\n i\n"},
+		{"line added at the start", "z\n" + old,
+			"--- a/x.go\n+++ b/x.go\n@@ -1,3 +1,4 @@ 1-3\n+z\n a\n b\n c\n"},
+		{"line removed at the end", strings.TrimSuffix(old, "l\n"),
+			"--- a/x.go\n+++ b/x.go\n@@ -9,4 +9,3 @@ 9-12\n i\n j\n k\n-l\n"},
+		{"two hunks", strings.Replace(strings.Replace(old, "a\n", "A\n", 1), "l\n", "L\n", 1),
+			"--- a/x.go\n+++ b/x.go\n@@ -1,4 +1,4 @@ 1-4\n-a\n+A\n b\n c\n d\n@@ -9,4 +9,4 @@ 9-12\n i\n j\n k\n-l\n+L\n"},
+		{"close changes in one hunk", strings.Replace(strings.Replace(old, "c\n", "C\n", 1), "h\n", "H\n", 1),
+			"--- a/x.go\n+++ b/x.go\n@@ -1,11 +1,11 @@ 1-11\n a\n b\n-c\n+C\n d\n e\n f\n g\n-h\n+H\n i\n j\n k\n"},
+		{"no newline at the end", strings.TrimSuffix(old, "\n"),
+			"--- a/x.go\n+++ b/x.go\n@@ -9,4 +9,4 @@ 9-12\n i\n j\n k\n-l\n+l\n\\ No newline at end of file\n"},
+	}
+	section := func(oldStart int, oldEnd int) string {
+		return strconv.Itoa(oldStart) + "-" + strconv.Itoa(oldEnd)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := UnifiedDiffWithSections("a/x.go", "b/x.go", old, tt.new, section); got != tt.want {
+				t.Errorf("UnifiedDiffWithSections() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilePatch(t *testing.T) {
+	// f's loop is on line 4, and g's on line 13 once f's is changed, far enough apart for hunks of their own
+	original := "package p\n\nfunc f() {\n\tfor {\n\t}\n}\n\nvar (\n\ta = 1\n\tb = 2\n)\n\nfunc g() {\n\tfor {\n\t}\n}\n"
+	first := NewLoopPatch("p.go", 4, original, strings.Replace(original, "\tfor {\n\t}\n}\n\nvar", "\tgo f()\n}\n\nvar", 1), 200, 100, 2)
+	second := NewLoopPatch("p.go", 13, first.Source, strings.Replace(first.Source, "\tfor {\n\t}\n", "\tgo g()\n", 1), 100, 80, 1.25)
+	other := NewLoopPatch("q.go", 9, original, original+"\n", 0, 0, 0)
+	patches := []LoopPatch{first, second, other}
+
+	if !strings.Contains(first.Diff, "@@ -1,8 +1,7 @@ loop p.go:4, 200ns/op -> 100ns/op (2.00x)\n") {
+		t.Errorf("the loop's patch is not headed with the loop:\n%s", first.Diff)
+	}
+	got := FilePatch("p.go", original, second.Source, patches)
+	for _, header := range []string{"@@ loop p.go:4, 200ns/op -> 100ns/op (2.00x)\n", "@@ loop p.go:13, 100ns/op -> 80ns/op (1.25x)\n"} {
+		if !strings.Contains(got, header) {
+			t.Errorf("the file's patch has no hunk headed %q:\n%s", strings.TrimSpace(header), got)
+		}
+	}
+	if strings.Contains(got, "q.go") {
+		t.Errorf("the file's patch names a loop of another file:\n%s", got)
+	}
+	if FilePatch("p.go", original, original, patches) != "" {
+		t.Errorf("an unchanged file gave a patch")
+	}
+}
@@ -4,31 +4,31 @@ import (
 	"fmt"
 	"github.com/google/pprof/profile"
 	"go/token"
+	"io"
 	"os"
 	"perfactor/graph"
 	"sort"
 	"time"
 )
 
-func GetProfileDataFromFile(filePath string) *profile.Profile {
+func GetProfileDataFromFile(filePath string) (*profile.Profile, error) {
 
 	// read the profile data
 	rawProfile, err := os.Open(filePath)
 	if err != nil {
-		fmt.Println("Error opening profiling data: " + err.Error())
-		return nil
+		return nil, fmt.Errorf("could not open the profiling data: %w", err)
 	}
 	prof, err := profile.Parse(rawProfile)
+	_ = rawProfile.Close()
 	if err != nil {
-		fmt.Println("Error parsing profiling data: " + err.Error())
-		return nil
+		return nil, fmt.Errorf("could not parse the profiling data in %s: %w", filePath, err)
 	}
 
 	// find the for loops that are the most expensive
-	return prof
+	return prof, nil
 }
 
-func FilterLoopsUsingProfileData(safeLoops []Loop, sorted LoopInfoArray, threshold int64) LoopInfoArray {
+func FilterLoopsUsingProfileData(safeLoops []Loop, sorted LoopInfoArray, threshold int64, out io.Writer) LoopInfoArray {
 	output := make(LoopInfoArray, 0)
 	for _, lt := range sorted {
 		loop, t := lt.Loop, lt.Time
@@ -38,10 +38,10 @@ func FilterLoopsUsingProfileData(safeLoops []Loop, sorted LoopInfoArray, thresho
 		}
 		if t < threshold {
 			// if the Time is less than the threshold, then the Loop is not worth making concurrent
-			fmt.Printf("Loop at line %d has a total Time of %s, which is less than the threshold of %s\n", loop.Line, time.Duration(t), time.Duration(threshold))
+			_, _ = fmt.Fprintf(out, "Loop at line %d has a total Time of %s, which is less than the threshold of %s\n", loop.Line, time.Duration(t), time.Duration(threshold))
 			continue
 		} else {
-			fmt.Printf("Loop at line %d has a total Time of %s, which is greater than the threshold of %s\n", loop.Line, time.Duration(t), time.Duration(threshold))
+			_, _ = fmt.Fprintf(out, "Loop at line %d has a total Time of %s, which is greater than the threshold of %s\n", loop.Line, time.Duration(t), time.Duration(threshold))
 		}
 		//println("Loop at line ", fset.Position(loop.Pos()).Line, " has a total Time of ", time)
 		output = append(output, lt)
@@ -58,26 +58,29 @@ func contains(loops []Loop, pos token.Pos) bool {
 	return false
 }
 
-func SortLoopsUsingProfileData(prof *profile.Profile, forLoops []Loop, fset *token.FileSet) LoopInfoArray {
-	totalCumulativeTime := make(LoopInfoArray, len(forLoops))
-
-	// find the gr nodes corresponding to the for loops
+// SortLoopsUsingProfileData ranks the loops of the file by the CPU time of the samples in them
+// Loops without samples are reported with the reason, since a loop missing from the profile is not the same as a cold one
+func SortLoopsUsingProfileData(prof *profile.Profile, forLoops []Loop, file graph.File, out io.Writer) LoopInfoArray {
 	// look through the profile data and find the for loops that are the most expensive
-	gr := graph.GetGraphFromProfile(prof)
+	times, matches := AttributeSamples(prof, forLoops, file)
+	return sortLoops(forLoops, file.Path, times, matches, out)
+}
 
+// SortLoopsUsingLabels ranks the loops like SortLoopsUsingProfileData, but by the labels of the loops that were wrapped
+// in pprof.Do in the profiled code, which count everything the loop calls, exactly
+func SortLoopsUsingLabels(prof *profile.Profile, forLoops []Loop, file graph.File, wrapped map[int]bool, out io.Writer) LoopInfoArray {
+	times, matches := AttributeLabels(prof, forLoops, file, wrapped)
+	return sortLoops(forLoops, file.Path, times, matches, out)
+}
+
+func sortLoops(forLoops []Loop, fileName string, times []int64, matches []LoopMatch, out io.Writer) LoopInfoArray {
+	totalCumulativeTime := make(LoopInfoArray, len(forLoops))
 	for i, loop := range forLoops {
 		totalCumulativeTime[i].Loop = loop
-		// get the line numbers of the Loop
-		startLine := fset.Position(loop.Pos).Line
-		endLine := fset.Position(loop.End).Line
-		// find the node in the gr with this line number
-		nodes := gr.FindNodesByLine(startLine, endLine)
-		for _, node := range nodes {
-			// we have the node - now we need to get the performance data for it
-			//println("Node in Loop at line ", startLine, " has a total Time of ", node.Cum, " and a self Time of ", node.Flat)
-			//println("The node has the name ", node.Info.Name)
-			// add the cumulative Time to the total cumulative Time for this Loop
-			totalCumulativeTime[i].Time += node.Cum
+		totalCumulativeTime[i].Time = times[i]
+		totalCumulativeTime[i].Match = matches[i]
+		if matches[i] != LoopSampled {
+			_, _ = fmt.Fprintf(out, "Loop at line %d of %s was not matched in the profile: %s\n", loop.Line, fileName, matches[i])
 		}
 	}
 	sort.Sort(totalCumulativeTime)
@@ -0,0 +1,26 @@
+package util
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestFilterLoopsUsingProfileData(t *testing.T) {
+	hot, cold, unsafe := Loop{Pos: 1, Line: 3}, Loop{Pos: 2, Line: 8}, Loop{Pos: 3, Line: 12}
+	sorted := LoopInfoArray{{Loop: unsafe, Time: 900}, {Loop: hot, Time: 500}, {Loop: cold, Time: 10}}
+
+	var out bytes.Buffer
+	got := FilterLoopsUsingProfileData([]Loop{hot, cold}, sorted, 100, &out)
+	if len(got) != 1 || got[0].Loop.Line != hot.Line {
+		t.Errorf("kept %v, want only the loop at line %d", got, hot.Line)
+	}
+	for _, line := range []string{"Loop at line 3 has a total Time of 500ns, which is greater", "Loop at line 8 has a total Time of 10ns, which is less"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("the writer has no %q:\n%s", line, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "line 12") {
+		t.Errorf("the writer names a loop that is not safe to refactor:\n%s", out.String())
+	}
+}
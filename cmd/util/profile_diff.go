@@ -0,0 +1,181 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"perfactor/graph"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"golang.org/x/tools/benchmark/parse"
+)
+
+// diffFunctionCount is how many of the functions whose time changed the most are listed in the report
+const diffFunctionCount = 10
+
+// ProfileDiff is where CPU time moved between the profile of the original code and that of the final version
+type ProfileDiff struct {
+	// Loops pairs the loops of the file before and after, which the rewrite keeps in the same order
+	Loops     []LoopDelta
+	Functions []FunctionDelta
+	// Runtime is the change in the flat time of the runtime and sync packages, where scheduling overhead shows up
+	Runtime int64
+	// Base and Final are the total CPU times of the two profiles, after the base is scaled
+	Base  int64
+	Final int64
+}
+
+// LoopDelta is the CPU time of a loop, and its closures, before and after
+// The goroutines a loop starts do not have the loop's callers on their stacks, so an outer loop loses their time
+type LoopDelta struct {
+	Loop      Loop
+	FinalLine int
+	Base      int64
+	Final     int64
+}
+
+// FunctionDelta is the change in a function's flat time
+type FunctionDelta struct {
+	Name  string
+	Delta int64
+}
+
+// DiffProfiles compares the final profile with the base, scaled by baseScale first so they cover the same work
+// The functions are compared on the graph of the two merged with the base negated, as pprof's -diff_base does
+// The loops' lines move when the code is rewritten, so they are attributed in each version on its own and paired in order
+func DiffProfiles(base *profile.Profile, final *profile.Profile, baseScale float64, baseLoops []Loop, finalLoops []Loop, file graph.File) (ProfileDiff, error) {
+	var d ProfileDiff
+	scaledBase := base.Copy()
+	scaledBase.Scale(baseScale)
+	negatedBase := scaledBase.Copy()
+	negatedBase.Scale(-1)
+	merged, err := profile.Merge([]*profile.Profile{negatedBase, final})
+	if err != nil {
+		return d, fmt.Errorf("could not merge the profiles: %w", err)
+	}
+	_, d.Base = FileSampleTime(scaledBase, graph.File{})
+	_, d.Final = FileSampleTime(final, graph.File{})
+
+	deltas := make(map[string]int64)
+	for _, n := range graph.GetDiffGraphFromProfile(merged).Nodes {
+		if n.Info.Name == "" || n.Flat == 0 {
+			continue
+		}
+		deltas[n.Info.Name] += n.Flat
+		if pkg := graph.PackagePath(n.Info.Name); pkg == "runtime" || pkg == "sync" {
+			d.Runtime += n.Flat
+		}
+	}
+	for name, delta := range deltas {
+		if delta != 0 {
+			d.Functions = append(d.Functions, FunctionDelta{Name: name, Delta: delta})
+		}
+	}
+	sort.Slice(d.Functions, func(i, j int) bool {
+		if abs(d.Functions[i].Delta) != abs(d.Functions[j].Delta) {
+			return abs(d.Functions[i].Delta) > abs(d.Functions[j].Delta)
+		}
+		return d.Functions[i].Name < d.Functions[j].Name
+	})
+	if len(d.Functions) > diffFunctionCount {
+		d.Functions = d.Functions[:diffFunctionCount]
+	}
+
+	if len(baseLoops) == len(finalLoops) {
+		baseTimes, _ := AttributeSamples(scaledBase, baseLoops, file)
+		finalTimes, _ := AttributeSamples(final, finalLoops, file)
+		for i := range baseLoops {
+			d.Loops = append(d.Loops, LoopDelta{Loop: baseLoops[i], FinalLine: finalLoops[i].Line, Base: baseTimes[i], Final: finalTimes[i]})
+		}
+	}
+	return d, nil
+}
+
+// WorkScale is the factor the base profile is scaled by to cover the work of the final one, from the benchmark output
+// of the two profiled runs. The benchmarks run for a set time, so a faster version runs more ops; the ops of each
+// benchmark are costed at its base ns/op, so that it counts by its time rather than by how many ops it ran, and weighted
+// as MergeProfiles weights its samples. It gives 0 if the outputs have no benchmark in common
+func WorkScale(baseOutput string, finalOutput string, weights map[string]float64) float64 {
+	baseOps, finalOps := benchmarkOps(baseOutput), benchmarkOps(finalOutput)
+	var base, final float64
+	for name, ns := range BenchmarkNsPerOp(baseOutput) {
+		if ns <= 0 || baseOps[name] == 0 || finalOps[name] == 0 {
+			continue
+		}
+		weight := 1.0
+		if w, ok := weights[name]; ok {
+			weight = w
+		}
+		base += weight * baseOps[name] * ns
+		final += weight * finalOps[name] * ns
+	}
+	if base == 0 {
+		return 0
+	}
+	return final / base
+}
+
+// benchmarkOps sums the iterations of the timed runs of each benchmark in the output, keyed as BenchmarkNsPerOp keys them
+func benchmarkOps(output string) map[string]float64 {
+	set, err := parse.ParseSet(strings.NewReader(output))
+	if err != nil {
+		return nil
+	}
+	ops := make(map[string]float64, len(set))
+	for name, runs := range set {
+		for _, run := range runs {
+			if run.Measured&parse.NsPerOp != 0 {
+				ops[trimProcs(name)] += float64(run.N)
+			}
+		}
+	}
+	return ops
+}
+
+// Write reports the diff, with the loops in the order of the file and the functions by the size of their change
+func (d ProfileDiff) Write(out io.Writer, fileName string) {
+	_, _ = fmt.Fprintf(out, "Profile diff against the original, in CPU time for the same work: %s before, %s after (%s)\n",
+		roundDuration(d.Base), roundDuration(d.Final), signedDuration(d.Final-d.Base))
+	if len(d.Loops) > 0 {
+		_, _ = fmt.Fprintf(out, "  Loops in %s:\n", fileName)
+		for _, l := range d.Loops {
+			if l.Base == 0 && l.Final == 0 {
+				continue
+			}
+			moved := ""
+			if l.FinalLine != l.Loop.Line {
+				moved = fmt.Sprintf(" (now line %d)", l.FinalLine)
+			}
+			_, _ = fmt.Fprintf(out, "    line %d%s in %s: %s -> %s (%s)\n", l.Loop.Line, moved, l.Loop.Func,
+				roundDuration(l.Base), roundDuration(l.Final), signedDuration(l.Final-l.Base))
+		}
+	} else {
+		_, _ = fmt.Fprintf(out, "  The loops of %s could not be paired up, so they are not compared\n", fileName)
+	}
+	_, _ = fmt.Fprintf(out, "  Functions, by flat time:\n")
+	for _, fn := range d.Functions {
+		_, _ = fmt.Fprintf(out, "    %12s %s\n", signedDuration(fn.Delta), fn.Name)
+	}
+	_, _ = fmt.Fprintf(out, "  Runtime and sync, where scheduling overhead shows up: %s\n", signedDuration(d.Runtime))
+}
+
+// the base is scaled, so its times are rounded to keep the report readable
+func roundDuration(d int64) time.Duration {
+	return time.Duration(d).Round(time.Microsecond)
+}
+
+func signedDuration(d int64) string {
+	if d > 0 {
+		return "+" + roundDuration(d).String()
+	}
+	return roundDuration(d).String()
+}
+
+func abs(i int64) int64 {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
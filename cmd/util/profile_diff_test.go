@@ -0,0 +1,118 @@
+package util
+
+import (
+	"bytes"
+	"perfactor/graph"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestWorkScale(t *testing.T) {
+	base := "BenchmarkA-8 \t    1000\t      2000 ns/op\nBenchmarkB-8 \t      10\t    100000 ns/op\n"
+	final := "BenchmarkA-8 \t    2000\t      1000 ns/op\nBenchmarkB-8 \t      30\t     33000 ns/op\n"
+	tests := []struct {
+		name    string
+		final   string
+		weights map[string]float64
+		want    float64
+	}{
+		// A ran twice the ops and B three times, and both took as long in the base: 4ms+3ms of work against 2ms+1ms
+		{"no weights", final, nil, 7.0 / 3},
+		{"one left out", final, map[string]float64{"BenchmarkB": 0}, 2},
+		{"one weighted twice", final, map[string]float64{"BenchmarkB": 2}, 10.0 / 4},
+		{"two counts", final + "BenchmarkA-8 \t    2000\t      1000 ns/op\n", map[string]float64{"BenchmarkB": 0}, 4},
+		{"nothing in common", "BenchmarkC-8 \t    1000\t      2000 ns/op\n", nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := WorkScale(base, tt.final, tt.weights); got < tt.want-1e-9 || got > tt.want+1e-9 {
+				t.Errorf("WorkScale() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffProfiles(t *testing.T) {
+	cpuProfile := func(samples map[*profile.Location]int64) *profile.Profile {
+		prof := &profile.Profile{
+			SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}, {Type: "cpu", Unit: "nanoseconds"}},
+			PeriodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+			Period:     1,
+		}
+		for location, cpu := range samples {
+			for _, line := range location.Line {
+				prof.Function = append(prof.Function, line.Function)
+			}
+			prof.Location = append(prof.Location, location)
+			prof.Sample = append(prof.Sample, &profile.Sample{Location: []*profile.Location{location}, Value: []int64{cpu, cpu}})
+		}
+		return prof
+	}
+	frame := func(id uint64, name string, filename string, line int64) *profile.Location {
+		return &profile.Location{ID: id, Line: []profile.Line{{Function: &profile.Function{ID: id, Name: name, Filename: filename}, Line: line}}}
+	}
+	// the loop of work moves from line 11 to 12, and its body into the closure the goroutines run
+	base := cpuProfile(map[*profile.Location]int64{
+		frame(1, "example.com/m/pkg.work", "/src/pkg/work.go", 12):   800000,
+		frame(2, "example.com/m/pkg.helper", "/src/pkg/work.go", 30): 200000,
+	})
+	final := cpuProfile(map[*profile.Location]int64{
+		frame(1, "example.com/m/pkg.work.func1", "/src/pkg/work.go", 14): 300000,
+		frame(2, "example.com/m/pkg.helper", "/src/pkg/work.go", 30):     200000,
+		frame(3, "runtime.schedule", "/go/src/runtime/proc.go", 4000):    100000,
+	})
+	baseLoops := []Loop{{Line: 11, EndLine: 13, Func: "work"}}
+	finalLoops := []Loop{{Line: 12, EndLine: 18, Func: "work"}}
+	file := graph.File{Path: "pkg/work.go", Package: "example.com/m/pkg"}
+
+	// the final version ran twice the work
+	d, err := DiffProfiles(base, final, 2, baseLoops, finalLoops, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Base != 2000000 || d.Final != 600000 {
+		t.Errorf("Base, Final = %d, %d, want 2000000, 600000", d.Base, d.Final)
+	}
+	if len(d.Loops) != 1 || d.Loops[0].Base != 1600000 || d.Loops[0].Final != 300000 || d.Loops[0].FinalLine != 12 {
+		t.Errorf("Loops = %+v, want line 11 now at 12 going from 1.6ms to 300µs", d.Loops)
+	}
+	if d.Runtime != 100000 {
+		t.Errorf("Runtime = %d, want 100000", d.Runtime)
+	}
+	want := []FunctionDelta{
+		{"example.com/m/pkg.work", -1600000},
+		{"example.com/m/pkg.work.func1", 300000},
+		{"example.com/m/pkg.helper", -200000},
+		{"runtime.schedule", 100000},
+	}
+	if len(d.Functions) != len(want) {
+		t.Fatalf("Functions = %v, want %v", d.Functions, want)
+	}
+	for i := range want {
+		if d.Functions[i] != want[i] {
+			t.Errorf("Functions[%d] = %+v, want %+v", i, d.Functions[i], want[i])
+		}
+	}
+	if base.Sample[0].Value[1]+base.Sample[1].Value[1] != 1000000 {
+		t.Errorf("the base profile was changed")
+	}
+
+	var out bytes.Buffer
+	d.Write(&out, "pkg/work.go")
+	for _, line := range []string{"2ms before, 600µs after (-1.4ms)", "line 11 (now line 12) in work: 1.6ms -> 300µs (-1.3ms)", "-1.6ms example.com/m/pkg.work\n", "Runtime and sync, where scheduling overhead shows up: +100µs"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("the report has no %q:\n%s", line, out.String())
+		}
+	}
+
+	// loops that cannot be paired are left out rather than compared with the wrong ones
+	d, err = DiffProfiles(base, final, 2, baseLoops, append(finalLoops, Loop{Line: 20, EndLine: 22, Func: "work"}), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Loops) != 0 {
+		t.Errorf("Loops = %+v, want none", d.Loops)
+	}
+}
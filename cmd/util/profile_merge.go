@@ -0,0 +1,141 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"perfactor/graph"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// ProfileRun is the CPU profile of one run of one benchmark
+type ProfileRun struct {
+	Benchmark string
+	Path      string
+	Profile   *profile.Profile
+}
+
+// MatchingBenchmarks lists the benchmarks of the package in folderPath whose names match the -bench pattern
+func MatchingBenchmarks(ctx context.Context, timeout time.Duration, folderPath string, pattern string) ([]string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid benchmark pattern %q: %w", pattern, err)
+	}
+	names, err := ListBenchmarks(ctx, timeout, folderPath)
+	if err != nil {
+		return nil, err
+	}
+	var matching []string
+	for _, name := range names {
+		if re.MatchString(name) {
+			matching = append(matching, name)
+		}
+	}
+	return matching, nil
+}
+
+// ProfileBenchmarks runs each benchmark count times, each run in its own process with its own profile,
+// so that no profile overwrites another. The outputs of the runs are joined into the one result
+// If a run fails, or its profile cannot be read, its result is returned along with the profiles taken before it
+func ProfileBenchmarks(ctx context.Context, timeout time.Duration, flags string, id string, filename string, folderPath string, benchNames []string, count int) ([]ProfileRun, TestResult) {
+	var runs []ProfileRun
+	var combined TestResult
+	var output strings.Builder
+	for _, name := range benchNames {
+		for i := 0; i < count; i++ {
+			profileName := fmt.Sprintf("cpu-%s-%d.pprof", name, i)
+			result := RunBenchmarkProfiled(ctx, timeout, flags, BenchmarkPattern([]string{name}), id, filename, folderPath, 1, profileName)
+			output.WriteString(result.Output)
+			if !result.Ok() || result.NoTestFiles {
+				result.Output = output.String()
+				return runs, result
+			}
+			combined.Events = append(combined.Events, result.Events...)
+			combined.Passed = append(combined.Passed, result.Passed...)
+			combined.Elapsed += result.Elapsed
+
+			prof, err := GetProfileDataFromFile(folderPath + profileName)
+			if err != nil {
+				combined.Err = err
+				combined.Output = output.String()
+				return runs, combined
+			}
+			runs = append(runs, ProfileRun{Benchmark: name, Path: folderPath + profileName, Profile: prof})
+		}
+	}
+	combined.Output = output.String()
+	return runs, combined
+}
+
+// MergeProfiles combines the profiles into one, with the samples of each benchmark scaled by its weight
+// Benchmarks without a weight count once; a weight of 0 leaves the benchmark out of the ranking
+// The duration of each profile is scaled with its samples, so that the share of the merged duration a loop takes,
+// which the threshold is applied to, is the same as the share of the weighted samples
+func MergeProfiles(runs []ProfileRun, weights map[string]float64) (*profile.Profile, error) {
+	profiles := make([]*profile.Profile, 0, len(runs))
+	for _, run := range runs {
+		prof := run.Profile
+		if weight, ok := weights[run.Benchmark]; ok && weight != 1 {
+			prof = prof.Copy()
+			prof.Scale(weight)
+			prof.DurationNanos = int64(float64(prof.DurationNanos) * weight)
+		}
+		profiles = append(profiles, prof)
+	}
+	if len(profiles) == 0 {
+		return nil, errors.New("no profiles to merge")
+	}
+	return profile.Merge(profiles)
+}
+
+// LoadProfiles reads CPU profiles captured elsewhere, such as in production or a module's default.pgo, and merges them
+// A relative path that does not exist from the working directory is looked up in projectPath instead
+func LoadProfiles(paths []string, projectPath string) (*profile.Profile, error) {
+	profiles := make([]*profile.Profile, 0, len(paths))
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil && !filepath.IsAbs(path) {
+			path = filepath.Join(projectPath, path)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		prof, err := profile.Parse(file)
+		_ = file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s: %w", path, err)
+		}
+		if !isCPUProfile(prof) {
+			return nil, fmt.Errorf("%s is not a CPU profile", path)
+		}
+		profiles = append(profiles, prof)
+	}
+	if len(profiles) == 0 {
+		return nil, errors.New("no profiles given")
+	}
+	return profile.Merge(profiles)
+}
+
+func isCPUProfile(prof *profile.Profile) bool {
+	for _, sampleType := range prof.SampleType {
+		if sampleType.Type == "cpu" {
+			return true
+		}
+	}
+	return false
+}
+
+// ProfileTotal is the length of time the profile covers, or if it does not say, the summed CPU time of its samples
+func ProfileTotal(prof *profile.Profile) int64 {
+	if prof.DurationNanos > 0 {
+		return prof.DurationNanos
+	}
+	_, total := FileSampleTime(prof, graph.File{})
+	return total
+}
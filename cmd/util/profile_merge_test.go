@@ -0,0 +1,56 @@
+package util
+
+import (
+	"perfactor/graph"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestMergeProfiles(t *testing.T) {
+	fn := &profile.Function{ID: 1, Name: "example.com/m.work", Filename: "/src/work.go"}
+	run := func(benchmark string, cpu int64, duration int64) ProfileRun {
+		location := &profile.Location{ID: 1, Line: []profile.Line{{Function: fn, Line: 10}}}
+		return ProfileRun{Benchmark: benchmark, Profile: &profile.Profile{
+			SampleType:    []*profile.ValueType{{Type: "samples", Unit: "count"}, {Type: "cpu", Unit: "nanoseconds"}},
+			PeriodType:    &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+			Period:        10000000,
+			DurationNanos: duration,
+			Function:      []*profile.Function{fn},
+			Location:      []*profile.Location{location},
+			Sample:        []*profile.Sample{{Location: []*profile.Location{location}, Value: []int64{cpu / 10000000, cpu}}},
+		}}
+	}
+	runs := []ProfileRun{run("BenchmarkA", 400, 1000), run("BenchmarkB", 200, 2000)}
+	tests := []struct {
+		name     string
+		weights  map[string]float64
+		cpu      int64
+		duration int64
+	}{
+		{"no weights", nil, 600, 3000},
+		{"one weighted twice", map[string]float64{"BenchmarkA": 2}, 1000, 4000},
+		{"one left out", map[string]float64{"BenchmarkB": 0}, 400, 1000},
+		{"fractional weight", map[string]float64{"BenchmarkA": 0.5, "BenchmarkB": 1.5}, 500, 3500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged, err := MergeProfiles(runs, tt.weights)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, cpu := FileSampleTime(merged, graph.File{}); cpu != tt.cpu {
+				t.Errorf("merged CPU time = %d, want %d", cpu, tt.cpu)
+			}
+			if merged.DurationNanos != tt.duration {
+				t.Errorf("DurationNanos = %d, want %d", merged.DurationNanos, tt.duration)
+			}
+			if runs[0].Profile.DurationNanos != 1000 || runs[0].Profile.Sample[0].Value[1] != 400 {
+				t.Errorf("the runs' own profiles were changed")
+			}
+		})
+	}
+	if _, err := MergeProfiles(nil, nil); err == nil {
+		t.Errorf("merging no profiles gave no error")
+	}
+}
@@ -0,0 +1,78 @@
+package util
+
+import (
+	"strconv"
+	"strings"
+)
+
+const raceHeader = "WARNING: DATA RACE"
+const raceSeparator = "=================="
+
+// RaceReport is one report written by the race detector, from its "WARNING: DATA RACE" header to the closing separator
+type RaceReport struct {
+	Text   string
+	Frames []StackFrame
+}
+
+// StackFrame is a single function call in a stack trace
+type StackFrame struct {
+	Function string
+	File     string
+	Line     int
+}
+
+// ParseRaceReports finds every data race reported in the output of a go test -race run
+func ParseRaceReports(output string) []RaceReport {
+	var reports []RaceReport
+	var current []string
+	inReport := false
+
+	for _, line := range strings.Split(output, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == raceHeader {
+			inReport = true
+			current = []string{trimmed}
+			continue
+		}
+		if !inReport {
+			continue
+		}
+		if trimmed == raceSeparator {
+			reports = append(reports, RaceReport{Text: strings.Join(current, "\n"), Frames: parseStackFrames(current)})
+			inReport = false
+			continue
+		}
+		current = append(current, line)
+	}
+	if inReport {
+		// the output was cut off before the report ended; keep what we have
+		reports = append(reports, RaceReport{Text: strings.Join(current, "\n"), Frames: parseStackFrames(current)})
+	}
+	return reports
+}
+
+// parseStackFrames reads the function name and file:line pairs of a stack trace
+// Each frame is a function line, followed by an indented "file:line +0xoffset" line
+func parseStackFrames(lines []string) []StackFrame {
+	var frames []StackFrame
+	for i := 1; i < len(lines); i++ {
+		location := strings.TrimSpace(lines[i])
+		if !strings.HasPrefix(lines[i], "      ") || !strings.Contains(location, ".go:") {
+			continue
+		}
+		if offset := strings.LastIndex(location, " +0x"); offset != -1 {
+			location = location[:offset]
+		}
+		colon := strings.LastIndex(location, ":")
+		lineNum, err := strconv.Atoi(location[colon+1:])
+		if err != nil {
+			continue
+		}
+		function := strings.TrimSpace(lines[i-1])
+		if paren := strings.LastIndex(function, "("); paren != -1 {
+			function = function[:paren]
+		}
+		frames = append(frames, StackFrame{Function: function, File: location[:colon], Line: lineNum})
+	}
+	return frames
+}
@@ -0,0 +1,82 @@
+package util
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// raceOutput is a report written by go test -race, for two goroutines incrementing the same variable
+const raceOutput = `==================
+WARNING: DATA RACE
+Read at 0x00c0000182a8 by goroutine 8:
+  rc.TestRace.func1()
+      /src/rc/r_test.go:15 +0x7b
+
+Previous write at 0x00c0000182a8 by goroutine 9:
+  rc.TestRace.func1()
+      /src/rc/r_test.go:15 +0x8d
+
+Goroutine 8 (running) created at:
+  rc.TestRace()
+      /src/rc/r_test.go:13 +0x78
+  testing.tRunner()
+      /go/src/testing/testing.go:2193 +0x21c
+  testing.(*T).Run.gowrap1()
+      /go/src/testing/testing.go:2258 +0x38
+
+Goroutine 9 (finished) created at:
+  rc.TestRace()
+      /src/rc/r_test.go:13 +0x78
+  testing.tRunner()
+      /go/src/testing/testing.go:2193 +0x21c
+  testing.(*T).Run.gowrap1()
+      /go/src/testing/testing.go:2258 +0x38
+==================
+`
+
+func TestParseRaceReports(t *testing.T) {
+	closure := []StackFrame{{Function: "rc.TestRace.func1", File: "/src/rc/r_test.go", Line: 15}}
+	tests := []struct {
+		name    string
+		output  string
+		reports int
+	}{
+		{"no race", "=== RUN   TestA\n--- PASS: TestA (0.00s)\nPASS\n", 0},
+		{"one race", "=== RUN   TestRace\n" + raceOutput + "--- FAIL: TestRace (0.00s)\n", 1},
+		{"two races", raceOutput + raceOutput, 2},
+		{"cut off before the separator", raceOutput[:strings.Index(raceOutput, "\nGoroutine 8")], 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reports := ParseRaceReports(tt.output)
+			if len(reports) != tt.reports {
+				t.Fatalf("got %d reports, want %d", len(reports), tt.reports)
+			}
+			for _, report := range reports {
+				if !strings.HasPrefix(report.Text, raceHeader) {
+					t.Errorf("report starts with %q", strings.SplitN(report.Text, "\n", 2)[0])
+				}
+				// the accesses come first, then the creation of the goroutines
+				if !reflect.DeepEqual(report.Frames[:2], append(closure, closure...)) {
+					t.Errorf("accesses at %v, want %v twice", report.Frames[:2], closure)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRaceReportsCreationFrames(t *testing.T) {
+	reports := ParseRaceReports(raceOutput)
+	if len(reports) != 1 {
+		t.Fatalf("got %d reports, want 1", len(reports))
+	}
+	frames := reports[0].Frames
+	if len(frames) != 8 {
+		t.Fatalf("got %d frames, want 8: %v", len(frames), frames)
+	}
+	want := StackFrame{Function: "testing.(*T).Run.gowrap1", File: "/go/src/testing/testing.go", Line: 2258}
+	if frames[4] != want {
+		t.Errorf("frame 4 = %v, want %v", frames[4], want)
+	}
+}
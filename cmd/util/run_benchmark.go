@@ -1,11 +1,15 @@
 package util
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 )
 
 const p = string(os.PathSeparator)
@@ -14,71 +18,119 @@ const p = string(os.PathSeparator)
 // flags - if any flags need to be passed when running the code
 // benchname - the name of the benchmark method in the test file to run
 // id - the id of the run, used to name the output
-func RunCode(flags string, benchName string, testName string, id string, filename string, folderPath string, doProfile bool, count int) string {
+// The tests are run with -json, and the result is built from the test2json event stream
+func RunCode(flags string, benchName string, testName string, id string, filename string, folderPath string, doProfile bool, count int) TestResult {
+	return RunCodeContext(context.Background(), 0, flags, benchName, testName, id, filename, folderPath, doProfile, count)
+}
+
+// RunCodeContext is RunCode with cancellation and a per-run timeout
+// If the run is killed because of the timeout, the result is marked as TimedOut
+func RunCodeContext(ctx context.Context, timeout time.Duration, flags string, benchName string, testName string, id string, filename string, folderPath string, doProfile bool, count int) TestResult {
 	// Command should be a perf call with appropriate arguments
 	//output, err := exec.Command("cmd", "/c", "dir").CombinedOutput()
 	// go test %flags% -bench=%benchName% -run=NONE -benchmem -memprofile mem.pprof -cpuprofile cpu.pprof > %id%.bench
 	// Potentially replace with: https://cs.opensource.google/go/go/+/refs/tags/go1.19.2:src/testing/benchmark.go;l=511
 	if runtime.GOOS == "windows" {
-		return runCodeWindows(flags, benchName, id, filename, folderPath, testName, count)
+		return runCodeWindows(ctx, timeout, flags, benchName, id, filename, folderPath, testName, count)
 	} else {
-		return runCodeLinux(flags, benchName, folderPath, testName, doProfile, count)
+		profileName := ""
+		if doProfile {
+			profileName = "cpu.pprof"
+		}
+		return runCodeLinux(ctx, timeout, flags, benchName, folderPath, testName, profileName, count)
 	}
 }
 
-func runCodeLinux(flags string, benchName string, folderPath string, testName string, doProfile bool, count int) string {
-	res, err := exec.Command("pwd").Output()
-	if err != nil {
-		fmt.Println("Failed to get PWD: " + err.Error())
-		return "FAILED"
+// RunBenchmarkProfiled runs the benchmarks matching benchName, and writes their CPU profile to profileName in folderPath
+// No tests are run. On windows the profile goes where RunCode puts it instead
+func RunBenchmarkProfiled(ctx context.Context, timeout time.Duration, flags string, benchName string, id string, filename string, folderPath string, count int, profileName string) TestResult {
+	if runtime.GOOS == "windows" {
+		return runCodeWindows(ctx, timeout, flags, benchName, id, filename, folderPath, "NONE", count)
 	}
-	pwd := string(res)
-	pwd = strings.Trim(pwd, "\n") + p
-	err = os.MkdirAll(folderPath, 0777)
+	return runCodeLinux(ctx, timeout, flags, benchName, folderPath, "NONE", profileName, count)
+}
+
+// runCodeLinux runs go test in folderPath; if profileName is empty, no profiles are recorded
+func runCodeLinux(ctx context.Context, timeout time.Duration, flags string, benchName string, folderPath string, testName string, profileName string, count int) TestResult {
+	dir, err := workingDir(folderPath)
 	if err != nil {
-		fmt.Println("Failed to make folders: " + err.Error())
-		return "FAILED"
+		return TestResult{Err: err}
 	}
 
 	// set up all the arguments in an array, to allow for conditional arguments
 	args := make([]string, 0)
-	args = append(args, "test", flags)       // we use go test, plus any flags that need to be passed to the executing method
-	args = append(args, "-bench="+benchName) // the name of the benchmark method in the test file to run
-	args = append(args, "-run="+testName)    // We don't run any normal tests. Maybe have this be a default value?
+	args = append(args, "test")
+	args = append(args, strings.Fields(flags)...) // any flags that need to be passed to the executing method
+	args = append(args, "-json")                  // report results as test2json events rather than plain text
+	args = append(args, "-bench="+benchName)      // the name of the benchmark method in the test file to run
+	args = append(args, "-run="+testName)         // We don't run any normal tests. Maybe have this be a default value?
 	args = append(args, fmt.Sprintf("-count=%d", count))
-	if doProfile {
-		args = append(args, "-cpuprofile", "cpu.pprof") // record cpu profile
+	if profileName != "" {
+		args = append(args, "-cpuprofile", profileName) // record cpu profile
 		args = append(args, "-memprofile", "mem.pprof") // record memory profile
 	}
 	//args = append(args, ">", outputPath+id+".bench") // put in "%id%.bench" for later use
 
-	cmd := exec.Command("go", args...)
-	cmd.Dir = pwd + folderPath
-	output, err := cmd.CombinedOutput()
+	output, err := RunCommand(ctx, timeout, dir, "go", args...)
+	return toTestResult(output, err)
+}
+
+// BuildPackage runs go build on every package in folderPath, returning the compiler output if it fails
+func BuildPackage(ctx context.Context, timeout time.Duration, folderPath string) (string, error) {
+	return runGoTool(ctx, timeout, folderPath, "build")
+}
+
+// VetPackage runs go vet on every package in folderPath, returning the reported problems if there are any
+func VetPackage(ctx context.Context, timeout time.Duration, folderPath string) (string, error) {
+	return runGoTool(ctx, timeout, folderPath, "vet")
+}
+
+// the flags given to perfactor are meant for go test, so they are not passed on here
+func runGoTool(ctx context.Context, timeout time.Duration, folderPath string, command string) (string, error) {
+	dir, err := workingDir(folderPath)
+	if err != nil {
+		return "", err
+	}
+	output, err := RunCommand(ctx, timeout, dir, "go", command, "./...")
+	return string(output), err
+}
+
+// workingDir makes sure folderPath exists, and returns it as a path the go command can be run in
+func workingDir(folderPath string) (string, error) {
+	res, err := exec.Command("pwd").Output()
+	if err != nil {
+		return "", fmt.Errorf("could not get the working directory: %w", err)
+	}
+	pwd := string(res)
+	pwd = strings.Trim(pwd, "\n") + p
+	err = os.MkdirAll(folderPath, 0777)
 	if err != nil {
-		fmt.Println(string(output))
-		fmt.Println("failed to run code: " + err.Error())
+		return "", fmt.Errorf("could not make %s: %w", folderPath, err)
 	}
-	if output != nil {
-		return string(output)
+	if filepath.IsAbs(folderPath) {
+		return folderPath, nil
 	}
-	return "FAILED"
+	return pwd + folderPath, nil
 }
 
-func runCodeWindows(flags string, benchName string, id string, inputPath string, outputPath string, testName string, count int) string {
-	output, err := exec.Command("powershell", "-nologo", "-noprofile", // opens powershell
+func runCodeWindows(ctx context.Context, timeout time.Duration, flags string, benchName string, id string, inputPath string, outputPath string, testName string, count int) TestResult {
+	output, err := RunCommand(ctx, timeout, "", "powershell", "-nologo", "-noprofile", // opens powershell
 		"cd", inputPath, // move into the tmp folder
-		"go", "test", flags, // we use go test, plus any flags that need to be passed to the executing method
+		"go", "test", flags, "-json", // we use go test, plus any flags that need to be passed to the executing method
 		"-bench="+benchName,                             // the name of the benchmark method in the test file to run
 		"-run="+testName,                                // We don't run any normal tests. Maybe have this be a default value?
 		"-cpuprofile", "./"+outputPath+id+p+"cpu.pprof", // record cpu profile
 		"-memprofile", outputPath+id+p+"mem.pprof", // record memory profile
-		">", outputPath+id+p+id+".bench").CombinedOutput() // put in "%id%.bench" for later use, in the _data directory
+		">", outputPath+id+p+id+".bench") // put in "%id%.bench" for later use, in the _data directory
+	return toTestResult(output, err)
+}
+
+// toTestResult sorts the output of a go test run; the failure is left in the result for the caller to report
+func toTestResult(output []byte, err error) TestResult {
+	result := ParseTestEvents(output)
 	if err != nil {
-		fmt.Println("Failed to execute windows command: " + err.Error())
-	}
-	if output != nil {
-		return string(output)
+		result.Err = err
+		result.TimedOut = errors.Is(err, ErrTimeout)
 	}
-	return "FAILED"
+	return result
 }
@@ -0,0 +1,202 @@
+package util
+
+import (
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"sync"
+	"time"
+)
+
+// spawnRounds and spawnGoroutines size MeasureSpawnOverhead: enough goroutines per round that the timer's resolution
+// does not matter, and a few rounds so one slowed by the garbage collector or another process can be left out
+const (
+	spawnRounds     = 5
+	spawnGoroutines = 10000
+)
+
+// MeasureSpawnOverhead times starting goroutines and waiting for them with a WaitGroup on this machine, the way the
+// rewritten loops do, and gives the cost per goroutine of the fastest round
+func MeasureSpawnOverhead() time.Duration {
+	var best time.Duration
+	for round := 0; round < spawnRounds; round++ {
+		start := time.Now()
+		var wg sync.WaitGroup
+		for i := 0; i < spawnGoroutines; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+			}()
+		}
+		wg.Wait()
+		perGoroutine := time.Since(start) / spawnGoroutines
+		if round == 0 || perGoroutine < best {
+			best = perGoroutine
+		}
+	}
+	if best < 1 {
+		// a clock too coarse for the rounds still should not make the goroutines free
+		best = 1
+	}
+	return best
+}
+
+// SpeedupPrediction is what Amdahl's law, with the cost of the goroutines added, expects of making a loop concurrent
+type SpeedupPrediction struct {
+	// Share is the loop's part of the benchmark's time, from 0 to 1
+	Share float64
+	Cores int
+	// Iterations is the number of iterations of the loop, or 0 if it is not known before running it
+	Iterations int64
+	// PerIteration is the predicted speedup of the benchmark with a goroutine per iteration, which is the rewrite perfactor
+	// makes, or 0 if the iterations are not known, since the cost of the goroutines then cannot be told
+	PerIteration float64
+	// Chunked is the predicted speedup with the iterations split into one goroutine per core, for comparison
+	Chunked float64
+	// Overhead is the cost of a goroutine the prediction was made with
+	Overhead time.Duration
+}
+
+// PredictSpeedup models the benchmark's time per op as a serial part and the loop, which is spread over the cores,
+// and adds overhead, the cost of starting each goroutine and waiting for it, which the loop pays one after the other
+// The loop is taken to run once per op, so a loop run several times per op, such as one nested in another, has its
+// overhead underestimated
+func PredictSpeedup(loopTime int64, total int64, nsPerOp float64, iterations int64, cores int, overhead time.Duration) SpeedupPrediction {
+	p := SpeedupPrediction{Cores: cores, Iterations: iterations, Overhead: overhead}
+	if total > 0 {
+		p.Share = float64(loopTime) / float64(total)
+	}
+	if p.Share > 1 {
+		p.Share = 1
+	}
+	if cores < 1 {
+		cores = 1
+	}
+	serial := nsPerOp * (1 - p.Share)
+	loop := nsPerOp * p.Share
+	spawn := float64(overhead)
+
+	workers := int64(cores)
+	if iterations > 0 && iterations < workers {
+		workers = iterations
+	}
+	perIteration := serial + loop/float64(workers) + float64(iterations)*spawn
+	chunked := serial + loop/float64(workers) + float64(workers)*spawn
+	if iterations > 0 && perIteration > 0 {
+		p.PerIteration = nsPerOp / perIteration
+	}
+	if chunked > 0 {
+		p.Chunked = nsPerOp / chunked
+	}
+	return p
+}
+
+// Known reports whether the speedup of the rewrite perfactor makes could be predicted, which needs the iterations
+func (p SpeedupPrediction) Known() bool {
+	return p.Iterations > 0
+}
+
+// Loses reports whether the rewrite perfactor makes is expected to be slower than the original
+// A loop whose speedup is not known is not expected to lose, nor to win
+func (p SpeedupPrediction) Loses() bool {
+	return p.Known() && p.PerIteration < 1
+}
+
+func (p SpeedupPrediction) String() string {
+	if !p.Known() {
+		return fmt.Sprintf("an unknown speedup with a goroutine per iteration, %.2fx chunked (%.1f%% of the time, %d cores, unknown iterations, %s per goroutine)",
+			p.Chunked, p.Share*100, p.Cores, p.Overhead)
+	}
+	return fmt.Sprintf("%.2fx with a goroutine per iteration, %.2fx chunked (%.1f%% of the time, %d cores, %d iterations, %s per goroutine)",
+		p.PerIteration, p.Chunked, p.Share*100, p.Cores, p.Iterations, p.Overhead)
+}
+
+// StaticIterations gives the number of iterations of a loop whose bounds are constants, as in
+// "for i := 0; i < 100; i++" or a range over an array, or 0 if it cannot be known without running the loop
+func StaticIterations(loop Loop, info *types.Info) int64 {
+	if info == nil {
+		return 0
+	}
+	if loop.Range != nil {
+		tv, ok := info.Types[loop.Range.X]
+		if !ok {
+			return 0
+		}
+		if tv.Value != nil && tv.Value.Kind() == constant.Int {
+			n, _ := constant.Int64Val(tv.Value)
+			return n
+		}
+		if tv.Value != nil && tv.Value.Kind() == constant.String {
+			// a range over a string is over its runes, which a constant string's length only bounds
+			return 0
+		}
+		typ := tv.Type
+		if ptr, ok := typ.Underlying().(*types.Pointer); ok {
+			typ = ptr.Elem()
+		}
+		if array, ok := typ.Underlying().(*types.Array); ok {
+			return array.Len()
+		}
+		return 0
+	}
+	if loop.For == nil {
+		return 0
+	}
+	return forIterations(loop.For, info)
+}
+
+// forIterations handles the counting loop, "for i := a; i < b; i++", with constant a and b, and < <= or !=
+func forIterations(loop *ast.ForStmt, info *types.Info) int64 {
+	init, ok := loop.Init.(*ast.AssignStmt)
+	if !ok || len(init.Lhs) != 1 || len(init.Rhs) != 1 {
+		return 0
+	}
+	counter, ok := init.Lhs[0].(*ast.Ident)
+	if !ok {
+		return 0
+	}
+	post, ok := loop.Post.(*ast.IncDecStmt)
+	if !ok || post.Tok != token.INC {
+		return 0
+	}
+	if ident, ok := post.X.(*ast.Ident); !ok || ident.Name != counter.Name {
+		return 0
+	}
+	cond, ok := loop.Cond.(*ast.BinaryExpr)
+	if !ok {
+		return 0
+	}
+	if ident, ok := cond.X.(*ast.Ident); !ok || ident.Name != counter.Name {
+		return 0
+	}
+	from, ok := constantInt(init.Rhs[0], info)
+	if !ok {
+		return 0
+	}
+	to, ok := constantInt(cond.Y, info)
+	if !ok {
+		return 0
+	}
+	n := to - from
+	switch cond.Op {
+	case token.LSS, token.NEQ:
+	case token.LEQ:
+		n++
+	default:
+		return 0
+	}
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+func constantInt(expr ast.Expr, info *types.Info) (int64, bool) {
+	tv, ok := info.Types[expr]
+	if !ok || tv.Value == nil || tv.Value.Kind() != constant.Int {
+		return 0, false
+	}
+	return constant.Int64Val(tv.Value)
+}
@@ -0,0 +1,104 @@
+package util
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPredictSpeedup(t *testing.T) {
+	overhead := float64(time.Microsecond)
+	tests := []struct {
+		name         string
+		loopTime     int64
+		total        int64
+		nsPerOp      float64
+		iterations   int64
+		cores        int
+		perIteration float64
+		chunked      float64
+		loses        bool
+	}{
+		// 1ms per op, all of it in 8 iterations on 4 cores: 250µs of loop and 8µs of goroutines
+		{"whole op in a few iterations", 100, 100, 1e6, 8, 4, 1e6 / (250e3 + 8*overhead), 1e6 / (250e3 + 4*overhead), false},
+		// half of 1ms in the loop: 500µs serial and 125µs of loop
+		{"half the op", 50, 100, 1e6, 8, 4, 1e6 / (500e3 + 125e3 + 8*overhead), 1e6 / (500e3 + 125e3 + 4*overhead), false},
+		// 10µs per op spread over 1000 iterations costs 1ms of goroutines
+		{"many tiny iterations", 100, 100, 10e3, 1000, 4, 10e3 / (2.5e3 + 1000*overhead), 10e3 / (2.5e3 + 4*overhead), true},
+		// fewer iterations than cores use only as many cores
+		{"fewer iterations than cores", 100, 100, 1e6, 2, 8, 1e6 / (500e3 + 2*overhead), 1e6 / (500e3 + 2*overhead), false},
+		{"unknown iterations", 100, 100, 10e3, 0, 4, 0, 10e3 / (2.5e3 + 4*overhead), false},
+		{"share capped at the whole op", 200, 100, 1e6, 8, 4, 1e6 / (250e3 + 8*overhead), 1e6 / (250e3 + 4*overhead), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := PredictSpeedup(tt.loopTime, tt.total, tt.nsPerOp, tt.iterations, tt.cores, time.Microsecond)
+			if math.Abs(p.PerIteration-tt.perIteration) > 1e-9 {
+				t.Errorf("PerIteration = %v, want %v", p.PerIteration, tt.perIteration)
+			}
+			if math.Abs(p.Chunked-tt.chunked) > 1e-9 {
+				t.Errorf("Chunked = %v, want %v", p.Chunked, tt.chunked)
+			}
+			if p.Loses() != tt.loses {
+				t.Errorf("Loses() = %v, want %v", p.Loses(), tt.loses)
+			}
+			if p.Known() != (tt.iterations > 0) {
+				t.Errorf("Known() = %v with %d iterations", p.Known(), tt.iterations)
+			}
+			if !p.Known() && !strings.HasPrefix(p.String(), "an unknown speedup") {
+				t.Errorf("String() = %q, want an unknown speedup", p.String())
+			}
+		})
+	}
+}
+
+func TestMeasureSpawnOverhead(t *testing.T) {
+	// a goroutine costs hundreds of nanoseconds on current machines; the bounds only catch a broken measurement
+	if got := MeasureSpawnOverhead(); got <= 0 || got > time.Millisecond {
+		t.Errorf("MeasureSpawnOverhead() = %s", got)
+	}
+}
+
+func TestStaticIterations(t *testing.T) {
+	tests := []struct {
+		loop string
+		want int64
+	}{
+		{"for i := 0; i < 100; i++ {}", 100},
+		{"for i := 1; i <= 100; i++ {}", 100},
+		{"for i := 10; i != 20; i++ {}", 10},
+		{"for i := 0; i < n; i++ {}", 0},
+		{"for i := 0; i < 100; i += 2 {}", 0},
+		{"for i := 0; i > 100; i++ {}", 0},
+		{"for range [5]int{} {}", 5},
+		{"for range &arr {}", 3},
+		{"for range slice {}", 0},
+		{`for range "héllo" {}`, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.loop, func(t *testing.T) {
+			src := "package p\n\nvar arr [3]int\nvar slice []int\n\nfunc f(n int) {\n\t" + tt.loop + "\n}\n"
+			fileSet := token.NewFileSet()
+			astFile, err := parser.ParseFile(fileSet, "p.go", src, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info := &types.Info{Types: make(map[ast.Expr]types.TypeAndValue)}
+			if _, err := (&types.Config{}).Check("p", fileSet, []*ast.File{astFile}, info); err != nil {
+				t.Fatal(err)
+			}
+			loops := FindForLoopsInAST(astFile, fileSet, nil)
+			if len(loops) != 1 {
+				t.Fatalf("found %d loops, want 1", len(loops))
+			}
+			if got := StaticIterations(loops[0], info); got != tt.want {
+				t.Errorf("StaticIterations() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package util
+
+import (
+	"fmt"
+	"io"
+)
+
+// Stage is one step of the pipeline a refactored loop goes through before the change is kept
+// The stages run in the order they are declared, and the first one to fail rejects the loop
+type Stage string
+
+const (
+	// StageDependence rejects loops seen to use a location in two iterations, with a write in one, while the tests ran
+	StageDependence Stage = "dependence"
+	// StagePrediction rejects loops that the speedup model expects to be slower, before anything is rewritten
+	StagePrediction Stage = "prediction"
+
+	StageTypeCheck Stage = "type-check"
+	StageBuild     Stage = "build"
+	StageVet       Stage = "vet"
+	StageTest      Stage = "test"
+	StageRace      Stage = "race"
+	StageBenchmark Stage = "benchmark"
+)
+
+// RuleID gives the SARIF rule used when a loop is rejected at this stage
+func (s Stage) RuleID() string {
+	switch s {
+	case StageTypeCheck:
+		return "PERFACTOR_RUN_002"
+	case StageBuild:
+		return "PERFACTOR_RUN_003"
+	case StageVet:
+		return "PERFACTOR_RUN_004"
+	case StageTest:
+		return "PERFACTOR_RUN_005"
+	case StageBenchmark:
+		return "PERFACTOR_RUN_006"
+	case StageRace:
+		return "PERFACTOR_RUN_007"
+	case StagePrediction:
+		return "PERFACTOR_RUN_009"
+	case StageDependence:
+		return DependenceRuleID
+	}
+	return "PERFACTOR_RUN_000"
+}
+
+// LoopOutcome records how far a refactored loop got through the stages, and why it stopped
+type LoopOutcome struct {
+	File string
+	Line int
+	// Stage is the stage that rejected the loop, or empty if it passed every stage
+	Stage Stage
+	// Reason is a short description of the failure, such as FailureTimeout or the failing tests
+	Reason string
+	// Detail holds the compiler, vet or test output that explains the failure
+	Detail   string
+	Accepted bool
+	// Contention describes the waits of the loop's goroutines, if they were blocked for long enough to be flagged
+	Contention string `json:",omitempty"`
+}
+
+func (o LoopOutcome) String() string {
+	contention := ""
+	if o.Contention != "" {
+		contention = "; contended: " + o.Contention
+	}
+	if o.Accepted {
+		return fmt.Sprintf("%s:%d: accepted%s", o.File, o.Line, contention)
+	}
+	if o.Stage == "" {
+		return fmt.Sprintf("%s:%d: passed all stages, not kept: %s%s", o.File, o.Line, o.Reason, contention)
+	}
+	return fmt.Sprintf("%s:%d: rejected at %s: %s", o.File, o.Line, o.Stage, o.Reason)
+}
+
+// WriteOutcomeSummary writes one line per loop in the given file, in the order the loops were tried
+func WriteOutcomeSummary(out io.Writer, outcomes []LoopOutcome, fileName string) {
+	var lines []string
+	for _, o := range outcomes {
+		if o.File == fileName {
+			lines = append(lines, o.String())
+		}
+	}
+	if len(lines) == 0 {
+		return
+	}
+	_, _ = fmt.Fprintf(out, "Summary of %d refactored loops in %s:\n", len(lines), fileName)
+	for _, line := range lines {
+		_, _ = fmt.Fprintf(out, "  %s\n", line)
+	}
+}
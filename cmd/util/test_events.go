@@ -0,0 +1,122 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// TestEvent is a single event in the stream produced by go test -json
+// The fields match the ones documented by cmd/test2json
+type TestEvent struct {
+	Time       time.Time
+	Action     string
+	Package    string
+	ImportPath string
+	Test       string
+	Elapsed    float64
+	Output     string
+}
+
+// TestResult is the structured outcome of one go test run, built from its test2json event stream
+type TestResult struct {
+	Events []TestEvent
+	// Output is the human-readable output, reassembled from the output events
+	Output         string
+	Passed         []string
+	Failed         []string
+	Skipped        []string
+	FailedPackages []string
+	// BuildFailed is set if a package failed to build or set up, which is a package failing before any of its tests ran
+	BuildFailed bool
+	NoTestFiles bool
+	// TimedOut is set if the run was killed after running past its timeout
+	TimedOut bool
+	// Elapsed is the summed elapsed time of all packages, in seconds
+	Elapsed float64
+	// Err is set if the go command itself could not be run, or exited with an error
+	Err error
+}
+
+// Ok reports whether the run finished without any failing test, benchmark, package or build
+func (r TestResult) Ok() bool {
+	return r.Err == nil && !r.TimedOut && !r.BuildFailed && len(r.Failed) == 0 && len(r.FailedPackages) == 0
+}
+
+// FailureSummary gives a short description of why the run was not Ok
+func (r TestResult) FailureSummary() string {
+	switch {
+	case r.TimedOut:
+		return FailureTimeout
+	case r.BuildFailed:
+		return "package failed to build or set up"
+	case len(r.Failed) > 0:
+		return "failing: " + strings.Join(r.Failed, ", ")
+	case len(r.FailedPackages) > 0:
+		return "failing packages: " + strings.Join(r.FailedPackages, ", ")
+	case r.Err != nil:
+		return r.Err.Error()
+	}
+	return "no failure"
+}
+
+// ParseTestEvents reads the output of go test -json and sorts the events into a TestResult
+// Lines that are not JSON (such as build errors written to stderr by older toolchains) are kept in the Output
+// Only the actions of the events are used: a panicking test gets a fail event of its own, and a package that fails
+// without running a test failed to build or set up, which toolchains before go1.24 report no other way
+func ParseTestEvents(output []byte) TestResult {
+	var res TestResult
+	var text strings.Builder
+	// ran holds the packages that started a test or benchmark
+	ran := make(map[string]bool)
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var event TestEvent
+		if len(line) == 0 || line[0] != '{' || json.Unmarshal(line, &event) != nil {
+			text.Write(line)
+			text.WriteByte('\n')
+			continue
+		}
+		res.Events = append(res.Events, event)
+
+		if event.Test != "" {
+			ran[event.Package] = true
+		}
+		switch event.Action {
+		case "output", "build-output":
+			text.WriteString(event.Output)
+		case "build-fail":
+			res.BuildFailed = true
+		case "pass":
+			if event.Test != "" {
+				res.Passed = append(res.Passed, event.Test)
+			} else {
+				res.Elapsed += event.Elapsed
+			}
+		case "fail":
+			if event.Test != "" {
+				res.Failed = append(res.Failed, event.Test)
+			} else {
+				res.FailedPackages = append(res.FailedPackages, event.Package)
+				res.Elapsed += event.Elapsed
+				if !ran[event.Package] {
+					res.BuildFailed = true
+				}
+			}
+		case "skip":
+			if event.Test != "" {
+				res.Skipped = append(res.Skipped, event.Test)
+			} else {
+				// a package-level skip means there was nothing to run
+				res.NoTestFiles = true
+			}
+		}
+	}
+	res.Output = text.String()
+	return res
+}
@@ -0,0 +1,116 @@
+package util
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTestEvents(t *testing.T) {
+	tests := []struct {
+		name        string
+		events      []string
+		ok          bool
+		buildFailed bool
+		passed      []string
+		failed      []string
+		summary     string
+	}{
+		{
+			name: "passing test that prints a panic",
+			events: []string{
+				`{"Action":"run","Package":"ev/ok","Test":"TestPrints"}`,
+				`{"Action":"output","Package":"ev/ok","Test":"TestPrints","Output":"panic: not really\n"}`,
+				`{"Action":"pass","Package":"ev/ok","Test":"TestPrints","Elapsed":0}`,
+				`{"Action":"output","Package":"ev/ok","Output":"ok  \tev/ok\t0.003s\n"}`,
+				`{"Action":"pass","Package":"ev/ok","Elapsed":0.004}`,
+			},
+			ok:      true,
+			passed:  []string{"TestPrints"},
+			summary: "no failure",
+		},
+		{
+			name: "panicking test",
+			events: []string{
+				`{"Action":"run","Package":"ev/pan","Test":"TestPanics"}`,
+				`{"Action":"output","Package":"ev/pan","Test":"TestPanics","Output":"panic: boom [recovered, repanicked]\n"}`,
+				`{"Action":"fail","Package":"ev/pan","Test":"TestPanics","Elapsed":0}`,
+				`{"Action":"output","Package":"ev/pan","Output":"FAIL\tev/pan\t0.005s\n"}`,
+				`{"Action":"fail","Package":"ev/pan","Elapsed":0.005}`,
+			},
+			failed:  []string{"TestPanics"},
+			summary: "failing: TestPanics",
+		},
+		{
+			name: "build failure with build events",
+			events: []string{
+				`{"ImportPath":"ev/build [ev/build.test]","Action":"build-output","Output":"build/build_test.go:5:28: undefined: undefined\n"}`,
+				`{"ImportPath":"ev/build [ev/build.test]","Action":"build-fail"}`,
+				`{"Action":"output","Package":"ev/build","Output":"FAIL\tev/build [build failed]\n"}`,
+				`{"Action":"fail","Package":"ev/build","Elapsed":0,"FailedBuild":"ev/build [ev/build.test]"}`,
+			},
+			buildFailed: true,
+			summary:     "package failed to build or set up",
+		},
+		{
+			name: "build failure from an older toolchain",
+			events: []string{
+				`build/build_test.go:5:28: undefined: undefined`,
+				`{"Action":"output","Package":"ev/build","Output":"FAIL\tev/build [build failed]\n"}`,
+				`{"Action":"fail","Package":"ev/build","Elapsed":0}`,
+			},
+			buildFailed: true,
+			summary:     "package failed to build or set up",
+		},
+		{
+			name: "package failing after its tests passed",
+			events: []string{
+				`{"Action":"run","Package":"ev/exit","Test":"TestA"}`,
+				`{"Action":"pass","Package":"ev/exit","Test":"TestA","Elapsed":0}`,
+				`{"Action":"fail","Package":"ev/exit","Elapsed":0.01}`,
+			},
+			passed:  []string{"TestA"},
+			summary: "failing packages: ev/exit",
+		},
+		{
+			name: "no test files",
+			events: []string{
+				`{"Action":"output","Package":"ev/none","Output":"?   \tev/none\t[no test files]\n"}`,
+				`{"Action":"skip","Package":"ev/none","Elapsed":0}`,
+			},
+			ok:      true,
+			summary: "no failure",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ParseTestEvents([]byte(strings.Join(tt.events, "\n") + "\n"))
+			if res.Ok() != tt.ok {
+				t.Errorf("Ok() = %v, want %v", res.Ok(), tt.ok)
+			}
+			if res.BuildFailed != tt.buildFailed {
+				t.Errorf("BuildFailed = %v, want %v", res.BuildFailed, tt.buildFailed)
+			}
+			if !reflect.DeepEqual(res.Passed, tt.passed) {
+				t.Errorf("Passed = %v, want %v", res.Passed, tt.passed)
+			}
+			if !reflect.DeepEqual(res.Failed, tt.failed) {
+				t.Errorf("Failed = %v, want %v", res.Failed, tt.failed)
+			}
+			if got := res.FailureSummary(); got != tt.summary {
+				t.Errorf("FailureSummary() = %q, want %q", got, tt.summary)
+			}
+		})
+	}
+}
+
+func TestParseTestEventsKeepsOutput(t *testing.T) {
+	res := ParseTestEvents([]byte("# ev/build\n" +
+		`{"Action":"output","Package":"ev/ok","Test":"TestA","Output":"hello\n"}` + "\n"))
+	if res.Output != "# ev/build\nhello\n" {
+		t.Errorf("Output = %q", res.Output)
+	}
+	if len(res.Events) != 1 {
+		t.Errorf("got %d events, want 1", len(res.Events))
+	}
+}
@@ -0,0 +1,242 @@
+package util
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"perfactor/graph"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TraceFileName is the file in the workspace that the execution trace of an accepted candidate is written to
+const TraceFileName = "trace.out"
+
+// TraceBenchTime keeps the traced run short, since a trace records every scheduling event and grows quickly
+const TraceBenchTime = "100ms"
+
+// Utilisation is how well the goroutines started by a loop kept the Ps busy, over the time any of them were alive
+type Utilisation struct {
+	File string
+	Line int
+	// Goroutines is the number of goroutines the loop started over the whole run
+	Goroutines int
+	// Span is the time at least one of them was alive
+	Span       time.Duration
+	GOMAXPROCS int
+	// Parallelism is the average number of the loop's goroutines running at once during the span
+	Parallelism float64
+	// SchedLatency is the average time the loop's goroutines waited to run once they were runnable, and MaxSchedLatency the longest
+	SchedLatency    time.Duration
+	MaxSchedLatency time.Duration
+	// Idle is the part of the Ps' time during the span that no goroutine was running on them, from 0 to 1
+	Idle float64
+}
+
+func (u Utilisation) String() string {
+	return fmt.Sprintf("%s:%d: %d goroutines over %s, average parallelism %.2f of %d Ps, %.1f%% idle, scheduler latency %s average, %s at most",
+		u.File, u.Line, u.Goroutines, u.Span.Round(time.Microsecond), u.Parallelism, u.GOMAXPROCS, u.Idle*100,
+		u.SchedLatency.Round(time.Microsecond), u.MaxSchedLatency.Round(time.Microsecond))
+}
+
+// Advice suggests a different strategy when the numbers show the goroutines are a poor fit, or gives an empty string
+func (u Utilisation) Advice() string {
+	switch {
+	case u.Goroutines == 0:
+		return "the loop started no goroutines during the traced run"
+	case u.GOMAXPROCS > 1 && u.Goroutines > 4*u.GOMAXPROCS && u.SchedLatency > 10*time.Microsecond:
+		return "many goroutines wait to be scheduled; running the iterations in chunks, one goroutine per P, would cut the overhead"
+	case u.GOMAXPROCS > 1 && u.Idle > 0.3:
+		return "the Ps are idle for much of the loop; the iterations may be too few or too uneven to keep them busy"
+	}
+	return ""
+}
+
+// TraceBenchmarks runs the benchmarks with the execution tracer on, writing the trace to TraceFileName in folderPath
+func TraceBenchmarks(ctx context.Context, timeout time.Duration, flags string, folderPath string, benchName string) TestResult {
+	dir, err := workingDir(folderPath)
+	if err != nil {
+		return TestResult{Err: err}
+	}
+	args := []string{"test"}
+	args = append(args, strings.Fields(flags)...)
+	args = append(args, "-json", "-run=NONE", "-bench="+benchName, "-count=1", "-benchtime="+TraceBenchTime, "-trace", TraceFileName)
+	output, err := RunCommand(ctx, timeout, dir, "go", args...)
+	return toTestResult(output, err)
+}
+
+// AnalyseTrace measures the utilisation of the goroutines started by closures of funcName in the file
+// The trace is read through go tool trace, which prints its parsed events as text from Go 1.22 on
+func AnalyseTrace(ctx context.Context, timeout time.Duration, tracePath string, funcName string, file graph.File) (Utilisation, error) {
+	reader, writer := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		stderr, err := RunCommandWriting(ctx, timeout, "", writer, "go", "tool", "trace", "-d=parsed", tracePath)
+		if err != nil && len(stderr) > 0 {
+			err = fmt.Errorf("%w: %s", err, strings.TrimSpace(string(stderr)))
+		}
+		_ = writer.CloseWithError(err)
+		done <- err
+	}()
+	u, parseErr := parseTrace(reader, funcName, file)
+	// the rest of the output is drained, so go tool trace is not left blocked on the pipe
+	_, _ = io.Copy(io.Discard, reader)
+	if err := <-done; err != nil {
+		return u, fmt.Errorf("could not read the trace, which needs Go 1.22 or later: %w", err)
+	}
+	return u, parseErr
+}
+
+// The text go tool trace -d=parsed prints is not a stable format, so these are pinned to the output of
+// testdata/trace_parsed.txt; when a Go release changes it, TestParseTrace fails instead of the analysis quietly finding nothing
+var (
+	traceEvent      = regexp.MustCompile(`^M=-?\d+ P=-?\d+ G=-?\d+ (\w+) Time=(\d+)(.*)$`)
+	traceTransition = regexp.MustCompile(`^ GoID=(\d+) (\w+)->(\w+)`)
+	traceGomaxprocs = regexp.MustCompile(`Name="/sched/gomaxprocs:threads" Value=Value\{Uint64\((\d+)\)\}`)
+)
+
+// parseTrace follows the state of every goroutine through the events, integrating the number running over the time
+// any of the loop's goroutines are alive. A goroutine is the loop's if the function it starts in, the first frame
+// of the stack of its creation event, is a closure of funcName in the file
+func parseTrace(r io.Reader, funcName string, file graph.File) (Utilisation, error) {
+	u := Utilisation{}
+	running := make(map[uint64]bool)
+	loopGoroutine := make(map[uint64]bool)
+	runnableSince := make(map[uint64]int64)
+	var runningAll, runningLoop, alive int
+	var last, span, loopRunning, allRunning, latency int64
+	var latencies int64
+	var created uint64
+	// the creation event's stack follows it, so the goroutine is only known to be the loop's a few lines on
+	expectStart := false
+	expectFile := false
+	var startFunc string
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if expectStart {
+			if line == "TransitionStack=" {
+				continue
+			}
+			expectStart = false
+			if strings.HasPrefix(line, "\t") && !strings.HasPrefix(line, "\t\t") {
+				startFunc = strings.TrimSpace(line)
+				if at := strings.Index(startFunc, " @ "); at != -1 {
+					startFunc = startFunc[:at]
+				}
+				expectFile = true
+				continue
+			}
+		}
+		if expectFile {
+			expectFile = false
+			path := strings.TrimSpace(line)
+			if colon := strings.LastIndex(path, ":"); colon != -1 {
+				path = path[:colon]
+			}
+			if graph.IsFile(path, startFunc, file) && inFunction(startFunc, funcName) && !strings.HasSuffix(startFunc, "."+funcName) {
+				loopGoroutine[created] = true
+				u.Goroutines++
+				alive++
+			}
+			continue
+		}
+
+		match := traceEvent.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		if match[1] == "Metric" {
+			if m := traceGomaxprocs.FindStringSubmatch(match[3]); m != nil {
+				if n, _ := strconv.Atoi(m[1]); n > u.GOMAXPROCS {
+					u.GOMAXPROCS = n
+				}
+			}
+			continue
+		}
+		if match[1] != "StateTransition" {
+			continue
+		}
+		transition := traceTransition.FindStringSubmatch(match[3])
+		if transition == nil {
+			// the Ps have transitions too
+			continue
+		}
+		now, _ := strconv.ParseInt(match[2], 10, 64)
+		if alive > 0 && last > 0 {
+			dt := now - last
+			span += dt
+			loopRunning += int64(runningLoop) * dt
+			allRunning += int64(runningAll) * dt
+		}
+		last = now
+
+		id, _ := strconv.ParseUint(transition[1], 10, 64)
+		from, to := transition[2], transition[3]
+		isLoop := loopGoroutine[id]
+		if from == "Running" && running[id] {
+			running[id] = false
+			runningAll--
+			if isLoop {
+				runningLoop--
+			}
+		}
+		switch to {
+		case "Running":
+			running[id] = true
+			runningAll++
+			if isLoop {
+				runningLoop++
+				if since, ok := runnableSince[id]; ok {
+					wait := now - since
+					latency += wait
+					latencies++
+					if time.Duration(wait) > u.MaxSchedLatency {
+						u.MaxSchedLatency = time.Duration(wait)
+					}
+				}
+			}
+			delete(runnableSince, id)
+		case "Runnable":
+			if from == "NotExist" {
+				created = id
+				expectStart = true
+			}
+			runnableSince[id] = now
+		case "NotExist":
+			if isLoop {
+				alive--
+				delete(loopGoroutine, id)
+			}
+			delete(running, id)
+			delete(runnableSince, id)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return u, err
+	}
+	if last == 0 {
+		return u, errors.New("no goroutine events in the trace")
+	}
+
+	u.Span = time.Duration(span)
+	if span > 0 {
+		u.Parallelism = float64(loopRunning) / float64(span)
+		if u.GOMAXPROCS > 0 {
+			u.Idle = 1 - float64(allRunning)/float64(span*int64(u.GOMAXPROCS))
+			if u.Idle < 0 {
+				u.Idle = 0
+			}
+		}
+	}
+	if latencies > 0 {
+		u.SchedLatency = time.Duration(latency / latencies)
+	}
+	return u, nil
+}
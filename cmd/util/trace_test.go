@@ -0,0 +1,66 @@
+package util
+
+import (
+	"math"
+	"os"
+	"perfactor/graph"
+	"strings"
+	"testing"
+)
+
+// testdata/trace_parsed.txt is an excerpt of what go tool trace -d=parsed printed, with go1.27, for a benchmark of
+//
+//	func work(n int) []int {
+//		...
+//		for i := 0; i < n; i++ {
+//			wg.Add(1)
+//			go func(i int) {
+//
+// run with n = 4 on 2 Ps. It covers the four goroutines of one call, from their creation to their end
+func TestParseTrace(t *testing.T) {
+	src, err := os.ReadFile("testdata/trace_parsed.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	work := graph.File{Path: "work.go", Package: "tr"}
+	tests := []struct {
+		name     string
+		funcName string
+		file     graph.File
+		want     Utilisation
+	}{
+		{"goroutines of the loop", "work", work, Utilisation{
+			Goroutines:      4,
+			Span:            22656,
+			GOMAXPROCS:      2,
+			Parallelism:     13056.0 / 22656,
+			SchedLatency:    (1152 + 12224 + 10112 + 12608) / 4,
+			MaxSchedLatency: 12608,
+			Idle:            1 - 13056.0/(2*22656),
+		}},
+		{"function without goroutines", "BenchmarkWork", work, Utilisation{GOMAXPROCS: 2}},
+		{"file of another package", "work", graph.File{Path: "work.go", Package: "example.com/other"}, Utilisation{GOMAXPROCS: 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTrace(strings.NewReader(string(src)), tt.funcName, tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Goroutines != tt.want.Goroutines || got.Span != tt.want.Span || got.GOMAXPROCS != tt.want.GOMAXPROCS ||
+				got.SchedLatency != tt.want.SchedLatency || got.MaxSchedLatency != tt.want.MaxSchedLatency {
+				t.Errorf("parseTrace() = %+v, want %+v", got, tt.want)
+			}
+			if math.Abs(got.Parallelism-tt.want.Parallelism) > 1e-9 || math.Abs(got.Idle-tt.want.Idle) > 1e-9 {
+				t.Errorf("parallelism %v and idle %v, want %v and %v", got.Parallelism, got.Idle, tt.want.Parallelism, tt.want.Idle)
+			}
+		})
+	}
+}
+
+func TestParseTraceWithoutEvents(t *testing.T) {
+	_, err := parseTrace(strings.NewReader("M=-1 P=-1 G=-1 Sync Time=1 N=1\n"), "work", graph.File{Path: "work.go"})
+	if err == nil {
+		t.Errorf("parsing a trace without goroutine events gave no error")
+	}
+}
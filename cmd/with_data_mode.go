@@ -2,7 +2,10 @@ package cmd
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"github.com/google/pprof/profile"
 	"github.com/owenrumney/go-sarif/sarif"
 	"github.com/plus3it/gorecurcopy"
 	"go/ast"
@@ -11,7 +14,12 @@ import (
 	"golang.org/x/tools/go/packages"
 	"io"
 	"os"
+	"path/filepath"
 	"perfactor/cmd/util"
+	"perfactor/graph"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -26,6 +34,53 @@ type WithData struct {
 	out             io.Writer
 	tmpPath         string
 	sarifRun        *sarif.Run
+	ctx             context.Context
+	outcomes        []util.LoopOutcome
+	// skipVet is set when go vet already fails on the original code, since every candidate would then be rejected
+	skipVet bool
+	// skipRace is the same for the race detector, which may also be unsupported on this platform
+	skipRace bool
+	// checked holds the verdicts of the parallel check, which are on the original code, so they are dropped once a
+	// change is kept and every later candidate is checked together with the kept changes
+	checked map[token.Pos]*stageFailure
+	// workspace holds the packages of the workspace, loaded for the first candidate of the file and kept for the others
+	workspace *workspacePackages
+	// baseBinary is the test binary of the best version so far, which candidates are compared against when interleaving
+	baseBinary string
+	// benchName is the -bench pattern in use for the current file, discovered when none was given,
+	// and benchNames are the benchmarks it matches, which are run and profiled one at a time
+	benchName  string
+	benchNames []string
+	// originalNsPerOp and bestNsPerOp are the benchmarks' own summed time per op, which is what is reported
+	// Candidates are compared on each benchmark's time per op, in originalBench and bestBench, with util.Speedup
+	// The profile durations also cover setup and calibration rounds, so they are only reported alongside
+	originalNsPerOp float64
+	bestNsPerOp     float64
+	originalBench   map[string]float64
+	bestBench       map[string]float64
+	// interleavedOriginal is the baseline's time per op in the file's first interleaved comparison, and interleavedBest
+	// the accepted candidate's, so the report compares numbers from the same kind of run; interleavedBest is 0 when
+	// the best version was measured with go test instead
+	interleavedOriginal float64
+	interleavedBest     float64
+	// utilisation holds the trace analysis of each accepted loop, when tracing
+	utilisation []util.Utilisation
+	// baseProf and baseLoops are the profile and loops of the original file, which the final version is diffed against
+	// bestProf is the profile of the best version, if one was taken
+	// baseOutput and bestOutput are the benchmark output of the profiled runs, which give the work each profile covers
+	baseProf   *profile.Profile
+	baseLoops  []util.Loop
+	bestProf   *profile.Profile
+	baseOutput string
+	bestOutput string
+	// predictions are the modelled speedups of the loops, by position, to show next to the measured ones
+	predictions map[token.Pos]util.SpeedupPrediction
+	// spawnOverhead is the cost of a goroutine the predictions are made with, measured for the first file
+	spawnOverhead time.Duration
+	// loopStats are the counters of the candidate loops, by line, when they were instrumented
+	loopStats map[int]util.LoopStats
+	// patches are the diffs of the accepted loops, in the order they were accepted
+	patches []util.LoopPatch
 }
 
 func (f WithData) GetWorkingDirPath() string {
@@ -36,29 +91,29 @@ func (f WithData) WriteSarifFile(pf ProgramSettings) {
 	// in order to write the sarif file, we use the sarifRun object and write it to a file
 	report, err := sarif.New(sarif.Version210)
 	if err != nil {
-		println("Error creating SARIF report: " + err.Error())
+		_, _ = fmt.Fprintf(f.out, "Error creating SARIF report: %s\n", err.Error())
 		return
 	}
 	report.AddRun(f.sarifRun)
 	buffer := bytes.NewBufferString("")
 	err = report.Write(buffer)
 	if err != nil {
-		println("Error writing SARIF report: " + err.Error())
+		_, _ = fmt.Fprintf(f.out, "Error writing SARIF report: %s\n", err.Error())
 		return
 	}
 	// write the buffer to a serif file
 	create, err := os.Create(pf.Id + ".sarif")
 	if err != nil {
-		println("Error creating SARIF file: " + err.Error())
+		_, _ = fmt.Fprintf(f.out, "Error creating SARIF file: %s\n", err.Error())
 		return
 	}
 	defer create.Close()
 	_, err = create.Write(buffer.Bytes())
 	if err != nil {
-		println("Error writing SARIF file: " + err.Error())
+		_, _ = fmt.Fprintf(f.out, "Error writing SARIF file: %s\n", err.Error())
 		return
 	}
-	println("SARIF file written")
+	_, _ = fmt.Fprintf(f.out, "SARIF file written\n")
 }
 func (f WithData) SetupSarif() RefactoringMode {
 	f.sarifRun = sarif.NewRun("perfactor_w", "uri_placeholder")
@@ -84,6 +139,14 @@ func (f WithData) SetWorkingDirPath(pf ProgramSettings) RefactoringMode {
 		_, _ = fmt.Fprintf(f.out, "Does the destination have a go.mod file?\n")
 		return f
 	}
+	if len(pf.BenchTargets) > 0 {
+		harness, err := util.WriteBenchmarkHarness(tmpPath, pf.BenchTargets)
+		if err != nil {
+			_, _ = fmt.Fprintf(f.out, "Error generating benchmarks: %s\n", err.Error())
+			return f
+		}
+		_, _ = fmt.Fprintf(f.out, "Generated benchmarks in %s\n", harness)
+	}
 	f.tmpPath = tmpPath
 	return f
 }
@@ -93,6 +156,11 @@ func (f WithData) SetWriter(out io.Writer) RefactoringMode {
 	return f
 }
 
+func (f WithData) SetContext(ctx context.Context) RefactoringMode {
+	f.ctx = ctx
+	return f
+}
+
 func (f WithData) LoadFiles(fileSet *token.FileSet) RefactoringMode {
 	f.pkgs = parseFiles(f.tmpPath, fileSet, f.out)
 	return f
@@ -101,7 +169,7 @@ func (f WithData) LoadFiles(fileSet *token.FileSet) RefactoringMode {
 func (f WithData) GetLoopInfoArray(fileSet *token.FileSet, pkgName string, projectPath string, pf ProgramSettings) (RefactoringMode, util.LoopInfoArray) {
 	astFile, info, err := getFileFromPkgs(pkgName, pf.FileName, f.pkgs)
 	if err != nil {
-		println("Error parsing files: " + err.Error())
+		_, _ = fmt.Fprintf(f.out, "Error parsing files: %s\n", err.Error())
 		return f, nil
 	}
 	f.astFile = astFile
@@ -111,112 +179,876 @@ func (f WithData) GetLoopInfoArray(fileSet *token.FileSet, pkgName string, proje
 	loops := util.FindForLoopsInAST(astFile, fileSet, nil)
 	//Program analyses the given input file to find for-loops which are safe to make concurrent
 
-	//Program runs the benchmark to generate profiling data
-	result := util.RunCode(pf.Flags, pf.BenchName, "NONE", pf.Id, f.tmpPath+pf.FileName, f.tmpPath, true, pf.Count)
-	if strings.Contains(result, "FAIL") {
-		println("Error running benchmark")
+	output, err := util.VetPackage(f.ctx, pf.Timeout, f.tmpPath)
+	if err != nil {
+		_, _ = fmt.Fprintf(f.out, "Warning: go vet fails on the original code, so the vet stage will be skipped: %s\n", firstLine(output))
+		f.skipVet = true
+	}
+
+	if pf.Race {
+		raceResult := util.RunCodeContext(f.ctx, pf.Timeout, pf.Flags+" -race", "NONE", pf.TestName, pf.Id, f.tmpPath+pf.FileName, f.tmpPath, false, 1)
+		if races := util.ParseRaceReports(raceResult.Output); len(races) > 0 {
+			_, _ = fmt.Fprintf(f.out, "Warning: the original code already has %d data races, so the race stage will be skipped\n", len(races))
+			f.skipRace = true
+		} else if !raceResult.Ok() {
+			_, _ = fmt.Fprintf(f.out, "Warning: the tests do not pass under the race detector, so the race stage will be skipped: %s\n", raceResult.FailureSummary())
+			f.skipRace = true
+		}
+	}
+
+	f.benchName = pf.BenchName
+	if f.benchName == "" {
+		f.benchName = f.discoverBenchmarks(pf)
+		if f.benchName == "" {
+			return f, nil
+		}
+	}
+
+	f.benchNames, err = util.MatchingBenchmarks(f.ctx, pf.Timeout, f.tmpPath, f.benchName)
+	if err != nil {
+		_, _ = fmt.Fprintf(f.out, "Error listing benchmarks: %s\n", err.Error())
 		return f, nil
 	}
-	if strings.Contains(result, "no test files") {
-		println("Error running benchmark: no test files found")
+	if len(f.benchNames) == 0 {
+		_, _ = fmt.Fprintf(f.out, "Error running benchmark: no benchmarks match %s\n", f.benchName)
 		return f, nil
 	}
-	println(result)
 
-	// Get the profiling data from file
-	prof := util.GetProfileDataFromFile(f.tmpPath + "cpu.pprof")
+	//Program runs the benchmark to generate profiling data
+	prof, result := f.profileBenchmarks(pf)
+	if result.NoTestFiles {
+		_, _ = fmt.Fprintf(f.out, "Error running benchmark: no test files found\n")
+		return f, nil
+	}
+	if !result.Ok() {
+		_, _ = fmt.Fprintf(f.out, "Error running benchmark: %s\n", result.FailureSummary())
+		return f, nil
+	}
+	_, _ = fmt.Fprint(f.out, result.Output)
 	if prof == nil {
-		println("Error getting profiling data")
+		_, _ = fmt.Fprintf(f.out, "Error getting profiling data\n")
 		return f, nil
 	}
 
 	f.bestDuration = prof.DurationNanos
 	f.originalRuntime = prof.DurationNanos
+	f.baseProf = prof
+	f.baseLoops = loops
+	f.bestProf = nil
+	f.baseOutput = result.Output
+	f.bestOutput = ""
+	f.originalBench = util.BenchmarkNsPerOp(result.Output)
+	f.bestBench = f.originalBench
+	f.originalNsPerOp = util.SumNsPerOp(f.originalBench)
+	f.bestNsPerOp = f.originalNsPerOp
+	f.interleavedOriginal = 0
+	f.interleavedBest = 0
+	if f.originalNsPerOp == 0 {
+		_, _ = fmt.Fprintf(f.out, "Error running benchmark: no ns/op results in the output\n")
+		return f, nil
+	}
+	_, _ = fmt.Fprintf(f.out, "Original runtime: %s (profile duration %s)\n", util.FormatNsPerOp(f.originalNsPerOp), time.Duration(prof.DurationNanos))
 
 	safeLoops := util.FindSafeLoopsForRefactoring(loops, fileSet, nil, projectPath+pf.FileName, acceptMap, info, f.out)
 
+	// Loops are ranked on the given profiles if there are any, and the benchmarks only check the speedup
+	rankingProf := prof
+	if len(pf.Profiles) > 0 {
+		rankingProf, err = util.LoadProfiles(pf.Profiles, pf.ProjectPath)
+		if err != nil {
+			_, _ = fmt.Fprintf(f.out, "Error loading profiles: %s\n", err.Error())
+			return f, nil
+		}
+		_, _ = fmt.Fprintf(f.out, "Ranking loops using %d given profiles\n", len(pf.Profiles))
+	}
+
 	//Program analyses the profiling data to find which for-loops to prioritize
-	sortedLoops := util.SortLoopsUsingProfileData(prof, loops, fileSet)
+	var sortedLoops util.LoopInfoArray
+	if pf.Attribution == util.AttributionLabels && len(pf.Profiles) == 0 {
+		sortedLoops, rankingProf = f.rankByLabels(loops, prof, pf)
+	} else {
+		if pf.Attribution == util.AttributionLabels {
+			_, _ = fmt.Fprintf(f.out, "Warning: the given profiles have no loop labels, so the loops are ranked by their lines\n")
+		}
+		sortedLoops = util.SortLoopsUsingProfileData(rankingProf, loops, f.profileFile(pf), f.out)
+	}
+	f.warnIfUncovered(sortedLoops, safeLoops, pf)
 
-	thresholdNanos := int64((float32(prof.DurationNanos) / 100) * pf.Threshold)
-	f.loopsToRefactor = util.FilterLoopsUsingProfileData(safeLoops, sortedLoops, thresholdNanos)
+	thresholdNanos := int64((float32(util.ProfileTotal(rankingProf)) / 100) * pf.Threshold)
+	f.loopsToRefactor = util.FilterLoopsUsingProfileData(safeLoops, sortedLoops, thresholdNanos, f.out)
 	//Program combines the previous two to find which for-loops to prioritize, and which to ignore
+
+	f.loopStats = nil
+	if pf.Instrument && len(f.loopsToRefactor) > 0 {
+		f = f.instrumentLoops(pf)
+	}
+
+	if pf.Dependences && len(f.loopsToRefactor) > 0 {
+		f = f.checkDependences(info, pf)
+	}
+
+	f.predictions = nil
+	if pf.Predict {
+		f = f.predictSpeedups(info, util.ProfileTotal(rankingProf), pf)
+	}
+
+	// The hottest functions may be called from loops far up the call chain, in any file, so the graph is walked up from them
+	// The loops of this file that are the best place to parallelise them are tried first
+	hot := util.FindLoopsAboveHotFunctions(graph.GetGraphFromProfile(rankingProf), f.loopsByFile(fileSet), hotFunctionCount, func(file string, loop util.Loop) bool {
+		return file == pf.FileName && containsLoop(f.loopsToRefactor, loop.Pos)
+	})
+	util.WriteHotFunctions(f.out, hot)
+	f.loopsToRefactor = preferBestPoints(f.loopsToRefactor, hot)
+
+	if pf.Interleave > 0 && len(f.loopsToRefactor) > 0 {
+		f = f.buildBaseline(pf)
+	}
+
+	f.checked = nil
+	f.workspace = nil
+	if pf.Workers > 1 && len(f.loopsToRefactor) > 1 {
+		stages := checkSettings{vet: !f.skipVet, race: pf.Race && !f.skipRace}
+		f.checked = f.checkInParallel(f.loopsToRefactor, pkgName, pf, stages)
+	}
 	return f, f.loopsToRefactor
 }
 
 func (f WithData) RefactorLoop(loopInfo util.LoopInfo, pkgName string, pf ProgramSettings) (RefactoringMode, bool, error) {
-	newFileSet := token.NewFileSet()
-	var newAST *ast.File
-	var newInfo *types.Info
+	line := loopInfo.Loop.Line
+	stages := checkSettings{vet: !f.skipVet, race: pf.Race && !f.skipRace}
 
-	tmpFilePath := f.tmpPath + pf.FileName
-	f.pkgs = parseFiles(f.tmpPath, newFileSet, f.out)
+	// the parallel check ran against the original code, so its verdict only holds until a change has been kept
+	if failure, checked := f.checked[loopInfo.Loop.Pos]; checked {
+		if failure != nil {
+			return f.reject(loopInfo, pf, *failure)
+		}
+		stages.rewriteOnly = true
+	}
 
-	newAST, newInfo, err := getFileFromPkgs(pkgName, pf.FileName, f.pkgs)
+	if f.workspace == nil {
+		w, err := loadWorkspace(f.tmpPath)
+		if err != nil {
+			_, _ = fmt.Fprintf(f.out, "Error loading packages: %s\n", err.Error())
+			return f, false, err
+		}
+		f.workspace = w
+	}
+	c, err := checkCandidate(f.ctx, f.workspace, f.tmpPath, pkgName, line, pf, stages)
 	if err != nil {
-		println("Error parsing files: " + err.Error())
+		if f.ctx.Err() != nil {
+			return f.interrupted(pf)
+		}
+		_, _ = fmt.Fprintf(f.out, "Error parsing files: %s\n", err.Error())
 		return f, false, err
 	}
+	if c.failure != nil {
+		//If any stage fails, we discard the change and go back to the start of the loop
+		return f.reject(loopInfo, pf, *c.failure)
+	}
 
-	line := loopInfo.Loop.Line
-
-	// Do the refactoring of the loopPos
-	util.MakeLoopConcurrent(newAST, newFileSet, line, newInfo)
-
-	// ------ run benchmarks etc
-
-	//Program writes current state of AST to file, into a folder with a copy of the project (the tmp folder)
-	util.WriteModifiedAST(newFileSet, newAST, f.tmpPath, pf.FileName)
-
-	//Run the tests. If these pass, then it runs the benchmark
-	testResult := util.RunCode(pf.Flags, "NONE", pf.TestName, pf.Id, tmpFilePath, f.tmpPath, false, 1)
-	if strings.Contains(testResult, "FAIL") {
-		//If any tests fail, we discard the change and go back to the start of the loop
-		fmt.Printf("Test failed in %s for loop at line %v\n", pf.Id, line)
-		// write old version back, so we can try the next loop
-		util.WriteModifiedAST(f.fileSet, f.astFile, f.tmpPath, pf.FileName)
-		return f, false, nil
+	if f.baseBinary != "" {
+		return f.compareInterleaved(loopInfo, c, pf)
 	}
 
 	//If the tests pass, we run the benchmark
-	benchmarkResult := util.RunCode(pf.Flags, pf.BenchName, "NONE", pf.Id, tmpFilePath, f.tmpPath, true, pf.Count)
-	if strings.Contains(benchmarkResult, "FAIL") {
-		//If any tests fail, we discard the change and go back to the start of the loop
-		fmt.Printf("Benchmark failed in %s for loop at line %v\n", pf.Id, line)
-		// write old version back, so we can try the next loop
-		util.WriteModifiedAST(f.fileSet, f.astFile, f.tmpPath, pf.FileName)
-		return f, false, nil
+	tempProf, benchmarkResult := f.profileBenchmarks(pf)
+	if !benchmarkResult.Ok() {
+		if f.ctx.Err() != nil {
+			return f.interrupted(pf)
+		}
+		return f.reject(loopInfo, pf, stageFailure{stage: util.StageBenchmark, reason: benchmarkResult.FailureSummary(), detail: benchmarkResult.Output})
 	}
 
-	//If the benchmark scores better than the previous result, we keep the change.
-	tempProf := util.GetProfileDataFromFile(f.tmpPath + "cpu.pprof")
+	//If the benchmarks score better than the previous result, we keep the change.
+	bench := util.BenchmarkNsPerOp(benchmarkResult.Output)
+	nsPerOp := util.SumNsPerOp(bench)
+	speedup := util.Speedup(f.bestBench, bench)
+	if speedup == 0 {
+		return f.reject(loopInfo, pf, stageFailure{stage: util.StageBenchmark, reason: "no ns/op results", detail: benchmarkResult.Output})
+	}
+	// the profile is not compared, only shown
+	profileDuration := "no profile"
+	if tempProf != nil {
+		profileDuration = "profile duration " + time.Duration(tempProf.DurationNanos).String()
+	}
 
-	// get the duration from the profile for the loop on this line
+	contention := f.checkContention(loopInfo, pf)
 
 	// ---- finish up this iteration
-
-	// DurationNanos is the total duration of the test
-	// TimeNanos is the time when the test was run
-	if tempProf.DurationNanos < f.bestDuration {
-		fmt.Printf("Loop at line %v is now concurrent with an improvement of %s over the previous\n", line, time.Duration(f.bestDuration-tempProf.DurationNanos).String())
+	if speedup > 1 {
+		_, _ = fmt.Fprintf(f.out, "Loop at line %v is now concurrent with a speedup of %.2fx over the previous (%s, %s)%s\n", line, speedup, util.FormatNsPerOp(nsPerOp), profileDuration, f.predicted(loopInfo, speedup))
 		// If the new benchmark is better, we keep the change
-		f.bestDuration = tempProf.DurationNanos
+		f.patches = append(f.patches, newLoopPatch(f.out, f.patches, c.fileSet, c.astFile, pf, line, f.bestNsPerOp, nsPerOp, speedup))
+		f.bestNsPerOp = nsPerOp
+		f.bestBench = bench
+		f.interleavedBest = 0
+		if tempProf != nil {
+			f.bestDuration = tempProf.DurationNanos
+			f.bestProf = tempProf
+			f.bestOutput = benchmarkResult.Output
+		}
 		// update the astFile to the new copy
-		f.astFile = newAST
-		f.fileSet = newFileSet
+		f.astFile = c.astFile
+		f.fileSet = c.fileSet
+		f.checked = nil
 		f.loopsToRefactor.AddLines(loopInfo.Loop)
+		f.outcomes = append(f.outcomes, util.LoopOutcome{File: pf.FileName, Line: line, Accepted: true, Contention: contention})
+		f = f.traceAccepted(loopInfo, pf)
 		return f, true, nil
 	} else {
-		fmt.Printf("Loop at line %v gave a slowdown of %s over the previous\n", line, time.Duration(tempProf.DurationNanos-f.bestDuration).String())
+		_, _ = fmt.Fprintf(f.out, "Loop at line %v gave a speedup of only %.2fx over the previous (%s, %s)%s\n", line, speedup, util.FormatNsPerOp(nsPerOp), profileDuration, f.predicted(loopInfo, speedup))
+		f.outcomes = append(f.outcomes, util.LoopOutcome{File: pf.FileName, Line: line, Reason: "no improvement", Contention: contention})
 		// since we're not keeping the change, write the old ast back to file
 		util.WriteModifiedAST(f.fileSet, f.astFile, f.tmpPath, pf.FileName)
 		return f, false, nil
 	}
 }
 
+// predictSpeedups models the speedup of each loop to refactor, skips those predicted to be slower, and tries the rest
+// the most promising first, with those whose speedup is not known last. The model only knows the loop's share of the
+// time and its iteration count if the bounds are constant or the loop was instrumented, so the benchmark still decides
+func (f WithData) predictSpeedups(info *types.Info, total int64, pf ProgramSettings) WithData {
+	cores := benchmarkCores(pf.Flags)
+	if f.spawnOverhead == 0 {
+		// measured once per run, on the machine the benchmarks run on
+		f.spawnOverhead = util.MeasureSpawnOverhead()
+		_, _ = fmt.Fprintf(f.out, "Starting a goroutine and waiting for it takes %s on this machine\n", f.spawnOverhead)
+	}
+	f.predictions = make(map[token.Pos]util.SpeedupPrediction, len(f.loopsToRefactor))
+	kept := make(util.LoopInfoArray, 0, len(f.loopsToRefactor))
+	for _, loopInfo := range f.loopsToRefactor {
+		iterations := util.StaticIterations(loopInfo.Loop, info)
+		if stats, ok := f.loopStats[loopInfo.Loop.Line]; ok && iterations == 0 {
+			iterations = stats.TypicalTrips()
+		}
+		prediction := util.PredictSpeedup(loopInfo.Time, total, f.originalNsPerOp, iterations, cores, f.spawnOverhead)
+		f.predictions[loopInfo.Loop.Pos] = prediction
+		_, _ = fmt.Fprintf(f.out, "Loop at line %d is predicted to give %s\n", loopInfo.Loop.Line, prediction)
+		if prediction.Loses() {
+			mode, _, _ := f.reject(loopInfo, pf, stageFailure{stage: util.StagePrediction, reason: fmt.Sprintf("predicted to be slower (%.2fx)", prediction.PerIteration), detail: prediction.String()})
+			f = mode.(WithData)
+			continue
+		}
+		kept = append(kept, loopInfo)
+	}
+	sort.SliceStable(kept, func(i, j int) bool {
+		return f.predictions[kept[i].Loop.Pos].PerIteration > f.predictions[kept[j].Loop.Pos].PerIteration
+	})
+	f.loopsToRefactor = kept
+	return f
+}
+
+// predicted shows the predicted speedup of the loop next to the measured one, if there is a prediction
+func (f WithData) predicted(loopInfo util.LoopInfo, measured float64) string {
+	prediction, ok := f.predictions[loopInfo.Loop.Pos]
+	if !ok {
+		return ""
+	}
+	if !prediction.Known() {
+		return fmt.Sprintf("; predicted speedup unknown, measured %.2fx", measured)
+	}
+	return fmt.Sprintf("; predicted %.2fx, measured %.2fx", prediction.PerIteration, measured)
+}
+
+// benchmarkCores is the number of cores the benchmarks run with: the largest -cpu in the flags, or else GOMAXPROCS
+func benchmarkCores(flags string) int {
+	cores := 0
+	fields := strings.Fields(flags)
+	for i, field := range fields {
+		var list string
+		switch {
+		case strings.HasPrefix(field, "-cpu="):
+			list = strings.TrimPrefix(field, "-cpu=")
+		case field == "-cpu" && i+1 < len(fields):
+			list = fields[i+1]
+		default:
+			continue
+		}
+		for _, n := range strings.Split(list, ",") {
+			if c, err := strconv.Atoi(n); err == nil && c > cores {
+				cores = c
+			}
+		}
+	}
+	if cores == 0 {
+		cores = runtime.GOMAXPROCS(0)
+	}
+	return cores
+}
+
+// hotFunctionCount is how many of the hottest functions are traced up the call graph to their loops
+const hotFunctionCount = 10
+
+// loopsByFile finds the loops in every file of the workspace, keyed by the file
+func (f WithData) loopsByFile(fileSet *token.FileSet) map[graph.File][]util.Loop {
+	loops := make(map[graph.File][]util.Loop)
+	root, err := filepath.Abs(f.tmpPath)
+	if err != nil {
+		return loops
+	}
+	for _, pkg := range f.pkgs {
+		for _, file := range pkg.Syntax {
+			name, err := filepath.Rel(root, fileSet.Position(file.Pos()).Filename)
+			if err != nil {
+				continue
+			}
+			loops[graph.File{Path: filepath.ToSlash(name), Package: pkg.PkgPath}] = util.FindForLoopsInAST(file, fileSet, nil)
+		}
+	}
+	return loops
+}
+
+// profileFile is the file being refactored, as the frames of the profiles taken in the workspace are matched against it
+func (f WithData) profileFile(pf ProgramSettings) graph.File {
+	return util.ProjectFile(f.tmpPath, pf.FileName)
+}
+
+func containsLoop(loops util.LoopInfoArray, pos token.Pos) bool {
+	for _, lt := range loops {
+		if lt.Loop.Pos == pos {
+			return true
+		}
+	}
+	return false
+}
+
+// preferBestPoints moves the loops that are the best place to parallelise a hot function to the front, keeping the order otherwise
+func preferBestPoints(loops util.LoopInfoArray, hot []util.HotFunction) util.LoopInfoArray {
+	best := make(map[token.Pos]bool)
+	for _, h := range hot {
+		if h.Best != -1 {
+			best[h.Loops[h.Best].Loop.Pos] = true
+		}
+	}
+	sorted := make(util.LoopInfoArray, 0, len(loops))
+	for _, lt := range loops {
+		if best[lt.Loop.Pos] {
+			sorted = append(sorted, lt)
+		}
+	}
+	for _, lt := range loops {
+		if !best[lt.Loop.Pos] {
+			sorted = append(sorted, lt)
+		}
+	}
+	return sorted
+}
+
+// profileBenchmarks runs every benchmark in use, each count in its own process, and merges the profiles
+// The merged profile is nil if there were none, and the result holds the output of every run
+func (f WithData) profileBenchmarks(pf ProgramSettings) (*profile.Profile, util.TestResult) {
+	runs, result := util.ProfileBenchmarks(f.ctx, pf.Timeout, pf.Flags, pf.Id, f.tmpPath+pf.FileName, f.tmpPath, f.benchNames, pf.Count)
+	if !result.Ok() || len(runs) == 0 {
+		return nil, result
+	}
+	prof, err := util.MergeProfiles(runs, pf.Weights)
+	if err != nil {
+		_, _ = fmt.Fprintf(f.out, "Error merging profiles: %s\n", err.Error())
+		return nil, result
+	}
+	return prof, result
+}
+
+// discoverBenchmarks profiles each benchmark of the package, and picks the ones that spend time in the file
+// It returns an empty pattern if there are none, after saying why
+func (f WithData) discoverBenchmarks(pf ProgramSettings) string {
+	_, _ = fmt.Fprintf(f.out, "No benchmark given, looking for benchmarks that exercise %s\n", pf.FileName)
+	coverage, err := util.DiscoverBenchmarks(f.ctx, pf.Timeout, pf.Flags, f.tmpPath, pf.FileName)
+	if err != nil {
+		_, _ = fmt.Fprintf(f.out, "Error discovering benchmarks: %s\n", err.Error())
+		return ""
+	}
+	if len(coverage) == 0 {
+		_, _ = fmt.Fprintf(f.out, "Error: the package has no benchmarks, so there is no profile to guide the refactoring\n")
+		return ""
+	}
+	var chosen []string
+	for _, c := range coverage {
+		_, _ = fmt.Fprintf(f.out, "  %s\n", c)
+		if c.Err == nil && c.FileNanos > 0 {
+			chosen = append(chosen, c.Name)
+		}
+	}
+	if len(chosen) == 0 {
+		_, _ = fmt.Fprintf(f.out, "WARNING: none of the %d benchmarks spend any time in %s, so it is skipped\n", len(coverage), pf.FileName)
+		return ""
+	}
+	pattern := util.BenchmarkPattern(chosen)
+	_, _ = fmt.Fprintf(f.out, "Using the benchmarks %s; pass --benchname to choose others\n", pattern)
+	return pattern
+}
+
+// warnIfUncovered makes it obvious when the benchmark never reaches any of the loops that could be refactored,
+// since they would otherwise all just fall below the threshold
+func (f WithData) warnIfUncovered(sortedLoops util.LoopInfoArray, safeLoops []util.Loop, pf ProgramSettings) {
+	if len(safeLoops) == 0 {
+		return
+	}
+	safe := make(map[token.Pos]bool, len(safeLoops))
+	for _, loop := range safeLoops {
+		safe[loop.Pos] = true
+	}
+	for _, lt := range sortedLoops {
+		if safe[lt.Loop.Pos] && lt.Time > 0 {
+			return
+		}
+	}
+	if len(pf.Profiles) > 0 {
+		_, _ = fmt.Fprintf(f.out, "WARNING: the given profiles have no samples in any of the %d candidate loops in %s\n", len(safeLoops), pf.FileName)
+		_, _ = fmt.Fprintf(f.out, "WARNING: no loop will be refactored; were the profiles captured from this version of the code?\n")
+		return
+	}
+	_, _ = fmt.Fprintf(f.out, "WARNING: the benchmark %s has no samples in any of the %d candidate loops in %s\n", f.benchName, len(safeLoops), pf.FileName)
+	_, _ = fmt.Fprintf(f.out, "WARNING: no loop will be refactored; choose a benchmark that exercises them, or leave --benchname empty to find one\n")
+}
+
+// binPath is where the test binaries are kept, outside the workspace so the parallel check does not copy them
+func (f WithData) binPath(pf ProgramSettings) string {
+	return testBinaryFolder(pf.Id)
+}
+
+// testBinaryFolder is the folder of the session's test binaries, which is removed when the session ends
+func testBinaryFolder(id string) string {
+	return "_tmp" + p + id + "-bin" + p
+}
+
+// buildBaseline compiles the tests of the workspace, as it is before any loop of this file is refactored
+// If that fails, the candidates are compared using the profiles instead
+func (f WithData) buildBaseline(pf ProgramSettings) WithData {
+	f.baseBinary = ""
+	binPath := f.binPath(pf)
+	err := os.MkdirAll(binPath, os.ModePerm)
+	if err != nil {
+		_, _ = fmt.Fprintf(f.out, "Warning: could not create %s, comparing profiles instead: %s\n", binPath, err.Error())
+		return f
+	}
+	baseBinary := binPath + util.TestBinaryName("baseline")
+	err = util.BuildTestBinary(f.ctx, pf.Timeout, f.tmpPath, baseBinary)
+	if err != nil {
+		_, _ = fmt.Fprintf(f.out, "Warning: could not build the baseline test binary, comparing profiles instead: %s\n", firstLine(err.Error()))
+		return f
+	}
+	f.baseBinary = baseBinary
+	return f
+}
+
+// compareInterleaved builds the candidate in the workspace and runs it against the baseline binary in alternating rounds,
+// so both see the same machine state. The baseline is measured afresh for every comparison, rather than trusting an old number
+func (f WithData) compareInterleaved(loopInfo util.LoopInfo, c candidate, pf ProgramSettings) (RefactoringMode, bool, error) {
+	line := loopInfo.Loop.Line
+	candidateBinary := f.binPath(pf) + util.TestBinaryName("candidate")
+	// an accepted candidate has been renamed to the baseline by the time this runs, so only a rejected one is removed
+	defer func() {
+		if err := util.RemoveTestBinary(candidateBinary); err != nil {
+			_, _ = fmt.Fprintf(f.out, "Warning: could not remove the candidate test binary: %s\n", err.Error())
+		}
+	}()
+	err := util.BuildTestBinary(f.ctx, pf.Timeout, f.tmpPath, candidateBinary)
+	if err != nil {
+		if f.ctx.Err() != nil {
+			return f.interrupted(pf)
+		}
+		return f.reject(loopInfo, pf, stageFailure{stage: util.StageBenchmark, reason: "could not build the test binary", detail: err.Error()})
+	}
+	ab, err := util.RunInterleaved(f.ctx, pf.Timeout, f.baseBinary, candidateBinary, f.tmpPath, f.benchName, pf.Warmup, pf.Interleave)
+	if err != nil {
+		if f.ctx.Err() != nil {
+			return f.interrupted(pf)
+		}
+		reason := firstLine(err.Error())
+		if errors.Is(err, util.ErrTimeout) {
+			reason = util.FailureTimeout
+		}
+		return f.reject(loopInfo, pf, stageFailure{stage: util.StageBenchmark, reason: reason, detail: err.Error()})
+	}
+
+	contention := f.checkContention(loopInfo, pf)
+	baseline, candidate := ab.BaselineMedian(), ab.CandidateMedian()
+	if f.interleavedOriginal == 0 {
+		f.interleavedOriginal = baseline
+	}
+	speedup := ab.Speedup()
+	if !ab.Improved() {
+		_, _ = fmt.Fprintf(f.out, "Loop at line %v gave a speedup of only %.2fx over %d interleaved rounds: %s against %s%s\n", line, speedup, pf.Interleave, util.FormatNsPerOp(candidate), util.FormatNsPerOp(baseline), f.predicted(loopInfo, speedup))
+		f.outcomes = append(f.outcomes, util.LoopOutcome{File: pf.FileName, Line: line, Reason: "no improvement", Contention: contention})
+		util.WriteModifiedAST(f.fileSet, f.astFile, f.tmpPath, pf.FileName)
+		return f, false, nil
+	}
+
+	_, _ = fmt.Fprintf(f.out, "Loop at line %v is now concurrent with a speedup of %.2fx over %d interleaved rounds: %s against %s%s\n", line, speedup, pf.Interleave, util.FormatNsPerOp(candidate), util.FormatNsPerOp(baseline), f.predicted(loopInfo, speedup))
+	// the candidate is the new best, so later candidates are compared against it
+	err = os.Rename(candidateBinary, f.baseBinary)
+	if err != nil {
+		_, _ = fmt.Fprintf(f.out, "Warning: could not keep the candidate test binary, comparing profiles instead: %s\n", err.Error())
+		f.baseBinary = ""
+	}
+	f.patches = append(f.patches, newLoopPatch(f.out, f.patches, c.fileSet, c.astFile, pf, line, baseline, candidate, speedup))
+	f.bestNsPerOp = candidate
+	f.interleavedBest = candidate
+	// later candidates that fall back to go test are compared against these, and no profile was taken of the candidate
+	f.bestBench = ab.CandidateBench()
+	f.bestDuration = 0
+	f.bestProf = nil
+	f.bestOutput = ""
+	f.astFile = c.astFile
+	f.fileSet = c.fileSet
+	f.checked = nil
+	f.loopsToRefactor.AddLines(loopInfo.Loop)
+	f.outcomes = append(f.outcomes, util.LoopOutcome{File: pf.FileName, Line: line, Accepted: true, Contention: contention})
+	f = f.traceAccepted(loopInfo, pf)
+	return f, true, nil
+}
+
+// rankByLabels profiles the benchmarks in a copy of the workspace whose loops run under pprof labels, and ranks the
+// loops by them. It gives the labelled profile, which the threshold and the hot paths are then taken from, or falls back
+// to ranking by lines on the original profile if the copy cannot be profiled
+func (f WithData) rankByLabels(loops []util.Loop, prof *profile.Profile, pf ProgramSettings) (util.LoopInfoArray, *profile.Profile) {
+	labelsPath := "_tmp" + p + pf.Id + "-labels" + p
+	util.CleanOrCreateTempFolder(labelsPath)
+	err := gorecurcopy.CopyDirectory(f.tmpPath, labelsPath)
+	if err != nil {
+		_, _ = fmt.Fprintf(f.out, "Warning: could not copy the workspace to label its loops, so they are ranked by their lines: %s\n", err.Error())
+		return util.SortLoopsUsingProfileData(prof, loops, f.profileFile(pf), f.out), prof
+	}
+	wrapped, err := util.LabelLoops(labelsPath, pf.FileName)
+	if err != nil {
+		_, _ = fmt.Fprintf(f.out, "Warning: could not label the loops, so they are ranked by their lines: %s\n", err.Error())
+		return util.SortLoopsUsingProfileData(prof, loops, f.profileFile(pf), f.out), prof
+	}
+	runs, result := util.ProfileBenchmarks(f.ctx, pf.Timeout, pf.Flags, pf.Id+"-labels", labelsPath+pf.FileName, labelsPath, f.benchNames, pf.Count)
+	if !result.Ok() || len(runs) == 0 {
+		_, _ = fmt.Fprintf(f.out, "Warning: the benchmarks with labelled loops failed, so the loops are ranked by their lines: %s\n", result.FailureSummary())
+		return util.SortLoopsUsingProfileData(prof, loops, f.profileFile(pf), f.out), prof
+	}
+	labelled, err := util.MergeProfiles(runs, pf.Weights)
+	if err != nil {
+		_, _ = fmt.Fprintf(f.out, "Warning: could not merge the labelled profiles, so the loops are ranked by their lines: %s\n", err.Error())
+		return util.SortLoopsUsingProfileData(prof, loops, f.profileFile(pf), f.out), prof
+	}
+	var unwrapped []string
+	for _, loop := range loops {
+		if !wrapped[loop.Line] {
+			unwrapped = append(unwrapped, strconv.Itoa(loop.Line))
+		}
+	}
+	_, _ = fmt.Fprintf(f.out, "Ranking loops by pprof labels, with %d of %d loops labelled\n", len(loops)-len(unwrapped), len(loops))
+	if len(unwrapped) > 0 {
+		_, _ = fmt.Fprintf(f.out, "  The loops at lines %s return, defer or jump out, so they cannot be wrapped and are ranked by their lines\n", strings.Join(unwrapped, ", "))
+	}
+	return util.SortLoopsUsingLabels(labelled, loops, f.profileFile(pf), wrapped, f.out), labelled
+}
+
+// instrumentLoops runs the benchmarks once in a copy of the workspace whose candidate loops count their invocations
+// and iterations and time themselves, and reports the counters. The copy is separate, so the counters' overhead is
+// never in the timed runs
+func (f WithData) instrumentLoops(pf ProgramSettings) WithData {
+	instrumentPath := "_tmp" + p + pf.Id + "-instrument" + p
+	util.CleanOrCreateTempFolder(instrumentPath)
+	err := gorecurcopy.CopyDirectory(f.tmpPath, instrumentPath)
+	if err != nil {
+		_, _ = fmt.Fprintf(f.out, "Warning: could not copy the workspace to instrument it: %s\n", err.Error())
+		return f
+	}
+	lines := make([]int, len(f.loopsToRefactor))
+	for i, loopInfo := range f.loopsToRefactor {
+		lines[i] = loopInfo.Loop.Line
+	}
+	err = util.InstrumentLoops(instrumentPath, pf.FileName, lines)
+	if err != nil {
+		_, _ = fmt.Fprintf(f.out, "Warning: could not instrument the loops: %s\n", err.Error())
+		return f
+	}
+	stats, result := util.RunInstrumented(f.ctx, pf.Timeout, pf.Flags, instrumentPath, f.benchName)
+	if !result.Ok() {
+		_, _ = fmt.Fprintf(f.out, "Warning: the instrumented benchmarks failed: %s\n", result.FailureSummary())
+		return f
+	}
+	util.WriteLoopStats(f.out, pf.FileName, stats)
+	f.loopStats = stats
+	return f
+}
+
+// checkDependences runs the tests in a copy of the workspace that records every read and write the file makes by
+// iteration of the candidate loops, and rejects the loops seen to carry a dependence from one iteration to another
+// A loop the tests do not run for two iterations is kept, since the static rules found nothing against it, but one that
+// starts goroutines is rejected, since the recorder cannot follow the goroutines' accesses
+func (f WithData) checkDependences(info *types.Info, pf ProgramSettings) WithData {
+	checkable := make(util.LoopInfoArray, 0, len(f.loopsToRefactor))
+	var loops []util.Loop
+	for _, loopInfo := range f.loopsToRefactor {
+		if util.StartsGoroutines(loopInfo.Loop) {
+			mode, _, _ := f.reject(loopInfo, pf, stageFailure{stage: util.StageDependence, reason: "starts goroutines, whose accesses the dependence check cannot follow"})
+			f = mode.(WithData)
+			continue
+		}
+		checkable = append(checkable, loopInfo)
+		loops = append(loops, loopInfo.Loop)
+	}
+	f.loopsToRefactor = checkable
+	if len(loops) == 0 {
+		return f
+	}
+
+	checkPath := "_tmp" + p + pf.Id + "-dependences" + p
+	util.CleanOrCreateTempFolder(checkPath)
+	err := gorecurcopy.CopyDirectory(f.tmpPath, checkPath)
+	if err != nil {
+		_, _ = fmt.Fprintf(f.out, "Warning: could not copy the workspace to check for dependences: %s\n", err.Error())
+		return f
+	}
+	err = util.InstrumentAccesses(checkPath, pf.FileName, f.astFile, f.fileSet, info, loops)
+	if err != nil {
+		_, _ = fmt.Fprintf(f.out, "Warning: could not record the accesses of the loops: %s\n", err.Error())
+		return f
+	}
+	reports, result := util.RunDependenceCheck(f.ctx, pf.Timeout, pf.Flags, checkPath, pf.TestName, f.benchName)
+	if !result.Ok() {
+		_, _ = fmt.Fprintf(f.out, "Warning: the tests failed with the accesses recorded: %s\n", result.FailureSummary())
+		return f
+	}
+	kept := make(util.LoopInfoArray, 0, len(f.loopsToRefactor))
+	for _, loopInfo := range f.loopsToRefactor {
+		line := loopInfo.Loop.Line
+		report := reports[line]
+		if len(report.Conflicts) == 0 {
+			if report.Exercised() {
+				_, _ = fmt.Fprintf(f.out, "Loop at line %d carried no dependence over %d iterations in %d invocations\n", line, report.Iterations, report.Invocations)
+			} else {
+				_, _ = fmt.Fprintf(f.out, "Warning: the loop at line %d did not run two iterations in the tests, so its dependences are unchecked\n", line)
+			}
+			kept = append(kept, loopInfo)
+			continue
+		}
+		details := make([]string, len(report.Conflicts))
+		for i, conflict := range report.Conflicts {
+			details[i] = conflict.String()
+		}
+		mode, _, _ := f.reject(loopInfo, pf, stageFailure{stage: util.StageDependence, reason: "loop-carried dependence: " + details[0],
+			detail: strings.Join(details, "\n"), dependences: report.Conflicts})
+		f = mode.(WithData)
+	}
+	f.loopsToRefactor = kept
+	return f
+}
+
+// traceAccepted records an execution trace of the benchmarks with the loop just accepted, when pf.Trace is set,
+// and keeps how busy the loop's goroutines kept the Ps for the report
+func (f WithData) traceAccepted(loopInfo util.LoopInfo, pf ProgramSettings) WithData {
+	if !pf.Trace {
+		return f
+	}
+	line := loopInfo.Loop.Line
+	result := util.TraceBenchmarks(f.ctx, pf.Timeout, pf.Flags, f.tmpPath, f.benchName)
+	if !result.Ok() {
+		_, _ = fmt.Fprintf(f.out, "Warning: could not trace the loop at line %d: %s\n", line, result.FailureSummary())
+		return f
+	}
+	u, err := util.AnalyseTrace(f.ctx, pf.Timeout, f.tmpPath+util.TraceFileName, loopInfo.Loop.Func, f.profileFile(pf))
+	if err != nil {
+		_, _ = fmt.Fprintf(f.out, "Warning: could not analyse the trace of the loop at line %d: %s\n", line, err.Error())
+		return f
+	}
+	u.File, u.Line = pf.FileName, line
+	f.utilisation = append(f.utilisation, u)
+	return f
+}
+
+// checkContention runs the candidate's benchmarks with the block and mutex profiles on, when pf.Contention is set,
+// and flags the loop if the goroutines it starts are blocked for more than pf.Contention percent of the run,
+// naming the call sites they waited on. It gives a description of the contention if the loop is flagged
+// Loops made concurrent earlier in the same function start goroutines that cannot be told apart, so they are counted too
+func (f WithData) checkContention(loopInfo util.LoopInfo, pf ProgramSettings) string {
+	if pf.Contention <= 0 {
+		return ""
+	}
+	line := loopInfo.Loop.Line
+	block, mutex, result := util.MeasureContention(f.ctx, pf.Timeout, pf.Flags, f.tmpPath, f.benchName)
+	if !result.Ok() {
+		_, _ = fmt.Fprintf(f.out, "Warning: could not measure the contention of the loop at line %d: %s\n", line, result.FailureSummary())
+		return ""
+	}
+	if block == nil && mutex == nil {
+		_, _ = fmt.Fprintf(f.out, "Warning: no block or mutex profile of the loop at line %d\n", line)
+		return ""
+	}
+	elapsed := time.Duration(result.Elapsed * float64(time.Second))
+	contention := util.GoroutineContention(block, mutex, elapsed, loopInfo.Loop.Func, f.profileFile(pf))
+	if contention.Share() <= float64(pf.Contention) {
+		return ""
+	}
+
+	summary := fmt.Sprintf("goroutines blocked for %s in a %s run (%.1f%%)", time.Duration(contention.Delay), elapsed.Round(time.Millisecond), contention.Share())
+	if len(contention.Sites) > 0 {
+		summary += ", mostly in " + contention.Sites[0].Function
+	}
+	_, _ = fmt.Fprintf(f.out, "Contention: loop at line %d: %s\n", line, summary)
+	for _, site := range contention.Sites {
+		_, _ = fmt.Fprintf(f.out, "  %s\n", site)
+	}
+	if f.sarifRun != nil {
+		util.AddRunResultForLine(f.sarifRun, util.ContentionRuleID, "Contended refactoring ; "+summary, pf.FileName, line)
+	}
+	return summary
+}
+
+// reject discards a refactored loop, recording the stage that failed and why, and writes the old version back
+func (f WithData) reject(loopInfo util.LoopInfo, pf ProgramSettings, failure stageFailure) (RefactoringMode, bool, error) {
+	line := loopInfo.Loop.Line
+	detail := failure.detail
+	texts := make([]string, 0, len(failure.races))
+	for _, race := range failure.races {
+		texts = append(texts, race.Text)
+	}
+	if len(texts) > 0 {
+		detail = strings.Join(texts, "\n\n")
+	}
+
+	_, _ = fmt.Fprintf(f.out, "Rejected: %d ; %s failed: %s\n", line, failure.stage, failure.reason)
+	if f.sarifRun != nil {
+		ruleID := failure.stage.RuleID()
+		if failure.reason == util.FailureTimeout {
+			ruleID = "PERFACTOR_RUN_001"
+		}
+		result := util.AddRunResultForLine(f.sarifRun, ruleID, "Rejected refactoring ; "+string(failure.stage)+" failed: "+failure.reason, pf.FileName, line)
+		if len(texts) > 0 {
+			// attach the racing stack traces, and point at the lines of the refactored file that take part in the races
+			seen := make(map[int]bool)
+			for _, race := range failure.races {
+				for _, frame := range race.Frames {
+					if graph.IsFile(frame.File, frame.Function, f.profileFile(pf)) && !seen[frame.Line] {
+						seen[frame.Line] = true
+						result.WithRelatedLocation(sarif.NewLocationWithPhysicalLocation(sarif.NewPhysicalLocation().
+							WithArtifactLocation(sarif.NewArtifactLocation().WithUri(pf.FileName)).
+							WithRegion(sarif.NewRegion().WithStartLine(frame.Line))).
+							WithMessage(sarif.NewMessage().WithText(frame.Function)))
+					}
+				}
+			}
+			result.WithProperties(sarif.Properties{"raceReports": texts})
+		}
+		if len(failure.dependences) > 0 {
+			// point at the statements that made the two accesses of each dependence
+			seen := make(map[int]bool)
+			for _, dependence := range failure.dependences {
+				for _, access := range []int{dependence.First, dependence.Second} {
+					if !seen[access] {
+						seen[access] = true
+						result.WithRelatedLocation(sarif.NewLocationWithPhysicalLocation(sarif.NewPhysicalLocation().
+							WithArtifactLocation(sarif.NewArtifactLocation().WithUri(pf.FileName)).
+							WithRegion(sarif.NewRegion().WithStartLine(access))).
+							WithMessage(sarif.NewMessage().WithText(dependence.Kind)))
+					}
+				}
+			}
+		}
+	}
+	f.outcomes = append(f.outcomes, util.LoopOutcome{File: pf.FileName, Line: line, Stage: failure.stage, Reason: failure.reason, Detail: detail})
+	// write old version back, so we can try the next loop
+	util.WriteModifiedAST(f.fileSet, f.astFile, f.tmpPath, pf.FileName)
+	return f, false, nil
+}
+
+// interrupted puts the last kept version back when the run is cancelled part way through a loop
+func (f WithData) interrupted(pf ProgramSettings) (RefactoringMode, bool, error) {
+	util.WriteModifiedAST(f.fileSet, f.astFile, f.tmpPath, pf.FileName)
+	return f, false, f.ctx.Err()
+}
+
+func (f WithData) RecordSession(session util.Session) util.Session {
+	session.Outcomes = f.outcomes
+	session.Metrics = util.SessionMetrics{
+		OriginalRuntime: time.Duration(f.originalRuntime),
+		BestRuntime:     time.Duration(f.bestDuration),
+		OriginalNsPerOp: f.originalNsPerOp,
+		BestNsPerOp:     f.bestNsPerOp,
+	}
+	if f.interleavedBest > 0 {
+		session.Metrics.OriginalNsPerOp = f.interleavedOriginal
+		session.Metrics.BestNsPerOp = f.interleavedBest
+	}
+	return session
+}
+
+func (f WithData) WriteSummary(pf ProgramSettings) {
+	util.WriteOutcomeSummary(f.out, f.outcomes, pf.FileName)
+}
+
 func (f WithData) WriteResult(pf ProgramSettings) {
-	util.WriteModifiedAST(f.fileSet, f.astFile, pf.Output+p+pf.Id+p, pf.FileName)
-	println("Final version written to " + pf.Output + p + pf.Id + p + pf.FileName)
-	fmt.Printf("Original runtime: %s\n", time.Duration(f.originalRuntime))
-	fmt.Printf("New runtime: %s\n", time.Duration(f.bestDuration))
+	writePatches(f.out, f.patches, pf)
+	_, _ = fmt.Fprintf(f.out, "Original runtime: %s (profile duration %s)\n", util.FormatNsPerOp(f.originalNsPerOp), time.Duration(f.originalRuntime))
+	if f.interleavedBest > 0 {
+		// no profile is taken of the candidates when interleaving, and the interleaved runs are compared with each other
+		_, _ = fmt.Fprintf(f.out, "Interleaved runtime: %s at first, %s after the changes\n", util.FormatNsPerOp(f.interleavedOriginal), util.FormatNsPerOp(f.interleavedBest))
+	} else {
+		_, _ = fmt.Fprintf(f.out, "New runtime: %s (profile duration %s)\n", util.FormatNsPerOp(f.bestNsPerOp), time.Duration(f.bestDuration))
+	}
+	f.writeProfileDiff(pf)
+	f.writeUtilisation(pf)
+}
+
+// ResultPatch diffs the file in the project against the final version
+func (f WithData) ResultPatch(pf ProgramSettings) string {
+	return resultPatch(f.patches, pf)
+}
+
+// Patches gives the patches of the loops accepted in the file, in the order they were accepted
+func (f WithData) Patches(pf ProgramSettings) []util.LoopPatch {
+	var patches []util.LoopPatch
+	for _, lp := range f.patches {
+		if lp.File == pf.FileName {
+			patches = append(patches, lp)
+		}
+	}
+	return patches
+}
+
+// writeProfileDiff reports where the CPU time moved between the original and the final version
+// The benchmarks run for a set time, so a faster version runs more ops: the base is scaled by util.WorkScale, from
+// the ops and ns/op the benchmarks reported, to compare the same work. The profiles' durations also cover setup and
+// calibration rounds, so they are not used
+func (f WithData) writeProfileDiff(pf ProgramSettings) {
+	if f.baseProf == nil {
+		return
+	}
+	final, finalOutput := f.bestProf, f.bestOutput
+	if final == nil {
+		// when interleaving, the candidates are not profiled, so the final version is profiled now
+		prof, result := f.profileBenchmarks(pf)
+		if prof == nil {
+			_, _ = fmt.Fprintf(f.out, "Warning: could not profile the final version to diff it: %s\n", result.FailureSummary())
+			return
+		}
+		final, finalOutput = prof, result.Output
+	}
+	scale := util.WorkScale(f.baseOutput, finalOutput, pf.Weights)
+	if scale == 0 {
+		return
+	}
+	finalLoops := util.FindForLoopsInAST(f.astFile, f.fileSet, nil)
+	diff, err := util.DiffProfiles(f.baseProf, final, scale, f.baseLoops, finalLoops, f.profileFile(pf))
+	if err != nil {
+		_, _ = fmt.Fprintf(f.out, "Warning: could not diff the profiles: %s\n", err.Error())
+		return
+	}
+	diff.Write(f.out, pf.FileName)
+}
+
+// writeUtilisation adds the trace analysis of the file's accepted loops to the report
+func (f WithData) writeUtilisation(pf ProgramSettings) {
+	var lines []util.Utilisation
+	for _, u := range f.utilisation {
+		if u.File == pf.FileName {
+			lines = append(lines, u)
+		}
+	}
+	if len(lines) == 0 {
+		return
+	}
+	_, _ = fmt.Fprintf(f.out, "Goroutine utilisation of the %d accepted loops in %s:\n", len(lines), pf.FileName)
+	for _, u := range lines {
+		_, _ = fmt.Fprintf(f.out, "  %s\n", u)
+		if advice := u.Advice(); advice != "" {
+			_, _ = fmt.Fprintf(f.out, "    %s\n", advice)
+		}
+	}
 }
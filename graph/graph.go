@@ -23,9 +23,20 @@ import (
 	"github.com/google/pprof/profile"
 	"path/filepath"
 	"sort"
+	"strings"
 )
 
 func GetGraphFromProfile(prof *profile.Profile) *Graph {
+	return newGraph(prof, true)
+}
+
+// GetDiffGraphFromProfile builds the graph of a profile made by merging a profile with a base scaled by -1,
+// as pprof's -diff_base does. The nodes where time was saved are negative, so they are kept
+func GetDiffGraphFromProfile(prof *profile.Profile) *Graph {
+	return newGraph(prof, false)
+}
+
+func newGraph(prof *profile.Profile, dropNegative bool) *Graph {
 	// Create nodes
 	locations := make(map[uint64][]*Node, len(prof.Location))
 	nm := make(NodeMap, len(prof.Location))
@@ -79,6 +90,7 @@ func GetGraphFromProfile(prof *profile.Profile) *Graph {
 				if _, ok := seenEdge[NodePair{Src: n, Dest: parent}]; !ok &&
 					parent != nil && n != parent {
 					seenEdge[NodePair{Src: n, Dest: parent}] = true
+					// the edge is only inlined if every call along it is, as in pprof
 					if e := parent.Out[n]; e != nil {
 						e.WeightDiv += dw
 						e.Weight += w
@@ -88,10 +100,11 @@ func GetGraphFromProfile(prof *profile.Profile) *Graph {
 						if ni == len(locNodes)-1 {
 							e.Inline = false
 						}
+					} else {
+						info := &Edge{Src: parent, Dest: n, WeightDiv: dw, Weight: w, Residual: residual, Inline: ni != len(locNodes)-1}
+						parent.Out[n] = info
+						n.In[parent] = info
 					}
-					info := &Edge{Src: parent, Dest: n, WeightDiv: dw, Weight: w, Residual: residual, Inline: ni == len(locNodes)-1}
-					parent.Out[n] = info
-					n.In[parent] = info
 				}
 				parent = n
 				residual = false
@@ -102,7 +115,7 @@ func GetGraphFromProfile(prof *profile.Profile) *Graph {
 			parent.FlatDiv += dw
 		}
 	}
-	return SelectNodesForGraph(nodes, true)
+	return SelectNodesForGraph(nodes, dropNegative)
 }
 
 type NodePair struct {
@@ -123,18 +136,48 @@ type Graph struct {
 	Nodes Nodes
 }
 
-func (g Graph) FindNodesByLine(line int, end int) []*Node {
-	// returns all nodes in the graph with the given line number
-	nodes := make([]*Node, 0, len(g.Nodes))
-	for _, n := range g.Nodes {
-		if n.Info.Lineno >= line && n.Info.Lineno <= end {
-			nodes = append(nodes, n)
-		}
+// File is a file of the module, as the frames of a profile are matched against it
+type File struct {
+	// Path is the slash-separated path of the file in the module
+	Path string
+	// Package is the import path of the file's package, or empty if it is not known
+	Package string
+}
+
+// IsFile reports whether a frame of a profile, at path in the function funcName, is in the file
+// Profiles give the path the file had where the binary was built, or with -trimpath its package path and name, so
+// path must end with the file's path in the module. A file of another directory or module, such as a dependency's,
+// can end the same way, so the function must also be in the file's package; functions of a main package are named
+// after main rather than its path, and match any file's
+func IsFile(path string, funcName string, file File) bool {
+	if path == "" || file.Path == "" {
+		return false
+	}
+	path = filepath.ToSlash(filepath.Clean(path))
+	name := filepath.ToSlash(filepath.Clean(file.Path))
+	if path != name && !strings.HasSuffix(path, "/"+name) {
+		return false
 	}
-	if len(nodes) == 0 {
-		println("Loop on line", line, "was not found in the profile data")
+	if file.Package == "" || funcName == "" {
+		return true
 	}
-	return nodes
+	pkg := PackagePath(funcName)
+	return pkg == file.Package || pkg == "main"
+}
+
+// PackagePath gives the import path of the package of a function named in a profile, as in "example.com/m/pkg" for
+// "example.com/m/pkg.(*T).M"
+func PackagePath(funcName string) string {
+	// the type arguments of a generic function may have paths of their own
+	if bracket := strings.Index(funcName, "["); bracket != -1 {
+		funcName = funcName[:bracket]
+	}
+	slash := strings.LastIndex(funcName, "/")
+	if dot := strings.Index(funcName[slash+1:], "."); dot != -1 {
+		funcName = funcName[:slash+1+dot]
+	}
+	// the dots of the last element of the path are escaped, as in "gopkg.in/yaml%2ev3"
+	return strings.ReplaceAll(funcName, "%2e", ".")
 }
 
 func SelectNodesForGraph(nodes Nodes, dropNegative bool) *Graph {
@@ -290,3 +333,33 @@ func abs64(i int64) int64 {
 	}
 	return i
 }
+
+// WalkCallers visits every node that n is called from, at any depth, by following the In edges up the graph
+// depth counts the calls between the two nodes, so a caller on another line of the same function, which is only
+// an inlining step, keeps the depth of the node it was reached from. The walk is breadth first, and each node is visited
+// once, when it is first reached. If visit returns false, the nodes above the caller are not walked
+func (g Graph) WalkCallers(n *Node, visit func(caller *Node, depth int) bool) {
+	type step struct {
+		node  *Node
+		depth int
+	}
+	seen := map[*Node]bool{n: true}
+	queue := []step{{n, 0}}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for caller := range current.node.In {
+			if seen[caller] {
+				continue
+			}
+			seen[caller] = true
+			depth := current.depth
+			if caller.Info.Name != current.node.Info.Name {
+				depth++
+			}
+			if visit(caller, depth) {
+				queue = append(queue, step{caller, depth})
+			}
+		}
+	}
+}
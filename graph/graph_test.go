@@ -0,0 +1,58 @@
+package graph
+
+import "testing"
+
+func TestIsFile(t *testing.T) {
+	root := File{Path: "main.go", Package: "example.com/m"}
+	sub := File{Path: "sub/work.go", Package: "example.com/m/sub"}
+	tests := []struct {
+		name     string
+		path     string
+		funcName string
+		file     File
+		want     bool
+	}{
+		{"built in the workspace", "/tmp/_tmp/run/sub/work.go", "example.com/m/sub.Work", sub, true},
+		{"built with -trimpath", "example.com/m/sub/work.go", "example.com/m/sub.Work", sub, true},
+		{"method and closure", "/src/sub/work.go", "example.com/m/sub.(*T).Run.func1", sub, true},
+		{"generic function", "/src/sub/work.go", "example.com/m/sub.Map[go.shape.struct { X example.com/other.T }]", sub, true},
+		{"same name in another directory", "/src/other/work.go", "example.com/m/other.Work", sub, false},
+		{"same path in a dependency", "/go/pkg/mod/example.com/dep@v1.0.0/sub/work.go", "example.com/dep/sub.Work", sub, false},
+		{"root file against a file in a subdirectory", "/src/sub/main.go", "example.com/m/sub.Run", root, false},
+		{"root file", "/src/main.go", "example.com/m.Run", root, true},
+		{"main package", "/src/main.go", "main.main", File{Path: "main.go", Package: "example.com/cmd"}, true},
+		{"package not known", "/src/other/work.go", "example.com/m/other.Work", File{Path: "work.go"}, true},
+		{"only the end of the name", "/src/network.go", "example.com/m.Run", File{Path: "work.go", Package: "example.com/m"}, false},
+		{"no path", "", "example.com/m.Run", root, false},
+		{"no file", "/src/main.go", "example.com/m.Run", File{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsFile(tt.path, tt.funcName, tt.file); got != tt.want {
+				t.Errorf("IsFile(%q, %q, %+v) = %v, want %v", tt.path, tt.funcName, tt.file, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPackagePath(t *testing.T) {
+	tests := []struct {
+		funcName string
+		want     string
+	}{
+		{"main.main", "main"},
+		{"example.com/m.Run", "example.com/m"},
+		{"example.com/m/pkg.(*T).M", "example.com/m/pkg"},
+		{"example.com/m/pkg.work.func1", "example.com/m/pkg"},
+		{"gopkg.in/yaml%2ev3.Unmarshal", "gopkg.in/yaml.v3"},
+		{"example.com/m/pkg.Map[...]", "example.com/m/pkg"},
+		{"runtime", "runtime"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.funcName, func(t *testing.T) {
+			if got := PackagePath(tt.funcName); got != tt.want {
+				t.Errorf("PackagePath(%q) = %q, want %q", tt.funcName, got, tt.want)
+			}
+		})
+	}
+}
@@ -183,13 +183,3 @@ func findPossibleRefactorings(path string, src any) {
 	fmt.Println()
 }
 */
-
-// Apply refactoring (temp folder, or actual code)
-func applyRefactoring() {
-
-}
-
-// Suggest a change to be made
-func suggestChange() {
-
-}